@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/home-sol/multicast-proxy/pkg/net/reflector"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var cmdConfig = &cobra.Command{
+	Use:   "config",
+	Short: "Configuration commands",
+}
+
+var cmdConfigCheck = &cobra.Command{
+	Use:   "check [file]",
+	Short: "Validate the reflector configuration",
+	Long: `Validate the reflector configuration and report every problem found.
+If no file is given, the configuration is looked up the same way as by serve.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 1 {
+			viper.SetConfigFile(args[0])
+		}
+		cfg, err := readConfig()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Configuration %s is valid: %d devices, %d selectors\n", viper.ConfigFileUsed(), len(cfg.Devices), len(cfg.Selectors))
+		return nil
+	},
+}
+
+func init() {
+	cmdConfig.AddCommand(cmdConfigCheck)
+}
+
+func setupConfig() {
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath("/etc/home-sol/multicast-proxy/")
+	viper.AddConfigPath("$HOME/.multicast-proxy")
+	viper.AddConfigPath(".")
+	viper.AutomaticEnv()
+}
+
+// readConfig reads the config file and returns the validated configuration.
+func readConfig() (*reflector.Config, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	return unmarshalConfig()
+}
+
+func unmarshalConfig() (*reflector.Config, error) {
+	var cfg reflector.Config
+	if err := viper.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
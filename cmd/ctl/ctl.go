@@ -0,0 +1,87 @@
+package ctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/home-sol/multicast-proxy/pkg/admin"
+	"github.com/spf13/cobra"
+)
+
+var cmdCtl = &cobra.Command{
+	Use:   "ctl",
+	Short: "Inspect and control a running multicast reflector",
+	Long:  "Inspect and control a running multicast reflector through its admin API (see serve --admin-address)",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := cmd.Root().PersistentPreRunE(cmd, args); err != nil {
+			return err
+		}
+		switch output {
+		case "table", "json":
+			return nil
+		default:
+			return fmt.Errorf("invalid output format %q, expected table or json", output)
+		}
+	},
+}
+
+var (
+	address string
+	output  string
+)
+
+func Setup(cmd *cobra.Command) {
+	cmdCtl.PersistentFlags().StringVarP(&address, "address", "a", admin.DefaultAddress, "Address of the admin API, either unix:<path> or host:port")
+	cmdCtl.PersistentFlags().StringVarP(&output, "output", "o", "table", "Output format: table or json")
+
+	cmdCtl.AddCommand(cmdDevices)
+	cmdCtl.AddCommand(cmdPools)
+	cmdCtl.AddCommand(cmdRegistry)
+	cmdCtl.AddCommand(cmdTrace)
+	cmdCtl.AddCommand(cmdReload)
+	cmd.AddCommand(cmdCtl)
+}
+
+func client() *admin.Client {
+	return admin.NewClient(address)
+}
+
+// render prints v as indented JSON, or as a table produced by table when the
+// table output is selected.
+func render(v interface{}, table func(w io.Writer)) error {
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(tw)
+	return tw.Flush()
+}
+
+func row(w io.Writer, columns ...interface{}) {
+	cells := make([]string, len(columns))
+	for i, c := range columns {
+		cells[i] = fmt.Sprint(c)
+	}
+	_, _ = fmt.Fprintln(w, strings.Join(cells, "\t"))
+}
+
+func join(values interface{}) string {
+	s := strings.Trim(fmt.Sprint(values), "[]")
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(s, " ", ",")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
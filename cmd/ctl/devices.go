@@ -0,0 +1,27 @@
+package ctl
+
+import (
+	"io"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdDevices = &cobra.Command{
+	Use:   "devices",
+	Short: "List devices seen by the reflector",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		devices, err := client().Devices(cmd.Context())
+		if err != nil {
+			return err
+		}
+		return render(devices, func(w io.Writer) {
+			row(w, "MAC", "IP", "VLAN", "HOSTNAME", "MATCHED BY", "PROTOCOLS", "LAST SEEN")
+			for _, d := range devices {
+				row(w, d.MAC, orDash(d.IP), d.VLAN, orDash(d.Hostname), orDash(d.MatchedBy), join(d.Protocols),
+					time.Since(d.LastSeen).Truncate(time.Second).String()+" ago")
+			}
+		})
+	},
+}
@@ -0,0 +1,37 @@
+package ctl
+
+import (
+	"io"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdPools = &cobra.Command{
+	Use:   "pools",
+	Short: "Show pools and the route table",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pools, err := client().Pools(cmd.Context())
+		if err != nil {
+			return err
+		}
+		return render(pools, func(w io.Writer) {
+			names := make([]string, 0, len(pools.Pools))
+			for name := range pools.Pools {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			row(w, "POOL", "VLAN", "DESCRIPTION")
+			for _, name := range names {
+				row(w, name, pools.Pools[name].VLAN, orDash(pools.Pools[name].Description))
+			}
+			row(w)
+			row(w, "VLAN", "KIND", "PROTOCOL", "FORWARDED TO")
+			for _, r := range pools.Routes {
+				row(w, r.VLAN, r.Kind, r.Protocol, join(r.To))
+			}
+		})
+	},
+}
@@ -0,0 +1,26 @@
+package ctl
+
+import (
+	"io"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdRegistry = &cobra.Command{
+	Use:   "registry",
+	Short: "List SSDP devices and services known to the reflector",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entries, err := client().Registry(cmd.Context())
+		if err != nil {
+			return err
+		}
+		return render(entries, func(w io.Writer) {
+			row(w, "USN", "NT", "LOCATION", "FROM", "EXPIRES IN")
+			for _, e := range entries {
+				row(w, e.USN, orDash(e.NT), orDash(e.Location), e.RemoteAddr, time.Until(e.CacheExpiry).Truncate(time.Second))
+			}
+		})
+	},
+}
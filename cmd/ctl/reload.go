@@ -0,0 +1,20 @@
+package ctl
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdReload = &cobra.Command{
+	Use:   "reload",
+	Short: "Make the reflector re-read its configuration",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := client().Reload(cmd.Context()); err != nil {
+			return err
+		}
+		fmt.Println("Configuration reloaded")
+		return nil
+	},
+}
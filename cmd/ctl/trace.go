@@ -0,0 +1,48 @@
+package ctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/home-sol/multicast-proxy/pkg/admin"
+	"github.com/home-sol/multicast-proxy/pkg/net/reflector"
+	"github.com/home-sol/multicast-proxy/pkg/trace"
+	"github.com/spf13/cobra"
+)
+
+var cmdTrace = &cobra.Command{
+	Use:   "trace",
+	Short: "Show recent forwarding decisions",
+	Long:  "Show recent forwarding decisions. See the top-level trace command for filters and other output formats.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if follow {
+			return client().FollowDecisions(cmd.Context(), admin.TraceQuery{}, printDecision)
+		}
+		decisions, err := client().Decisions(cmd.Context())
+		if err != nil {
+			return err
+		}
+		return render(decisions, func(w io.Writer) {
+			for _, d := range decisions {
+				row(w, trace.Format(d))
+			}
+		})
+	},
+}
+
+var follow bool
+
+func init() {
+	cmdTrace.Flags().BoolVarP(&follow, "follow", "f", false, "Stream new decisions as they are made")
+}
+
+func printDecision(d reflector.Decision) error {
+	if output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(d)
+	}
+	_, err := fmt.Println(trace.Format(d))
+	return err
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+	"github.com/home-sol/multicast-proxy/pkg/net/dnssd"
+	"github.com/home-sol/multicast-proxy/pkg/net/mdns"
+	"github.com/home-sol/multicast-proxy/pkg/net/multicast"
+	"github.com/home-sol/multicast-proxy/pkg/net/netwatch"
+	"github.com/home-sol/multicast-proxy/pkg/net/reflector"
+)
+
+// dnsLinks keeps the links of the DNS gateway in sync with the pools that
+// have a dns_domain: a cache per VLAN, fed by the reflector capture, and an
+// mDNS connection per mdns_interface, which queries for names not seen yet
+// and feeds the answers into the cache of its pool.
+type dnsLinks struct {
+	ctx     context.Context
+	gateway *dnssd.Gateway
+	watcher *netwatch.Watcher
+
+	lock   sync.Mutex
+	caches map[uint16]*dnssd.Cache
+	conns  map[string]*dnsConn
+}
+
+type dnsConn struct {
+	conn   *mdns.Conn
+	cancel context.CancelFunc
+	// cache receives the responses read from conn. It changes if the
+	// interface is moved to another pool.
+	cache *dnssd.Cache
+}
+
+func newDNSLinks(ctx context.Context, gateway *dnssd.Gateway, watcher *netwatch.Watcher) *dnsLinks {
+	return &dnsLinks{
+		ctx:     ctx,
+		gateway: gateway,
+		watcher: watcher,
+		caches:  make(map[uint16]*dnssd.Cache),
+		conns:   make(map[string]*dnsConn),
+	}
+}
+
+// observe adds an mDNS response captured on vlan to the cache of its pool.
+func (l *dnsLinks) observe(vlan uint16, msg *layers.DNS) {
+	l.lock.Lock()
+	cache := l.caches[vlan]
+	l.lock.Unlock()
+	if cache != nil {
+		cache.Observe(msg)
+	}
+}
+
+// update applies the pools of cfg. Caches of pools that keep their VLAN are
+// kept; connections on interfaces no longer used are closed.
+func (l *dnsLinks) update(cfg *reflector.Config) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	caches := make(map[uint16]*dnssd.Cache)
+	used := make(map[string]bool)
+	var links []dnssd.Link
+	for name, pool := range cfg.Pools {
+		if pool.DNSDomain == "" {
+			continue
+		}
+		cache := l.caches[pool.VLAN]
+		if cache == nil {
+			cache = dnssd.NewCache()
+		}
+		caches[pool.VLAN] = cache
+		link := dnssd.Link{Domain: pool.DNSDomain, Cache: cache}
+		if pool.MDNSInterface != "" {
+			used[pool.MDNSInterface] = true
+			conn, err := l.connLocked(pool.MDNSInterface, cache)
+			if err != nil {
+				logger.Warn("Cannot query mDNS for the DNS gateway", "pool", name, "interface", pool.MDNSInterface, "error", err)
+			} else {
+				link.Query = conn.conn.Query
+			}
+		}
+		links = append(links, link)
+	}
+	for name, conn := range l.conns {
+		if !used[name] {
+			conn.cancel()
+			delete(l.conns, name)
+		}
+	}
+	l.caches = caches
+	l.gateway.SetLinks(links)
+}
+
+// connLocked returns the connection on the named interface, opening it if
+// needed, and directs its responses to cache.
+func (l *dnsLinks) connLocked(name string, cache *dnssd.Cache) (*dnsConn, error) {
+	if conn, ok := l.conns[name]; ok {
+		conn.cache = cache
+		return conn, nil
+	}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := mdns.Listen([]net.Interface{*ifi}, multicast.WithLogger(logger))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(l.ctx)
+	c := &dnsConn{conn: conn, cancel: cancel, cache: cache}
+	l.conns[name] = c
+	go multicast.Rejoin(ctx, conn.GroupConn(), conn.Group(), l.watcher, netwatch.MatchNames(name))
+	context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	go l.read(ctx, c)
+	return c, nil
+}
+
+// read feeds the responses received on c into its cache until ctx is done.
+func (l *dnsLinks) read(ctx context.Context, c *dnsConn) {
+	for {
+		msg, _, err := c.conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Warn("DNS gateway stopped reading mDNS", "error", err)
+			}
+			return
+		}
+		l.lock.Lock()
+		cache := c.cache
+		l.lock.Unlock()
+		cache.Observe(msg)
+	}
+}
@@ -0,0 +1,87 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/home-sol/multicast-proxy/pkg/net/mdns"
+	"github.com/spf13/cobra"
+)
+
+var cmdBrowse = &cobra.Command{
+	Use:   "browse [service type]",
+	Short: "Browse DNS-SD services",
+	Long: `Browse DNS-SD services of a type, e.g. _ipp._tcp, and print them as they are
+added, updated or removed. Each instance is resolved to its host, port, TXT
+record and addresses. With --all, every service type announced is browsed.`,
+	Args:    cobra.MaximumNArgs(1),
+	PreRunE: resolveInterfaces,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var serviceType string
+		switch {
+		case browseAll:
+			serviceType = mdns.ServicesType
+		case len(args) == 1:
+			serviceType = args[0]
+		default:
+			return errors.New("a service type or --all is required")
+		}
+
+		ctx := cmd.Context()
+		if browseTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, browseTimeout)
+			defer cancel()
+		}
+
+		conn, err := mdns.Listen(interfaces)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := conn.Close(); err != nil {
+				slog.Warn("Error closing connection", "error", err)
+			}
+		}()
+
+		events, wait := mdns.Browse(ctx, conn, serviceType)
+		out := cmd.OutOrStdout()
+		for event := range events {
+			printService(out, event.Type.String(), event.Service)
+		}
+		return wait()
+	},
+}
+
+// printService prints a service as a tab-separated line.
+func printService(out io.Writer, prefix string, s mdns.Service) {
+	intf := s.Interface
+	if intf == "" {
+		intf = "-"
+	}
+	addrs := make([]string, len(s.Addrs))
+	for i, addr := range s.Addrs {
+		addrs[i] = addr.String()
+	}
+	fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\n", prefix, intf, s.Instance,
+		net.JoinHostPort(s.Host, strconv.Itoa(int(s.Port))), strings.Join(addrs, ","), strings.Join(s.Text, " "))
+}
+
+var (
+	browseAll     bool
+	browseTimeout time.Duration
+)
+
+func init() {
+	flags := cmdBrowse.Flags()
+	flags.StringArrayVarP(&interfaceNames, "interface", "i", nil, "Interfaces to browse on by name, e.g. eth0, wlan0, etc.; if not specified, all interfaces will be used")
+	flags.BoolVar(&browseAll, "all", false, "Browse every service type, found through "+mdns.ServicesType)
+	flags.DurationVar(&browseTimeout, "timeout", 0, "How long to browse; until interrupted if 0")
+}
@@ -0,0 +1,185 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+	"github.com/home-sol/multicast-proxy/pkg/net/mdns"
+	"github.com/home-sol/multicast-proxy/pkg/net/multicast"
+	"github.com/home-sol/multicast-proxy/pkg/net/netwatch"
+	"github.com/spf13/cobra"
+)
+
+var cmdListen = &cobra.Command{
+	Use:   "listen",
+	Short: "Listen for mDNS messages",
+	Long: `Listen for mDNS messages on 224.0.0.251 and ff02::fb and print their questions
+and records decoded, with the source address and the interface they arrived
+on.`,
+	PreRunE: resolveInterfaces,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var listens []func([]net.Interface, ...multicast.Option) (*mdns.Conn, error)
+		switch listenNetwork {
+		case "udp4":
+			listens = append(listens, mdns.Listen)
+		case "udp6":
+			listens = append(listens, mdns.ListenIPv6)
+		case "udp":
+			listens = append(listens, mdns.Listen, mdns.ListenIPv6)
+		default:
+			return fmt.Errorf("unknown network %q, expected udp4, udp6 or udp", listenNetwork)
+		}
+
+		var conns []*mdns.Conn
+		defer func() {
+			for _, conn := range conns {
+				if err := conn.Close(); err != nil {
+					slog.Warn("Error closing connection", "error", err)
+				}
+			}
+		}()
+		var errs []error
+		for _, listen := range listens {
+			conn, err := listen(interfaces)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			conns = append(conns, conn)
+		}
+		if len(conns) == 0 {
+			return errors.Join(errs...)
+		}
+		for _, err := range errs {
+			slog.Warn("Not listening on all networks", "error", err)
+		}
+
+		watcher, err := netwatch.New()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := watcher.Run(cmd.Context()); err != nil {
+				slog.Warn("Interface watcher stopped", "error", err)
+			}
+		}()
+
+		ctx, cancel := context.WithCancel(cmd.Context())
+		defer cancel()
+		out := &lockedWriter{w: cmd.OutOrStdout()}
+		readErrs := make(chan error, len(conns))
+		for _, conn := range conns {
+			go multicast.Rejoin(ctx, conn.GroupConn(), conn.Group(), watcher, netwatch.MatchNames(interfaceNames...))
+			go func(conn *mdns.Conn) {
+				readErrs <- printMessages(out, conn)
+			}(conn)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErrs:
+			return err
+		}
+	},
+}
+
+// printMessages prints the messages received on conn until reading fails.
+func printMessages(out io.Writer, conn *mdns.Conn) error {
+	for {
+		msg, src, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		writeMessage(&b, msg, src)
+		_, _ = io.WriteString(out, b.String())
+	}
+}
+
+// writeMessage writes a message header line followed by one line per
+// question and record.
+func writeMessage(b *strings.Builder, msg *layers.DNS, src mdns.Source) {
+	kind := "query"
+	if msg.QR {
+		kind = "response"
+	}
+	intf := src.Interface
+	if intf == "" {
+		intf = "-"
+	}
+	fmt.Fprintf(b, "%s from %s on %s to %s id=%d\n", kind, src.Addr, intf, src.Dst, msg.ID)
+	for _, q := range msg.Questions {
+		bit := "QM"
+		if mdns.UnicastResponse(q) {
+			bit = "QU"
+		}
+		fmt.Fprintf(b, "  question\t%s\t%s\t%s\t%s\n", q.Name, q.Type, mdns.Class(q.Class), bit)
+	}
+	for _, section := range []struct {
+		name    string
+		records []layers.DNSResourceRecord
+	}{
+		{"answer", msg.Answers},
+		{"authority", msg.Authorities},
+		{"additional", msg.Additionals},
+	} {
+		for _, rr := range section.records {
+			flush := ""
+			if mdns.CacheFlush(rr) {
+				flush = "flush"
+			}
+			fmt.Fprintf(b, "  %s\t%s\t%s\t%s\tttl=%d\t%s\t%s\n", section.name, rr.Name, rr.Type, mdns.Class(rr.Class), rr.TTL, flush, recordData(rr))
+		}
+	}
+}
+
+// recordData formats the data of a record.
+func recordData(rr layers.DNSResourceRecord) string {
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		return rr.IP.String()
+	case layers.DNSTypePTR:
+		return string(rr.PTR)
+	case layers.DNSTypeCNAME:
+		return string(rr.CNAME)
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%d %d %s", rr.SRV.Priority, rr.SRV.Weight, net.JoinHostPort(string(rr.SRV.Name), strconv.Itoa(int(rr.SRV.Port))))
+	case layers.DNSTypeTXT:
+		txts := make([]string, len(rr.TXTs))
+		for i, txt := range rr.TXTs {
+			txts[i] = strconv.Quote(string(txt))
+		}
+		return strings.Join(txts, " ")
+	default:
+		return fmt.Sprintf("%d bytes", len(rr.Data))
+	}
+}
+
+// lockedWriter serializes writes from several goroutines.
+type lockedWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.w.Write(p)
+}
+
+var listenNetwork string
+
+func init() {
+	flags := cmdListen.Flags()
+	flags.StringArrayVarP(&interfaceNames, "interface", "i", nil, "Interfaces to listen on by name, e.g. eth0, wlan0, etc.; if not specified, all interfaces will be used")
+	flags.StringVar(&listenNetwork, "network", "udp", "Network to listen on: udp4, udp6 or udp for both")
+}
@@ -0,0 +1,50 @@
+package mdns
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/home-sol/multicast-proxy/pkg/net/mdns"
+)
+
+func TestWriteMessage(t *testing.T) {
+	const flush = layers.DNSClassIN | 0x8000
+	msg := &layers.DNS{
+		QR: true,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN},
+			{Name: []byte("printer.local"), Type: layers.DNSTypeA, Class: flush},
+		},
+		Answers: []layers.DNSResourceRecord{
+			{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: 4500, PTR: []byte("Printer._ipp._tcp.local")},
+			{Name: []byte("Printer._ipp._tcp.local"), Type: layers.DNSTypeSRV, Class: flush, TTL: 120,
+				SRV: layers.DNSSRV{Priority: 0, Weight: 0, Port: 631, Name: []byte("printer.local")}},
+		},
+		Additionals: []layers.DNSResourceRecord{
+			{Name: []byte("Printer._ipp._tcp.local"), Type: layers.DNSTypeTXT, Class: flush, TTL: 4500, TXTs: [][]byte{[]byte("rp=ipp/print"), []byte(`note="2nd floor"`)}},
+			{Name: []byte("printer.local"), Type: layers.DNSTypeAAAA, Class: flush, TTL: 120, IP: net.ParseIP("fe80::1")},
+		},
+	}
+	src := mdns.Source{Addr: &net.UDPAddr{IP: net.ParseIP("192.168.1.50"), Port: 5353}, Dst: net.ParseIP("224.0.0.251"), Interface: "eth0"}
+
+	var b strings.Builder
+	writeMessage(&b, msg, src)
+	want := "response from 192.168.1.50:5353 on eth0 to 224.0.0.251 id=0\n" +
+		"  question\t_ipp._tcp.local\tPTR\tIN\tQM\n" +
+		"  question\tprinter.local\tA\tIN\tQU\n" +
+		"  answer\t_ipp._tcp.local\tPTR\tIN\tttl=4500\t\tPrinter._ipp._tcp.local\n" +
+		"  answer\tPrinter._ipp._tcp.local\tSRV\tIN\tttl=120\tflush\t0 0 printer.local:631\n" +
+		"  additional\tPrinter._ipp._tcp.local\tTXT\tIN\tttl=4500\tflush\t\"rp=ipp/print\" \"note=\\\"2nd floor\\\"\"\n" +
+		"  additional\tprinter.local\tAAAA\tIN\tttl=120\tflush\tfe80::1\n"
+	if got := b.String(); got != want {
+		t.Errorf("writeMessage =\n%s\nwant\n%s", got, want)
+	}
+
+	b.Reset()
+	writeMessage(&b, &layers.DNS{ID: 7}, mdns.Source{Addr: &net.UDPAddr{IP: net.ParseIP("fe80::2"), Port: 5353}, Dst: net.ParseIP("ff02::fb")})
+	if got, want := b.String(), "query from [fe80::2]:5353 on - to ff02::fb id=7\n"; got != want {
+		t.Errorf("writeMessage of a query = %q, want %q", got, want)
+	}
+}
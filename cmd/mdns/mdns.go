@@ -0,0 +1,41 @@
+package mdns
+
+import (
+	"net"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdMDNS = &cobra.Command{
+	Use:   "mdns",
+	Short: "mDNS commands",
+}
+
+func Setup(cmd *cobra.Command) {
+	cmdMDNS.AddCommand(cmdBrowse)
+	cmdMDNS.AddCommand(cmdResolve)
+	cmdMDNS.AddCommand(cmdListen)
+	cmd.AddCommand(cmdMDNS)
+}
+
+var interfaceNames []string
+
+var interfaces []net.Interface
+
+// resolveInterfaces looks up the interfaces named with --interface, or all
+// interfaces if none were given.
+func resolveInterfaces(cmd *cobra.Command, args []string) error {
+	if len(interfaceNames) == 0 {
+		var err error
+		interfaces, err = net.Interfaces()
+		return err
+	}
+	for _, name := range interfaceNames {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return err
+		}
+		interfaces = append(interfaces, *iface)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package mdns
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/home-sol/multicast-proxy/pkg/net/mdns"
+	"github.com/spf13/cobra"
+)
+
+var cmdResolve = &cobra.Command{
+	Use:   "resolve <instance>",
+	Short: "Resolve a DNS-SD service instance",
+	Long: `Resolve a DNS-SD service instance, e.g. "Living Room._airplay._tcp", to its
+host, port, TXT record and addresses.`,
+	Args:    cobra.ExactArgs(1),
+	PreRunE: resolveInterfaces,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithTimeout(cmd.Context(), resolveTimeout)
+		defer cancel()
+
+		conn, err := mdns.Listen(interfaces)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := conn.Close(); err != nil {
+				slog.Warn("Error closing connection", "error", err)
+			}
+		}()
+
+		service, err := mdns.Resolve(ctx, conn, args[0])
+		if err != nil {
+			return err
+		}
+		printService(cmd.OutOrStdout(), "resolved", service)
+		return nil
+	},
+}
+
+var resolveTimeout time.Duration
+
+func init() {
+	flags := cmdResolve.Flags()
+	flags.StringArrayVarP(&interfaceNames, "interface", "i", nil, "Interfaces to resolve on by name, e.g. eth0, wlan0, etc.; if not specified, all interfaces will be used")
+	flags.DurationVar(&resolveTimeout, "timeout", 5*time.Second, "How long to wait for the instance to be resolved")
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/home-sol/multicast-proxy/pkg/net/reflector"
+	"github.com/spf13/viper"
+)
+
+// reloader re-reads and applies the configuration, one reload at a time.
+// viper is not safe for concurrent use, so every trigger (file changes,
+// SIGHUP and the admin API) is queued to the single goroutine running run.
+type reloader struct {
+	apply    func(*reflector.Config) error
+	requests chan reloadRequest
+}
+
+type reloadRequest struct {
+	reason string
+	// done receives the result of the reload, if set.
+	done chan error
+}
+
+func newReloader(apply func(*reflector.Config) error) *reloader {
+	return &reloader{
+		apply: apply,
+		// One pending request is enough: it reads the latest file anyway.
+		requests: make(chan reloadRequest, 1),
+	}
+}
+
+// run applies the queued reloads until ctx is cancelled.
+func (l *reloader) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-l.requests:
+			err := l.reload(req.reason)
+			if req.done != nil {
+				req.done <- err
+			}
+		}
+	}
+}
+
+func (l *reloader) reload(reason string) error {
+	err := viper.ReadInConfig()
+	var cfg *reflector.Config
+	if err == nil {
+		cfg, err = unmarshalConfig()
+	}
+	if err == nil {
+		err = l.apply(cfg)
+	}
+	if err != nil {
+		logger.Error("Keeping previous configuration, reload failed", "trigger", reason, "error", err)
+	}
+	return err
+}
+
+// trigger queues a reload without waiting for it. It is dropped if a reload
+// is already pending.
+func (l *reloader) trigger(reason string) {
+	select {
+	case l.requests <- reloadRequest{reason: reason}:
+	default:
+	}
+}
+
+// wait queues a reload and returns its result.
+func (l *reloader) wait(ctx context.Context, reason string) error {
+	done := make(chan error, 1)
+	select {
+	case l.requests <- reloadRequest{reason: reason, done: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// watchFile triggers a reload whenever the config file is written or
+// replaced, until ctx is cancelled. It watches the directory rather than the
+// file, so that files replaced by editors keep being watched.
+func (l *reloader) watchFile(ctx context.Context, file string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	file = filepath.Clean(file)
+	if err := w.Add(filepath.Dir(file)); err != nil {
+		_ = w.Close()
+		return err
+	}
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == file && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					l.trigger("file change")
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("Config file watcher failed", "error", err)
+			}
+		}
+	}()
+	return nil
+}
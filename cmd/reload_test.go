@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/home-sol/multicast-proxy/pkg/net/reflector"
+	"github.com/spf13/viper"
+)
+
+// useConfig points viper at a config file with contents for the test.
+func useConfig(t *testing.T, contents string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	viper.SetConfigFile(file)
+	t.Cleanup(viper.Reset)
+}
+
+const testConfig = "net_interface: lo\npools:\n  iot:\n    vlan: 30\n"
+
+func runReloader(t *testing.T, l *reloader) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestReloaderCoalescesTriggers(t *testing.T) {
+	useConfig(t, testConfig)
+	var applied atomic.Int32
+	l := newReloader(func(cfg *reflector.Config) error {
+		if cfg.Pools["iot"].VLAN != 30 {
+			t.Errorf("applied %+v", cfg)
+		}
+		applied.Add(1)
+		return nil
+	})
+	for i := 0; i < 5; i++ {
+		l.trigger("test")
+	}
+	runReloader(t, l)
+
+	// The reload waited for is queued behind the pending trigger.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := l.wait(ctx, "test"); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if n := applied.Load(); n != 2 {
+		t.Errorf("%d reloads applied for 5 triggers and a wait, want 2", n)
+	}
+}
+
+func TestReloaderWaitReturnsError(t *testing.T) {
+	useConfig(t, testConfig)
+	errApply := errors.New("apply failed")
+	l := newReloader(func(*reflector.Config) error { return errApply })
+	runReloader(t, l)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := l.wait(ctx, "test"); !errors.Is(err, errApply) {
+		t.Errorf("wait = %v, want %v", err, errApply)
+	}
+
+	useConfig(t, "net_interface: lo\npools:\n  iot:\n    vlan: 0\n")
+	l.apply = func(*reflector.Config) error {
+		t.Error("invalid configuration applied")
+		return nil
+	}
+	if err := l.wait(ctx, "test"); err == nil {
+		t.Error("wait for an invalid configuration = nil, want an error")
+	}
+}
+
+func TestReloaderWaitCancelled(t *testing.T) {
+	l := newReloader(func(*reflector.Config) error { return nil })
+	l.trigger("pending")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, "test"); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait without a running reloader = %v, want %v", err, context.Canceled)
+	}
+}
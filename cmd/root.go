@@ -2,9 +2,12 @@ package cmd
 
 import (
 	"context"
+	"log/slog"
 	"os"
 	"os/signal"
 
+	"github.com/home-sol/multicast-proxy/cmd/ctl"
+	"github.com/home-sol/multicast-proxy/cmd/mdns"
 	"github.com/home-sol/multicast-proxy/cmd/ssdp"
 	"github.com/spf13/cobra"
 )
@@ -17,7 +20,14 @@ var root = &cobra.Command{
 	Use:     "multicast-proxy",
 	Long:    "This is command for multicast-proxy",
 	Version: Version,
-	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		logger, err = newLogger(os.Stderr, logLevel, logFormat)
+		if err != nil {
+			return err
+		}
+		slog.SetDefault(logger)
+
 		// Sigint
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, os.Kill)
@@ -34,6 +44,7 @@ var root = &cobra.Command{
 		}()
 
 		cmd.SetContext(ctx)
+		return nil
 	},
 
 	PersistentPostRun: func(cmd *cobra.Command, args []string) {
@@ -46,6 +57,14 @@ func Execute() error {
 }
 
 func init() {
+	root.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	root.PersistentFlags().StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+
+	setupConfig()
 	ssdp.Setup(root)
+	mdns.Setup(root)
+	ctl.Setup(root)
 	root.AddCommand(cmdServe)
+	root.AddCommand(cmdConfig)
+	root.AddCommand(cmdTrace)
 }
@@ -1,7 +1,19 @@
 package cmd
 
 import (
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/home-sol/multicast-proxy/pkg/admin"
+	"github.com/home-sol/multicast-proxy/pkg/net/dnssd"
+	"github.com/home-sol/multicast-proxy/pkg/net/netwatch"
 	"github.com/home-sol/multicast-proxy/pkg/net/reflector"
+	"github.com/home-sol/multicast-proxy/pkg/net/ssdp"
+	"github.com/home-sol/multicast-proxy/pkg/net/upnp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -9,25 +21,178 @@ import (
 var cmdServe = &cobra.Command{
 	Use:   "serve",
 	Short: "Run multicast reflector",
-	Long:  `Run multicast reflector, which copies mdns and ssdp packets from one vlan to another`,
+	Long: `Run multicast reflector, which copies mdns and ssdp packets from one vlan to another.
+
+The configuration is reloaded when the config file changes, on SIGHUP, or on
+request through the admin API. The capture is reopened when the network
+interface is recreated or comes back up.
+
+With --upnp-proxy-address, pools with an upnp_proxy URL receive SSDP messages
+whose LOCATION points at the UPnP proxy, which forwards descriptions, SOAP
+control, presentation and event requests to devices they cannot reach. Only
+multicast NOTIFY messages are rewritten: unicast M-SEARCH responses go from
+devices straight to control points and keep the device LOCATION.
+
+With --dns-gateway-address, the mDNS services of pools with a dns_domain are
+published over unicast DNS (RFC 8766) for clients that do not do multicast:
+"printer.local" on the pool with dns_domain "iot.home.arpa" is answered as
+"printer.iot.home.arpa", and browse domains are listed under
+"b._dns-sd._udp". Records are learnt from the capture, and queried on the
+pool's mdns_interface, if any, when not seen yet.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		viper.SetConfigName("config")
-		viper.SetConfigType("yaml")
-		viper.AddConfigPath("/etc/home-sol/multicast-proxy/")
-		viper.AddConfigPath("$HOME/.multicast-proxy")
-		viper.AddConfigPath(".")
-		viper.AutomaticEnv()
-
-		err := viper.ReadInConfig()
+		cfg, err := readConfig()
 		if err != nil {
 			return err
 		}
-		var cfg reflector.Config
-		err = viper.Unmarshal(&cfg)
+
+		watcher, err := netwatch.New(netwatch.WithLogger(logger))
 		if err != nil {
 			return err
 		}
+		go func() {
+			if err := watcher.Run(cmd.Context()); err != nil {
+				logger.Warn("Interface watcher stopped", "error", err)
+			}
+		}()
+
+		registry := ssdp.NewRegistry(ssdp.WithLogger(logger))
+		opts := []reflector.Option{
+			reflector.WithLogger(logger),
+			reflector.WithRegistry(registry),
+			reflector.WithDecisionHistory(decisionHistory),
+			reflector.WithWatcher(watcher),
+		}
+		var (
+			gateway *dnssd.Gateway
+			links   *dnsLinks
+		)
+		if dnsGatewayAddress != "" {
+			gateway = &dnssd.Gateway{Logger: logger}
+			links = newDNSLinks(cmd.Context(), gateway, watcher)
+			opts = append(opts, reflector.WithMDNSObserver(links.observe))
+		}
+		r, err := reflector.New(cfg, opts...)
+		if err != nil {
+			return err
+		}
+		if links != nil {
+			links.update(cfg)
+		}
+
+		reloads := newReloader(func(cfg *reflector.Config) error {
+			if err := r.Reload(cfg); err != nil {
+				return err
+			}
+			if links != nil {
+				links.update(cfg)
+			}
+			return nil
+		})
+		go reloads.run(cmd.Context())
+		if err := reloads.watchFile(cmd.Context(), viper.ConfigFileUsed()); err != nil {
+			logger.Warn("Not watching the config file for changes", "error", err)
+		}
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go func() {
+			for {
+				select {
+				case <-cmd.Context().Done():
+					return
+				case <-hup:
+					reloads.trigger("SIGHUP")
+				}
+			}
+		}()
 
-		return reflector.Serve(cmd.Context(), &cfg)
+		if metricsAddress != "" {
+			go serveMetrics(cmd.Context(), metricsAddress)
+		}
+		if adminAddress != "" {
+			srv := &admin.Server{
+				Reflector: r,
+				Registry:  registry,
+				Reload: func() error {
+					return reloads.wait(cmd.Context(), "admin API")
+				},
+				Logger: logger,
+			}
+			if gateway != nil {
+				srv.MDNSCache = gateway
+			}
+			go func() {
+				if err := srv.ListenAndServe(cmd.Context(), adminAddress); err != nil {
+					logger.Error("Admin API failed", "error", err)
+				}
+			}()
+		}
+		if upnpProxyAddress != "" {
+			allow := knownDevice(registry, r)
+			proxy := &upnp.Proxy{
+				Events: &upnp.EventProxy{
+					Allow:  allow,
+					Logger: logger,
+				},
+				Allow:  allow,
+				Logger: logger,
+			}
+			go func() {
+				if err := proxy.ListenAndServe(cmd.Context(), upnpProxyAddress); err != nil {
+					logger.Error("UPnP proxy failed", "error", err)
+				}
+			}()
+		}
+
+		if gateway != nil {
+			go func() {
+				if err := gateway.ListenAndServe(cmd.Context(), dnsGatewayAddress); err != nil {
+					logger.Error("DNS gateway failed", "error", err)
+				}
+			}()
+		}
+
+		return r.Serve(cmd.Context())
 	},
 }
+
+var (
+	metricsAddress    string
+	adminAddress      string
+	decisionHistory   int
+	upnpProxyAddress  string
+	dnsGatewayAddress string
+)
+
+// knownDevice reports whether a host:port is the location of a live device
+// in the registry that was announced to the pool of the control point, so
+// that the UPnP proxy only reaches devices shared with it. The pool is the
+// one whose upnp_proxy host the control point connected to.
+func knownDevice(registry *ssdp.Registry, r *reflector.Reflector) func(req *http.Request, hostport string) bool {
+	return func(req *http.Request, hostport string) bool {
+		local, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+		if !ok || !r.Proxied(local.IP, hostport) {
+			return false
+		}
+		now := time.Now()
+		for _, entry := range registry.Entries() {
+			host := entry.Location.Host
+			if entry.Location.Port() == "" {
+				host = net.JoinHostPort(entry.Location.Hostname(), "80")
+			}
+			if host == hostport && now.Before(entry.CacheExpiry) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func init() {
+	cmdServe.Flags().StringVar(&metricsAddress, "metrics-address", "", "Address to expose Prometheus metrics on, e.g. :9100; disabled if empty")
+	cmdServe.Flags().StringVar(&adminAddress, "admin-address", "", "Address of the admin API, either unix:<path> or a local host:port, e.g. "+admin.DefaultAddress+"; disabled if empty")
+	cmdServe.Flags().IntVar(&decisionHistory, "decision-history", reflector.DefaultDecisionHistory, "Number of recent forwarding decisions kept for the admin API")
+	cmdServe.Flags().StringVar(&upnpProxyAddress, "upnp-proxy-address", "", "Address of the UPnP proxy, which forwards HTTP and event (GENA) requests from control points on other vlans to devices, e.g. :8200; pools reach it at their upnp_proxy URL. Disabled if empty")
+	cmdServe.Flags().StringVar(&dnsGatewayAddress, "dns-gateway-address", "", "Address of the unicast DNS gateway publishing the mDNS services of pools with a dns_domain, e.g. :53; disabled if empty")
+}
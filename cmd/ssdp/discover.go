@@ -3,48 +3,76 @@ package ssdp
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net"
 	"time"
 
-	"github.com/home-sol/multicast-proxy/pkg/net/httpu"
+	"github.com/home-sol/multicast-proxy/pkg/net/netwatch"
 	"github.com/home-sol/multicast-proxy/pkg/net/ssdp"
 	"github.com/spf13/cobra"
 )
 
 var cmdDiscover = &cobra.Command{
-	Use:   "discover",
-	Short: "Discover for SSDP devices",
-	Long:  "Discover for SSDP devices",
-	RunE: func(cmd *cobra.Command, args []string) (err error) {
-		intf, err := net.InterfaceByName("enp7s0")
-		if err != nil {
-			return err
-		}
-		hc, err := httpu.NewClientInterfaces([]net.Interface{*intf})
+	Use:   "discover [search target...]",
+	Short: "Discover SSDP devices",
+	Long: `Discover SSDP devices by sending M-SEARCH requests and printing each unique
+response as it arrives. Search targets may be given as arguments or with
+--st; if none are given, all devices and services are searched for.`,
+	PreRunE: resolveInterfaces,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithTimeout(cmd.Context(), discoverTimeout)
+		defer cancel()
+
+		watcher, err := netwatch.New()
 		if err != nil {
 			return err
 		}
-
-		defer func() {
-			hcCloseErr := hc.Close()
-			if err == nil {
-				err = hcCloseErr
+		go func() {
+			if err := watcher.Run(ctx); err != nil && ctx.Err() == nil {
+				slog.Warn("Interface watcher stopped", "error", err)
 			}
 		}()
 
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-
-		defer cancel()
-		responses, err := ssdp.SSDPRawSearchCtx(ctx, hc, args[0], 3)
-		if err != nil {
-			return err
+		// Without --interface, follow every interface, including those
+		// appearing during the search.
+		var searchInterfaces []net.Interface
+		if len(interfaceNames) > 0 {
+			searchInterfaces = interfaces
 		}
-		if err != nil {
-			return err
-		}
-		for _, d := range responses {
-			fmt.Printf("%v\n", d)
+		results, wait := ssdp.Search(ctx, nil, ssdp.SearchOptions{
+			Targets:    append(append([]string(nil), discoverTargets...), args...),
+			MX:         discoverMX,
+			NumSends:   discoverSends,
+			Network:    discoverNetwork,
+			Interfaces: searchInterfaces,
+			Watcher:    watcher,
+		})
+		out := cmd.OutOrStdout()
+		for result := range results {
+			intf := result.Interface
+			if intf == "" {
+				intf = "-"
+			}
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\n", intf, result.RemoteAddr, result.ST, result.USN, result.Location)
 		}
-		return nil
+		return wait()
 	},
 }
+
+var (
+	discoverTargets []string
+	discoverMX      int
+	discoverSends   int
+	discoverTimeout time.Duration
+	discoverNetwork string
+)
+
+func init() {
+	flags := cmdDiscover.Flags()
+	flags.StringArrayVarP(&interfaceNames, "interface", "i", nil, "Interfaces to search on by name, e.g. eth0, wlan0, etc.; if not specified, all interfaces will be used")
+	flags.StringArrayVar(&discoverTargets, "st", nil, "Search target, may be repeated (default ssdp:all)")
+	flags.IntVar(&discoverMX, "mx", 0, "Maximum response delay in seconds, 1-5 (default derived from --timeout)")
+	flags.IntVar(&discoverSends, "sends", ssdp.DefaultNumSends, "Number of times each search request is sent")
+	flags.DurationVar(&discoverTimeout, "timeout", 3*time.Second, "How long to wait for responses")
+	flags.StringVar(&discoverNetwork, "network", "udp4", "Network to search on: udp4, udp6 or udp for both")
+}
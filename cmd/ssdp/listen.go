@@ -2,55 +2,56 @@ package ssdp
 
 import (
 	"fmt"
-	"github.com/home-sol/multicast-proxy/pkg/net/httpu"
+	"log/slog"
 	"net"
 	"net/http"
 
+	"github.com/home-sol/multicast-proxy/pkg/net/httpu"
 	"github.com/home-sol/multicast-proxy/pkg/net/multicast"
+	"github.com/home-sol/multicast-proxy/pkg/net/netwatch"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/ipv4"
 )
 
 var cmdListen = &cobra.Command{
-	Use:   "listen",
-	Short: "Listen for SSDP messages",
-	Long:  "Listen for SSDP messages",
-	PreRunE: func(cmd *cobra.Command, args []string) error {
-		switch len(interfaceNames) {
-		case 0:
-			var err error
-			interfaces, err = net.Interfaces()
-			if err != nil {
-				return err
-			}
-		default:
-			for _, name := range interfaceNames {
-				iface, err := net.InterfaceByName(name)
-				if err != nil {
-					return err
-				}
-				interfaces = append(interfaces, *iface)
-			}
-		}
-
-		return nil
-	},
+	Use:     "listen",
+	Short:   "Listen for SSDP messages",
+	Long:    "Listen for SSDP messages",
+	PreRunE: resolveInterfaces,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		gaddr, err := net.ResolveUDPAddr("udp4", "239.255.255.250:1900")
 		if err != nil {
 			return err
 		}
-		conn, err := multicast.Listen(gaddr, gaddr, interfaces)
+		// Control messages enabled from the start report the ingress of
+		// the first messages too.
+		conn, err := multicast.Listen(gaddr, gaddr, interfaces, multicast.WithControlMessages(ipv4.FlagDst|ipv4.FlagInterface))
 		if err != nil {
 			return err
 		}
 
+		watcher, err := netwatch.New()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := watcher.Run(cmd.Context()); err != nil {
+				slog.Warn("Interface watcher stopped", "error", err)
+			}
+		}()
+		go multicast.Rejoin(cmd.Context(), conn, gaddr, watcher, netwatch.MatchNames(interfaceNames...))
+
 		defer func() {
 			if err := conn.Close(); err != nil {
-				fmt.Printf("Error closing connection: %v\n", err)
+				slog.Warn("Error closing connection", "error", err)
 			}
 		}()
 
 		return httpu.Serve(cmd.Context(), conn, (httpu.HandlerFunc)(func(r *http.Request) ([]*http.Response, error) {
+			if ingress, ok := httpu.IngressFromContext(r.Context()); ok {
+				fmt.Printf("Request on %s to %s: %v\n", ingress.Interface, ingress.Dst, r)
+				return nil, nil
+			}
 			fmt.Printf("Request: %v\n", r)
 			return nil, nil
 		}))
@@ -61,7 +62,29 @@ var interfaceNames []string
 
 var interfaces []net.Interface
 
+// resolveInterfaces looks up the interfaces named with --interface, or all
+// interfaces if none were given.
+func resolveInterfaces(cmd *cobra.Command, args []string) error {
+	switch len(interfaceNames) {
+	case 0:
+		var err error
+		interfaces, err = net.Interfaces()
+		if err != nil {
+			return err
+		}
+	default:
+		for _, name := range interfaceNames {
+			iface, err := net.InterfaceByName(name)
+			if err != nil {
+				return err
+			}
+			interfaces = append(interfaces, *iface)
+		}
+	}
+
+	return nil
+}
+
 func init() {
 	cmdListen.Flags().StringArrayVarP(&interfaceNames, "interface", "i", nil, "Interfaces to listen on by name, e.g. eth0, wlan0, etc.; if not specified, all interfaces will be used")
-
 }
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/home-sol/multicast-proxy/pkg/admin"
+	"github.com/home-sol/multicast-proxy/pkg/net/reflector"
+	"github.com/home-sol/multicast-proxy/pkg/trace"
+	"github.com/spf13/cobra"
+)
+
+var cmdTrace = &cobra.Command{
+	Use:   "trace",
+	Short: "Stream decoded packets and forwarding decisions",
+	Long: `Stream decoded packets and forwarding decisions.
+
+By default trace attaches to a running serve process through its admin API.
+With --interface it captures on the interface itself, and shows what serve
+would do with the current configuration without forwarding anything.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		q := admin.TraceQuery{
+			Filter: reflector.TraceFilter{
+				Protocol: traceProtocol,
+				VLAN:     traceVLAN,
+			},
+			Data: trace.NeedsData(traceFormat),
+		}
+		if traceMAC != "" {
+			if q.Filter.SrcMAC, err = reflector.ParseMacAddress(traceMAC); err != nil {
+				return fmt.Errorf("invalid --mac: %w", err)
+			}
+		}
+		if traceName != "" {
+			if q.Filter.Name, err = regexp.Compile(traceName); err != nil {
+				return fmt.Errorf("invalid --name: %w", err)
+			}
+		}
+
+		var out io.Writer = os.Stdout
+		if traceOutput != "" && traceOutput != "-" {
+			f, err := os.Create(traceOutput)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if closeErr := f.Close(); err == nil {
+					err = closeErr
+				}
+			}()
+			out = f
+		}
+		w, err := trace.NewWriter(out, traceFormat)
+		if err != nil {
+			return err
+		}
+
+		if traceInterface == "" {
+			return admin.NewClient(traceAddress).FollowDecisions(cmd.Context(), q, w.Write)
+		}
+		return traceStandalone(cmd.Context(), q, w)
+	},
+}
+
+// traceStandalone runs a dry-run reflector on --interface. The configuration
+// is used if one is found, so decisions match those of serve.
+func traceStandalone(ctx context.Context, q admin.TraceQuery, w trace.Writer) error {
+	cfg, err := readConfig()
+	if err != nil {
+		logger.Warn("Tracing without configuration, no packet will match a route", "error", err)
+		cfg = &reflector.Config{}
+	}
+	if cfg.NetInterface != traceInterface {
+		cfg.NetInterface = traceInterface
+		cfg.WindowsInterface = ""
+	}
+
+	r, err := reflector.New(cfg, reflector.WithLogger(logger), reflector.WithDryRun())
+	if err != nil {
+		return err
+	}
+	decisions, unsubscribe := r.SubscribeDecisions(1024)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- r.Serve(ctx)
+	}()
+
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case d := <-decisions:
+			if !q.Filter.Match(&d) {
+				continue
+			}
+			if err := w.Write(d); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+var (
+	traceAddress   string
+	traceInterface string
+	traceProtocol  string
+	traceVLAN      uint16
+	traceMAC       string
+	traceName      string
+	traceFormat    string
+	traceOutput    string
+)
+
+func init() {
+	cmdTrace.Flags().StringVarP(&traceAddress, "address", "a", admin.DefaultAddress, "Address of the admin API of the running reflector")
+	cmdTrace.Flags().StringVarP(&traceInterface, "interface", "i", "", "Capture on this interface instead of attaching to the running reflector")
+	cmdTrace.Flags().StringVar(&traceProtocol, "protocol", "", "Only show mdns or ssdp packets")
+	cmdTrace.Flags().Uint16Var(&traceVLAN, "vlan", 0, "Only show packets captured on this VLAN")
+	cmdTrace.Flags().StringVar(&traceMAC, "mac", "", "Only show packets sent by this MAC address")
+	cmdTrace.Flags().StringVar(&traceName, "name", "", "Only show packets querying or announcing a name matching this regular expression")
+	cmdTrace.Flags().StringVarP(&traceFormat, "format", "f", trace.FormatText, "Output format: text, json or pcapng")
+	cmdTrace.Flags().StringVarP(&traceOutput, "output", "o", "", "Write to this file instead of standard output")
+}
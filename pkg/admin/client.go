@@ -0,0 +1,134 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/home-sol/multicast-proxy/pkg/net/reflector"
+)
+
+// Client talks to the admin API of a running serve process.
+type Client struct {
+	http    *http.Client
+	baseURL string
+}
+
+// NewClient creates a client for the admin API listening on address, in the
+// same format as accepted by Listen.
+func NewClient(address string) *Client {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		return &Client{
+			http:    &http.Client{Transport: transport},
+			baseURL: "http://admin",
+		}
+	}
+	return &Client{
+		http:    &http.Client{},
+		baseURL: "http://" + address,
+	}
+}
+
+// Config returns the configuration in use by the daemon.
+func (c *Client) Config(ctx context.Context) (*reflector.Config, error) {
+	var cfg reflector.Config
+	return &cfg, c.get(ctx, "/api/config", &cfg)
+}
+
+// Pools returns the pools and the route table in use by the daemon.
+func (c *Client) Pools(ctx context.Context) (*Pools, error) {
+	var pools Pools
+	return &pools, c.get(ctx, "/api/pools", &pools)
+}
+
+// Devices returns the senders seen by the daemon.
+func (c *Client) Devices(ctx context.Context) ([]reflector.KnownDevice, error) {
+	var devices []reflector.KnownDevice
+	return devices, c.get(ctx, "/api/devices", &devices)
+}
+
+// Registry returns the contents of the daemon's SSDP registry.
+func (c *Client) Registry(ctx context.Context) ([]RegistryEntry, error) {
+	var entries []RegistryEntry
+	return entries, c.get(ctx, "/api/registry", &entries)
+}
+
+// Decisions returns the most recent forwarding decisions.
+func (c *Client) Decisions(ctx context.Context) ([]reflector.Decision, error) {
+	var decisions []reflector.Decision
+	return decisions, c.get(ctx, "/api/decisions", &decisions)
+}
+
+// FollowDecisions calls fn for every new forwarding decision selected by q
+// until ctx is cancelled, the connection is closed, or fn returns an error.
+func (c *Client) FollowDecisions(ctx context.Context, q TraceQuery, fn func(reflector.Decision) error) error {
+	res, err := c.do(ctx, http.MethodGet, "/api/decisions?"+q.values().Encode())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	scanner := bufio.NewScanner(res.Body)
+	// Lines carry base64 encoded frames when q.Data is set.
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var d reflector.Decision
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return fmt.Errorf("decoding decision: %w", err)
+		}
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
+
+// Reload asks the daemon to re-read its configuration.
+func (c *Client) Reload(ctx context.Context) error {
+	res, err := c.do(ctx, http.MethodPost, "/api/reload")
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (c *Client) get(ctx context.Context, path string, v interface{}) error {
+	res, err := c.do(ctx, http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// do sends a request and turns non-2xx responses into errors.
+func (c *Client) do(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, res.Status, strings.TrimSpace(string(msg)))
+	}
+	return res, nil
+}
@@ -0,0 +1,66 @@
+package admin
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/home-sol/multicast-proxy/pkg/net/reflector"
+)
+
+// TraceQuery selects the decisions streamed by /api/decisions?follow=1.
+type TraceQuery struct {
+	Filter reflector.TraceFilter
+	// Data includes the captured frames in the streamed decisions.
+	Data bool
+}
+
+func (q TraceQuery) values() url.Values {
+	v := url.Values{}
+	v.Set("follow", "1")
+	if q.Filter.Protocol != "" {
+		v.Set("protocol", q.Filter.Protocol)
+	}
+	if q.Filter.VLAN != 0 {
+		v.Set("vlan", strconv.Itoa(int(q.Filter.VLAN)))
+	}
+	if q.Filter.SrcMAC != "" {
+		v.Set("mac", string(q.Filter.SrcMAC))
+	}
+	if q.Filter.Name != nil {
+		v.Set("name", q.Filter.Name.String())
+	}
+	if q.Data {
+		v.Set("data", "1")
+	}
+	return v
+}
+
+func parseTraceQuery(v url.Values) (TraceQuery, error) {
+	var q TraceQuery
+	q.Filter.Protocol = v.Get("protocol")
+	q.Data = v.Get("data") != ""
+	if s := v.Get("vlan"); s != "" {
+		vlan, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return q, fmt.Errorf("invalid vlan %q: %w", s, err)
+		}
+		q.Filter.VLAN = uint16(vlan)
+	}
+	if s := v.Get("mac"); s != "" {
+		mac, err := reflector.ParseMacAddress(s)
+		if err != nil {
+			return q, fmt.Errorf("invalid mac %q: %w", s, err)
+		}
+		q.Filter.SrcMAC = mac
+	}
+	if s := v.Get("name"); s != "" {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return q, fmt.Errorf("invalid name pattern: %w", err)
+		}
+		q.Filter.Name = re
+	}
+	return q, nil
+}
@@ -0,0 +1,286 @@
+// Package admin exposes the live state of a running reflector over a local
+// HTTP API, on a TCP address or a Unix socket.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/home-sol/multicast-proxy/pkg/net/reflector"
+	"github.com/home-sol/multicast-proxy/pkg/net/ssdp"
+)
+
+// DefaultAddress is the Unix socket the admin API is usually served on.
+const DefaultAddress = "unix:/run/multicast-proxy/admin.sock"
+
+// MDNSCache is implemented by components that keep a cache of mDNS records.
+type MDNSCache interface {
+	// Snapshot returns a JSON-encodable copy of the cached records.
+	Snapshot() interface{}
+}
+
+// Server serves the admin API.
+type Server struct {
+	Reflector *reflector.Reflector
+	Registry  *ssdp.Registry
+	// MDNSCache is optional; /api/mdns responds 404 without it.
+	MDNSCache MDNSCache
+	// Reload re-reads and applies the configuration. It is optional;
+	// /api/reload responds 404 without it.
+	Reload func() error
+	Logger *slog.Logger
+}
+
+// Pools is the response of /api/pools.
+type Pools struct {
+	Pools  map[string]reflector.Pool `json:"pools"`
+	Routes []reflector.Route         `json:"routes"`
+}
+
+// RegistryEntry is an SSDP registry entry as returned by /api/registry.
+type RegistryEntry struct {
+	USN         string    `json:"usn"`
+	NT          string    `json:"nt"`
+	Server      string    `json:"server"`
+	Location    string    `json:"location"`
+	RemoteAddr  string    `json:"remote_addr"`
+	BootID      int32     `json:"boot_id"`
+	ConfigID    int32     `json:"config_id"`
+	LastUpdate  time.Time `json:"last_update"`
+	CacheExpiry time.Time `json:"cache_expiry"`
+}
+
+// Handler returns the HTTP handler of the admin API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/config", s.get(func(r *http.Request) (interface{}, error) {
+		return s.Reflector.Config(), nil
+	}))
+	mux.HandleFunc("/api/pools", s.get(func(r *http.Request) (interface{}, error) {
+		return Pools{
+			Pools:  s.Reflector.Config().Pools,
+			Routes: s.Reflector.Routes(),
+		}, nil
+	}))
+	mux.HandleFunc("/api/devices", s.get(func(r *http.Request) (interface{}, error) {
+		return s.Reflector.Devices(), nil
+	}))
+	mux.HandleFunc("/api/registry", s.get(func(r *http.Request) (interface{}, error) {
+		if s.Registry == nil {
+			return nil, errNotAvailable
+		}
+		entries := s.Registry.Entries()
+		result := make([]RegistryEntry, 0, len(entries))
+		for _, e := range entries {
+			result = append(result, RegistryEntry{
+				USN:         e.USN,
+				NT:          e.NT,
+				Server:      e.Server,
+				Location:    e.Location.String(),
+				RemoteAddr:  e.RemoteAddr,
+				BootID:      e.BootID,
+				ConfigID:    e.ConfigID,
+				LastUpdate:  e.LastUpdate,
+				CacheExpiry: e.CacheExpiry,
+			})
+		}
+		return result, nil
+	}))
+	mux.HandleFunc("/api/mdns", s.get(func(r *http.Request) (interface{}, error) {
+		if s.MDNSCache == nil {
+			return nil, errNotAvailable
+		}
+		return s.MDNSCache.Snapshot(), nil
+	}))
+	mux.HandleFunc("/api/decisions", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("follow") != "" {
+			s.followDecisions(w, r)
+			return
+		}
+		s.get(func(r *http.Request) (interface{}, error) {
+			decisions := s.Reflector.Decisions()
+			for i := range decisions {
+				decisions[i].Data = nil
+			}
+			return decisions, nil
+		})(w, r)
+	})
+	mux.HandleFunc("/api/reload", s.reload)
+	return mux
+}
+
+// followDecisions streams the forwarding decisions selected by the query as
+// JSON lines until the client goes away.
+func (s *Server) followDecisions(w http.ResponseWriter, r *http.Request) {
+	q, err := parseTraceQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	decisions, unsubscribe := s.Reflector.SubscribeDecisions(256)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case d := <-decisions:
+			if !q.Filter.Match(&d) {
+				continue
+			}
+			if !q.Data {
+				d.Data = nil
+			}
+			if err := enc.Encode(d); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Server) reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Reload == nil {
+		http.Error(w, errNotAvailable.Error(), http.StatusNotFound)
+		return
+	}
+	if err := s.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errNotAvailable = errors.New("not available in this process")
+
+func (s *Server) get(fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := fn(r)
+		if errors.Is(err, errNotAvailable) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, v)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// socketMode is the permission of the admin socket: the API can reload the
+// configuration, so only the owner and group may use it.
+const socketMode = 0o660
+
+// Listen opens the listener for address, which is either "unix:<path>" for a
+// Unix socket or a TCP "host:port" on a loopback address, since the API is
+// not authenticated. A stale socket file is removed first.
+func Listen(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, socketMode); err != nil {
+			_ = l.Close()
+			return nil, fmt.Errorf("restricting admin socket permissions: %w", err)
+		}
+		return l, nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("admin address %q is not a loopback address", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// removeStaleSocket removes the socket left at path by a previous run. Other
+// files are left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("admin socket %s exists and is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("removing stale admin socket: %w", err)
+	}
+	return nil
+}
+
+// ListenAndServe serves the admin API on address until ctx is cancelled.
+func (s *Server) ListenAndServe(ctx context.Context, address string) error {
+	logger := s.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	l, err := Listen(address)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("Serving admin API", "address", address)
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
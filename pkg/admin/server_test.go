@@ -0,0 +1,65 @@
+package admin
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenTCPLoopbackOnly(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0", "localhost:0"} {
+		l, err := Listen(address)
+		if err != nil {
+			t.Errorf("Listen(%q) = %v", address, err)
+			continue
+		}
+		l.Close()
+	}
+	for _, address := range []string{":0", "0.0.0.0:0", "[::]:0", "192.0.2.1:0"} {
+		if l, err := Listen(address); err == nil {
+			l.Close()
+			t.Errorf("Listen(%q) succeeded, want an error", address)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+
+	// A stale socket is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets not supported: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := Listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("Listen over stale socket = %v", err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != socketMode {
+		t.Errorf("socket permissions = %v, want %v", perm, os.FileMode(socketMode))
+	}
+}
+
+func TestListenUnixKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("keep me"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := Listen("unix:" + path); err == nil {
+		l.Close()
+		t.Fatal("Listen over a regular file succeeded")
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "keep me" {
+		t.Errorf("file changed: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,289 @@
+// Package dnssd publishes the services found through mDNS on a link in a
+// unicast DNS domain, so that clients which do not do multicast can browse
+// them: a DNS-SD discovery proxy (RFC 8766).
+package dnssd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// maxRecords bounds the number of records cached per link.
+	maxRecords = 10000
+	// flushDelay is how old cached records must be to be replaced by a record
+	// with the cache-flush bit (RFC 6762, section 10.2).
+	flushDelay = time.Second
+	// goodbyeTTL is how long a record is kept after a goodbye (RFC 6762,
+	// section 10.1).
+	goodbyeTTL = time.Second
+
+	classTopBit = 0x8000
+)
+
+// TypeANY is the QTYPE asking for records of every type (RFC 1035, section
+// 3.2.3), which layers does not define.
+const TypeANY layers.DNSType = 255
+
+// Cache holds the mDNS records observed on a link.
+type Cache struct {
+	lock    sync.Mutex
+	records map[cacheKey][]cachedRecord
+	size    int
+	// changed is closed and replaced whenever records are added.
+	changed chan struct{}
+	now     func() time.Time
+}
+
+type cacheKey struct {
+	name   string
+	rrtype layers.DNSType
+}
+
+type cachedRecord struct {
+	rr       layers.DNSResourceRecord
+	received time.Time
+	expiry   time.Time
+}
+
+// NewCache creates an empty cache.
+func NewCache() *Cache {
+	return &Cache{
+		records: make(map[cacheKey][]cachedRecord),
+		changed: make(chan struct{}),
+		now:     time.Now,
+	}
+}
+
+// Observe adds the answer and additional records of an mDNS response to the
+// cache. Records of types that are not served are ignored.
+func (c *Cache) Observe(msg *layers.DNS) {
+	if !msg.QR {
+		return
+	}
+	now := c.now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	added := false
+	flushed := make(map[cacheKey]bool)
+	for _, section := range [][]layers.DNSResourceRecord{msg.Answers, msg.Additionals} {
+		for _, rr := range section {
+			if !servedType(rr.Type) {
+				continue
+			}
+			key := cacheKey{name: normalize(string(rr.Name)), rrtype: rr.Type}
+			if rr.Class&classTopBit != 0 && !flushed[key] {
+				flushed[key] = true
+				c.flushLocked(key, now)
+			}
+			if c.addLocked(key, rr, now) {
+				added = true
+			}
+		}
+	}
+	if added {
+		close(c.changed)
+		c.changed = make(chan struct{})
+	}
+}
+
+// flushLocked drops the records of key received more than flushDelay ago.
+func (c *Cache) flushLocked(key cacheKey, now time.Time) {
+	kept := c.records[key][:0]
+	for _, cached := range c.records[key] {
+		if now.Sub(cached.received) < flushDelay {
+			kept = append(kept, cached)
+		}
+	}
+	c.size -= len(c.records[key]) - len(kept)
+	c.records[key] = kept
+}
+
+// addLocked adds or refreshes rr and reports whether a record was added.
+func (c *Cache) addLocked(key cacheKey, rr layers.DNSResourceRecord, now time.Time) bool {
+	ttl := time.Duration(rr.TTL) * time.Second
+	if rr.TTL == 0 {
+		ttl = goodbyeTTL
+	}
+	data := rdata(rr)
+	for i, cached := range c.records[key] {
+		if rdata(cached.rr) == data {
+			c.records[key][i].received = now
+			c.records[key][i].expiry = now.Add(ttl)
+			c.records[key][i].rr.TTL = rr.TTL
+			return false
+		}
+	}
+	if rr.TTL == 0 {
+		return false
+	}
+	if c.size >= maxRecords {
+		c.pruneLocked(now)
+		if c.size >= maxRecords {
+			return false
+		}
+	}
+	c.records[key] = append(c.records[key], cachedRecord{rr: copyRecord(rr), received: now, expiry: now.Add(ttl)})
+	c.size++
+	return true
+}
+
+// pruneLocked drops the expired records.
+func (c *Cache) pruneLocked(now time.Time) {
+	for key := range c.records {
+		c.expireLocked(key, now)
+	}
+}
+
+// expireLocked drops the expired records of key and returns the others.
+func (c *Cache) expireLocked(key cacheKey, now time.Time) []cachedRecord {
+	cached := c.records[key]
+	kept := cached[:0]
+	for _, r := range cached {
+		if now.Before(r.expiry) {
+			kept = append(kept, r)
+		}
+	}
+	c.size -= len(cached) - len(kept)
+	if len(kept) == 0 {
+		delete(c.records, key)
+		return nil
+	}
+	c.records[key] = kept
+	return kept
+}
+
+// Lookup returns the records of an mDNS name, e.g. "printer.local", and type,
+// with their remaining TTL. TypeANY returns the records of every type.
+func (c *Cache) Lookup(name string, rrtype layers.DNSType) []layers.DNSResourceRecord {
+	name = normalize(name)
+	now := c.now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	types := []layers.DNSType{rrtype}
+	if rrtype == TypeANY {
+		types = servedTypes
+	}
+	var records []layers.DNSResourceRecord
+	for _, t := range types {
+		for _, r := range c.expireLocked(cacheKey{name: name, rrtype: t}, now) {
+			rr := r.rr
+			rr.TTL = uint32(r.expiry.Sub(now).Round(time.Second) / time.Second)
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// wait returns a channel closed when records are next added.
+func (c *Cache) wait() <-chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.changed
+}
+
+// Record is a cached record as listed by Records.
+type Record struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+// Records lists the cached records, sorted by name and type.
+func (c *Cache) Records() []Record {
+	now := c.now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pruneLocked(now)
+	var records []Record
+	for _, cached := range c.records {
+		for _, r := range cached {
+			records = append(records, Record{
+				Name: normalize(string(r.rr.Name)),
+				Type: r.rr.Type.String(),
+				TTL:  uint32(r.expiry.Sub(now) / time.Second),
+				Data: rdata(r.rr),
+			})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		if records[i].Type != records[j].Type {
+			return records[i].Type < records[j].Type
+		}
+		return records[i].Data < records[j].Data
+	})
+	return records
+}
+
+// servedTypes are the types of the records cached and served.
+var servedTypes = []layers.DNSType{layers.DNSTypeA, layers.DNSTypeAAAA, layers.DNSTypePTR, layers.DNSTypeSRV, layers.DNSTypeTXT, layers.DNSTypeCNAME}
+
+// servedType reports whether records of type t are cached and served.
+func servedType(t layers.DNSType) bool {
+	for _, served := range servedTypes {
+		if t == served {
+			return true
+		}
+	}
+	return false
+}
+
+// rdata formats the data of a record, to compare and list records.
+func rdata(rr layers.DNSResourceRecord) string {
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		return rr.IP.String()
+	case layers.DNSTypePTR:
+		return normalize(string(rr.PTR))
+	case layers.DNSTypeCNAME:
+		return normalize(string(rr.CNAME))
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", rr.SRV.Priority, rr.SRV.Weight, rr.SRV.Port, normalize(string(rr.SRV.Name)))
+	case layers.DNSTypeTXT:
+		txts := make([]string, len(rr.TXTs))
+		for i, txt := range rr.TXTs {
+			txts[i] = string(txt)
+		}
+		return strings.Join(txts, " ")
+	}
+	return string(rr.Data)
+}
+
+// copyRecord copies the data of rr that may point into a packet buffer.
+func copyRecord(rr layers.DNSResourceRecord) layers.DNSResourceRecord {
+	clone := func(b []byte) []byte {
+		return append([]byte(nil), b...)
+	}
+	rr.Name = clone(rr.Name)
+	rr.Data = nil
+	rr.IP = net.IP(clone(rr.IP))
+	rr.PTR = clone(rr.PTR)
+	rr.CNAME = clone(rr.CNAME)
+	rr.SRV.Name = clone(rr.SRV.Name)
+	txts := make([][]byte, len(rr.TXTs))
+	for i, txt := range rr.TXTs {
+		txts[i] = clone(txt)
+	}
+	rr.TXTs = txts
+	rr.TXT = nil
+	// The cache-flush bit is not part of the class in unicast DNS.
+	rr.Class &^= classTopBit
+	return rr
+}
+
+// normalize lower-cases a name and strips the root dot.
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,76 @@
+package dnssd
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestCachePrunesWhenFull(t *testing.T) {
+	now := time.Now()
+	c := NewCache()
+	c.now = func() time.Time { return now }
+
+	host := func(name string, ttl uint32) *layers.DNS {
+		return &layers.DNS{QR: true, Answers: []layers.DNSResourceRecord{
+			{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: ttl, IP: net.IPv4(10, 0, 0, 1)},
+		}}
+	}
+	full := &layers.DNS{QR: true}
+	for i := 0; i < maxRecords; i++ {
+		full.Answers = append(full.Answers, host(fmt.Sprintf("host-%d.local", i), 60).Answers...)
+	}
+	c.Observe(full)
+
+	c.Observe(host("late.local", 120))
+	if got := c.Lookup("late.local", layers.DNSTypeA); len(got) != 0 {
+		t.Errorf("full cache added %v", got)
+	}
+
+	now = now.Add(61 * time.Second)
+	c.Observe(host("late.local", 120))
+	if got := c.Lookup("late.local", layers.DNSTypeA); len(got) != 1 || got[0].TTL != 120 {
+		t.Errorf("Lookup after expiry = %v, want the new record", got)
+	}
+	if c.size != 1 || len(c.records) != 1 {
+		t.Errorf("cache holds %d records under %d keys, want 1", c.size, len(c.records))
+	}
+}
+
+func TestCacheLookup(t *testing.T) {
+	now := time.Now()
+	c := NewCache()
+	c.now = func() time.Time { return now }
+	c.Observe(printer())
+
+	for _, tt := range []struct {
+		name   string
+		rrtype layers.DNSType
+		want   int
+	}{
+		{"printer.local", layers.DNSTypeA, 2},
+		{"PRINTER.local.", layers.DNSTypeAAAA, 2},
+		{"printer.local", TypeANY, 4},
+		{"printer._ipp._tcp.local", TypeANY, 2},
+		{"printer.local", layers.DNSTypeSRV, 0},
+		{"other.local", TypeANY, 0},
+	} {
+		if got := c.Lookup(tt.name, tt.rrtype); len(got) != tt.want {
+			t.Errorf("Lookup(%s, %v) = %d records, want %d", tt.name, tt.rrtype, len(got), tt.want)
+		}
+	}
+
+	now = now.Add(121 * time.Second)
+	if got := c.Lookup("printer.local", TypeANY); len(got) != 0 {
+		t.Errorf("Lookup after expiry = %v", got)
+	}
+	if got := c.Records(); len(got) != 2 {
+		t.Errorf("Records after expiry = %v, want the PTR and TXT records", got)
+	}
+	if c.size != 2 {
+		t.Errorf("size = %d, want 2", c.size)
+	}
+}
@@ -0,0 +1,320 @@
+package dnssd
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// DefaultQueryTimeout is how long the gateway waits for mDNS answers to a
+	// question its cache cannot answer, by default.
+	DefaultQueryTimeout = time.Second
+	// maxTTL caps the TTL of served records, since clients are not told when
+	// they change (RFC 8766, section 5.5.1).
+	maxTTL = 10
+	// browseDomainTTL is the TTL of browse domain records, which only change
+	// with the configuration.
+	browseDomainTTL = 300
+	// mdnsDomain is the domain of mDNS names.
+	mdnsDomain = "local"
+)
+
+// browseDomainLabels are the names under which clients look for browse
+// domains (RFC 6763, section 11): browsing, default browsing and legacy
+// browsing domains.
+var browseDomainLabels = []string{"b._dns-sd._udp", "db._dns-sd._udp", "lb._dns-sd._udp"}
+
+// Link is a network whose mDNS records are published under a unicast domain.
+type Link struct {
+	// Domain is the unicast domain, e.g. "iot.home.arpa".
+	Domain string
+	// Cache holds the records observed on the link.
+	Cache *Cache
+	// Query, if set, sends mDNS questions on the link when the cache cannot
+	// answer.
+	Query func(questions ...layers.DNSQuestion) error
+}
+
+// Gateway answers unicast DNS questions for the domains of its links from
+// their mDNS records: a question for "printer.iot.home.arpa" is answered with
+// the records of "printer.local" on the link of "iot.home.arpa".
+type Gateway struct {
+	// QueryTimeout bounds the wait for mDNS answers. It defaults to
+	// DefaultQueryTimeout.
+	QueryTimeout time.Duration
+	// Logger reports failures. If nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	lock  sync.RWMutex
+	links []Link
+
+	// queries are the mDNS questions awaiting answers, shared by the clients
+	// asking the same question meanwhile.
+	queryLock sync.Mutex
+	queries   map[queryKey]*pendingQuery
+}
+
+// queryKey identifies an mDNS question asked on a link.
+type queryKey struct {
+	domain string
+	name   string
+	rrtype layers.DNSType
+}
+
+// pendingQuery is an mDNS question awaiting answers. records are set once
+// done is closed.
+type pendingQuery struct {
+	done    chan struct{}
+	records []layers.DNSResourceRecord
+}
+
+func (g *Gateway) logger() *slog.Logger {
+	if g.Logger != nil {
+		return g.Logger
+	}
+	return slog.Default()
+}
+
+// SetLinks replaces the links served.
+func (g *Gateway) SetLinks(links []Link) {
+	links = append([]Link(nil), links...)
+	for i := range links {
+		links[i].Domain = normalize(links[i].Domain)
+	}
+	// Longest domains first, so that nested domains match first.
+	sort.Slice(links, func(i, j int) bool {
+		return len(links[i].Domain) > len(links[j].Domain)
+	})
+	g.lock.Lock()
+	g.links = links
+	g.lock.Unlock()
+}
+
+// Links returns the links served.
+func (g *Gateway) Links() []Link {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return append([]Link(nil), g.links...)
+}
+
+// Snapshot returns the cached records by domain, for the admin API.
+func (g *Gateway) Snapshot() interface{} {
+	snapshot := make(map[string][]Record)
+	for _, link := range g.Links() {
+		snapshot[link.Domain] = link.Cache.Records()
+	}
+	return snapshot
+}
+
+// Answer answers a DNS query.
+func (g *Gateway) Answer(ctx context.Context, req *layers.DNS) *layers.DNS {
+	res := &layers.DNS{
+		ID:        req.ID,
+		QR:        true,
+		OpCode:    req.OpCode,
+		RD:        req.RD,
+		Questions: req.Questions,
+	}
+	if req.QR || req.OpCode != layers.DNSOpCodeQuery || len(req.Questions) != 1 {
+		res.ResponseCode = layers.DNSResponseCodeNotImp
+		if req.OpCode == layers.DNSOpCodeQuery {
+			res.ResponseCode = layers.DNSResponseCodeFormErr
+		}
+		return res
+	}
+	q := req.Questions[0]
+	name := normalize(string(q.Name))
+
+	if domains := g.browseDomains(name, q.Type); domains != nil {
+		res.AA = true
+		for _, domain := range domains {
+			res.Answers = append(res.Answers, layers.DNSResourceRecord{
+				Name: []byte(name), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: browseDomainTTL, PTR: []byte(domain),
+			})
+		}
+		return res
+	}
+
+	link, ok := g.link(name)
+	if !ok {
+		res.ResponseCode = layers.DNSResponseCodeRefused
+		return res
+	}
+	res.AA = true
+	if name == link.Domain {
+		// The apex has no records of its own.
+		return res
+	}
+	mdnsName := strings.TrimSuffix(name, link.Domain) + mdnsDomain
+
+	records := link.Cache.Lookup(mdnsName, q.Type)
+	if len(records) == 0 && link.Query != nil && (q.Type == TypeANY || servedType(q.Type)) {
+		records = g.query(ctx, link, mdnsName, q.Type)
+	}
+	res.Answers = translate(records, link.Domain)
+	res.Additionals = translate(additionals(link.Cache, records), link.Domain)
+	return res
+}
+
+// browseDomains returns the domains to answer a browse domain question with,
+// or nil if name is not one.
+func (g *Gateway) browseDomains(name string, rrtype layers.DNSType) []string {
+	if rrtype != layers.DNSTypePTR && rrtype != TypeANY {
+		return nil
+	}
+	for _, label := range browseDomainLabels {
+		if name != label && !strings.HasPrefix(name, label+".") {
+			continue
+		}
+		links := g.Links()
+		domains := make([]string, 0, len(links))
+		for _, link := range links {
+			domains = append(domains, link.Domain)
+		}
+		sort.Strings(domains)
+		return domains
+	}
+	return nil
+}
+
+// link returns the link whose domain name is in.
+func (g *Gateway) link(name string) (Link, bool) {
+	for _, link := range g.Links() {
+		if name == link.Domain || strings.HasSuffix(name, "."+link.Domain) {
+			return link, true
+		}
+	}
+	return Link{}, false
+}
+
+// query asks the link for the records of name and waits for them up to
+// QueryTimeout. Clients asking the same question meanwhile share the answer
+// rather than sending the question again.
+func (g *Gateway) query(ctx context.Context, link Link, name string, rrtype layers.DNSType) []layers.DNSResourceRecord {
+	key := queryKey{domain: link.Domain, name: name, rrtype: rrtype}
+	g.queryLock.Lock()
+	if p, ok := g.queries[key]; ok {
+		g.queryLock.Unlock()
+		select {
+		case <-p.done:
+			return p.records
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	if g.queries == nil {
+		g.queries = make(map[queryKey]*pendingQuery)
+	}
+	p := &pendingQuery{done: make(chan struct{})}
+	g.queries[key] = p
+	g.queryLock.Unlock()
+
+	p.records = g.ask(ctx, link, name, rrtype)
+	g.queryLock.Lock()
+	delete(g.queries, key)
+	g.queryLock.Unlock()
+	close(p.done)
+	return p.records
+}
+
+// ask sends an mDNS question on the link and waits for its answers up to
+// QueryTimeout.
+func (g *Gateway) ask(ctx context.Context, link Link, name string, rrtype layers.DNSType) []layers.DNSResourceRecord {
+	timeout := DefaultQueryTimeout
+	if g.QueryTimeout > 0 {
+		timeout = g.QueryTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	changed := link.Cache.wait()
+	err := link.Query(layers.DNSQuestion{Name: []byte(name), Type: rrtype, Class: layers.DNSClassIN})
+	if err != nil {
+		g.logger().Warn("dnssd: mDNS query failed", "domain", link.Domain, "name", name, "error", err)
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+		changed = link.Cache.wait()
+		if records := link.Cache.Lookup(name, rrtype); len(records) > 0 {
+			return records
+		}
+	}
+}
+
+// additionals returns the records that go with answers (RFC 6763, section
+// 12): the SRV and TXT records of instances and the addresses of hosts.
+func additionals(cache *Cache, answers []layers.DNSResourceRecord) []layers.DNSResourceRecord {
+	var records []layers.DNSResourceRecord
+	seen := make(map[string]bool)
+	add := func(name string, rrtype layers.DNSType) []layers.DNSResourceRecord {
+		key := normalize(name) + "/" + rrtype.String()
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+		found := cache.Lookup(name, rrtype)
+		records = append(records, found...)
+		return found
+	}
+	addHost := func(host string) {
+		add(host, layers.DNSTypeA)
+		add(host, layers.DNSTypeAAAA)
+	}
+	for _, rr := range answers {
+		switch rr.Type {
+		case layers.DNSTypePTR:
+			for _, srv := range add(string(rr.PTR), layers.DNSTypeSRV) {
+				addHost(string(srv.SRV.Name))
+			}
+			add(string(rr.PTR), layers.DNSTypeTXT)
+		case layers.DNSTypeSRV:
+			addHost(string(rr.SRV.Name))
+		}
+	}
+	return records
+}
+
+// translate renames mDNS records into domain and caps their TTL. Link-local
+// addresses are dropped, since clients on other links cannot reach them
+// (RFC 8766, section 5.5.2).
+func translate(records []layers.DNSResourceRecord, domain string) []layers.DNSResourceRecord {
+	translated := make([]layers.DNSResourceRecord, 0, len(records))
+	for _, rr := range records {
+		if (rr.Type == layers.DNSTypeA || rr.Type == layers.DNSTypeAAAA) && !reachable(rr.IP) {
+			continue
+		}
+		rr.Name = rename(rr.Name, domain)
+		rr.PTR = rename(rr.PTR, domain)
+		rr.CNAME = rename(rr.CNAME, domain)
+		rr.SRV.Name = rename(rr.SRV.Name, domain)
+		rr.TTL = min(rr.TTL, maxTTL)
+		translated = append(translated, rr)
+	}
+	return translated
+}
+
+// rename replaces the "local" domain of an mDNS name with domain.
+func rename(name []byte, domain string) []byte {
+	s := strings.TrimSuffix(string(name), ".")
+	if i := len(s) - len(mdnsDomain); i >= 0 && strings.EqualFold(s[i:], mdnsDomain) && (i == 0 || s[i-1] == '.') {
+		return []byte(s[:i] + domain)
+	}
+	return name
+}
+
+// reachable reports whether ip may be served to clients on other links.
+func reachable(ip net.IP) bool {
+	return !ip.IsLinkLocalUnicast() && !ip.IsLoopback()
+}
@@ -0,0 +1,496 @@
+package dnssd
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const testDomain = "iot.home.arpa"
+
+// printer returns the mDNS records of an IPP printer, with a link-local
+// address besides its routable ones.
+func printer() *layers.DNS {
+	return &layers.DNS{QR: true, AA: true, Answers: []layers.DNSResourceRecord{
+		{Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: 4500, PTR: []byte("Printer._ipp._tcp.local")},
+		{Name: []byte("Printer._ipp._tcp.local"), Type: layers.DNSTypeSRV, Class: layers.DNSClassIN | classTopBit, TTL: 120,
+			SRV: layers.DNSSRV{Port: 631, Name: []byte("printer.local")}},
+		{Name: []byte("Printer._ipp._tcp.local"), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN | classTopBit, TTL: 4500,
+			TXTs: [][]byte{[]byte("txtvers=1"), []byte("rp=ipp/print")}},
+		{Name: []byte("printer.local"), Type: layers.DNSTypeA, Class: layers.DNSClassIN | classTopBit, TTL: 120, IP: net.IPv4(192, 168, 1, 50).To4()},
+		{Name: []byte("printer.local"), Type: layers.DNSTypeA, Class: layers.DNSClassIN | classTopBit, TTL: 120, IP: net.IPv4(169, 254, 3, 7).To4()},
+		{Name: []byte("printer.local"), Type: layers.DNSTypeAAAA, Class: layers.DNSClassIN | classTopBit, TTL: 120, IP: net.ParseIP("fe80::1")},
+		{Name: []byte("printer.local"), Type: layers.DNSTypeAAAA, Class: layers.DNSClassIN | classTopBit, TTL: 120, IP: net.ParseIP("fd00::50")},
+	}}
+}
+
+// serve runs g on loopback UDP and TCP listeners until the test ends and
+// returns their address.
+func serve(t *testing.T, g *Gateway) (udp, tcp string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- g.Serve(ctx, pc, l)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Serve = %v", err)
+		}
+	})
+	return pc.LocalAddr().String(), l.Addr().String()
+}
+
+func question(name string, rrtype layers.DNSType) *layers.DNS {
+	return &layers.DNS{ID: 0x1234, RD: true, Questions: []layers.DNSQuestion{
+		{Name: []byte(name), Type: rrtype, Class: layers.DNSClassIN},
+	}}
+}
+
+func serialize(t *testing.T, msg *layers.DNS) []byte {
+	t.Helper()
+	msg.QDCount = uint16(len(msg.Questions))
+	msg.ARCount = uint16(len(msg.Additionals))
+	buf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decode(t *testing.T, b []byte) *layers.DNS {
+	t.Helper()
+	res := &layers.DNS{}
+	if err := res.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return res
+}
+
+// exchangeUDP sends req to the gateway at addr over UDP and returns its
+// response.
+func exchangeUDP(t *testing.T, addr string, req *layers.DNS) *layers.DNS {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(serialize(t, req)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxEDNSSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decode(t, buf[:n])
+}
+
+// exchangeTCP sends req to the gateway at addr over TCP and returns its
+// response.
+func exchangeTCP(t *testing.T, addr string, req *layers.DNS) *layers.DNS {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeTCP(t, conn, req); err != nil {
+		t.Fatal(err)
+	}
+	res, err := readTCP(t, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// writeTCP sends req, length-prefixed, on conn.
+func writeTCP(t *testing.T, conn net.Conn, req *layers.DNS) error {
+	t.Helper()
+	msg := serialize(t, req)
+	_, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+// readTCP reads a length-prefixed response from conn.
+func readTCP(t *testing.T, conn net.Conn) (*layers.DNS, error) {
+	t.Helper()
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return decode(t, buf), nil
+}
+
+// lines formats records one per line, sorted, to compare them.
+func lines(records []layers.DNSResourceRecord) []string {
+	var lines []string
+	for _, rr := range records {
+		lines = append(lines, fmt.Sprintf("%s %s %d %s", rr.Name, rr.Type, rr.TTL, rdata(rr)))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func equal(a, b []string) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func newGateway(query func(questions ...layers.DNSQuestion) error) (*Gateway, *Cache) {
+	cache := NewCache()
+	g := &Gateway{QueryTimeout: 100 * time.Millisecond}
+	g.SetLinks([]Link{{Domain: testDomain, Cache: cache, Query: query}})
+	return g, cache
+}
+
+func TestServeBrowse(t *testing.T) {
+	g, cache := newGateway(nil)
+	cache.Observe(printer())
+	udp, tcp := serve(t, g)
+
+	for _, tt := range []struct {
+		network  string
+		addr     string
+		exchange func(*testing.T, string, *layers.DNS) *layers.DNS
+	}{
+		{"udp", udp, exchangeUDP},
+		{"tcp", tcp, exchangeTCP},
+	} {
+		t.Run(tt.network, func(t *testing.T) {
+			res := tt.exchange(t, tt.addr, question("_ipp._tcp."+testDomain, layers.DNSTypePTR))
+			if !res.QR || !res.AA || res.ID != 0x1234 || res.ResponseCode != layers.DNSResponseCodeNoErr {
+				t.Fatalf("response header %+v", res)
+			}
+			want := []string{"_ipp._tcp.iot.home.arpa PTR 10 printer._ipp._tcp.iot.home.arpa"}
+			if got := lines(res.Answers); !equal(got, want) {
+				t.Errorf("answers = %q, want %q", got, want)
+			}
+			want = []string{
+				"Printer._ipp._tcp.iot.home.arpa SRV 10 0 0 631 printer.iot.home.arpa",
+				"Printer._ipp._tcp.iot.home.arpa TXT 10 txtvers=1 rp=ipp/print",
+				"printer.iot.home.arpa A 10 192.168.1.50",
+				"printer.iot.home.arpa AAAA 10 fd00::50",
+			}
+			if got := lines(res.Additionals); !equal(got, want) {
+				t.Errorf("additionals = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestServeAddresses(t *testing.T) {
+	g, cache := newGateway(nil)
+	cache.Observe(printer())
+	udp, _ := serve(t, g)
+
+	for _, tt := range []struct {
+		rrtype layers.DNSType
+		want   []string
+	}{
+		{layers.DNSTypeA, []string{"printer.iot.home.arpa A 10 192.168.1.50"}},
+		{layers.DNSTypeAAAA, []string{"printer.iot.home.arpa AAAA 10 fd00::50"}},
+		{TypeANY, []string{"printer.iot.home.arpa A 10 192.168.1.50", "printer.iot.home.arpa AAAA 10 fd00::50"}},
+	} {
+		res := exchangeUDP(t, udp, question("printer."+testDomain, tt.rrtype))
+		if got := lines(res.Answers); !equal(got, tt.want) {
+			t.Errorf("%v answers = %q, want %q", tt.rrtype, got, tt.want)
+		}
+	}
+}
+
+func TestServeBrowseDomains(t *testing.T) {
+	g, _ := newGateway(nil)
+	g.SetLinks(append(g.Links(), Link{Domain: "Media.Home.Arpa.", Cache: NewCache()}))
+	udp, _ := serve(t, g)
+
+	for _, name := range []string{"b._dns-sd._udp.home.arpa", "lb._dns-sd._udp", "db._dns-sd._udp.example.com"} {
+		res := exchangeUDP(t, udp, question(name, layers.DNSTypePTR))
+		var got []string
+		for _, rr := range res.Answers {
+			got = append(got, fmt.Sprintf("%s %d", rr.PTR, rr.TTL))
+		}
+		want := []string{"iot.home.arpa 300", "media.home.arpa 300"}
+		if !res.AA || !equal(got, want) {
+			t.Errorf("%s answers = %q, want %q", name, got, want)
+		}
+	}
+	if res := exchangeUDP(t, udp, question("b._dns-sd._udp.home.arpa", layers.DNSTypeA)); res.ResponseCode != layers.DNSResponseCodeRefused {
+		t.Errorf("A question for a browse domain name = %v, want %v", res.ResponseCode, layers.DNSResponseCodeRefused)
+	}
+}
+
+func TestServeRefused(t *testing.T) {
+	g, _ := newGateway(func(...layers.DNSQuestion) error {
+		t.Error("mDNS question sent for a domain not served")
+		return nil
+	})
+	udp, tcp := serve(t, g)
+
+	for _, name := range []string{"printer.example.com", "home.arpa", "printer.xiot.home.arpa"} {
+		if res := exchangeUDP(t, udp, question(name, layers.DNSTypeA)); res.ResponseCode != layers.DNSResponseCodeRefused || len(res.Answers) != 0 {
+			t.Errorf("UDP %s = %v %d answers, want %v", name, res.ResponseCode, len(res.Answers), layers.DNSResponseCodeRefused)
+		}
+		if res := exchangeTCP(t, tcp, question(name, layers.DNSTypeA)); res.ResponseCode != layers.DNSResponseCodeRefused {
+			t.Errorf("TCP %s = %v, want %v", name, res.ResponseCode, layers.DNSResponseCodeRefused)
+		}
+	}
+	if res := exchangeUDP(t, udp, question(testDomain, layers.DNSTypeA)); res.ResponseCode != layers.DNSResponseCodeNoErr || !res.AA {
+		t.Errorf("apex = %v, want an authoritative empty answer", res.ResponseCode)
+	}
+}
+
+func TestServeQuery(t *testing.T) {
+	var asked atomic.Int32
+	var g *Gateway
+	var cache *Cache
+	g, cache = newGateway(func(questions ...layers.DNSQuestion) error {
+		asked.Add(1)
+		if string(questions[0].Name) != "printer.local" || questions[0].Type != layers.DNSTypeA {
+			t.Errorf("mDNS question %s %v", questions[0].Name, questions[0].Type)
+		}
+		go cache.Observe(printer())
+		return nil
+	})
+	g.QueryTimeout = 5 * time.Second
+	udp, _ := serve(t, g)
+
+	res := exchangeUDP(t, udp, question("printer."+testDomain, layers.DNSTypeA))
+	if want := []string{"printer.iot.home.arpa A 10 192.168.1.50"}; !equal(lines(res.Answers), want) {
+		t.Errorf("answers = %q, want %q", lines(res.Answers), want)
+	}
+	exchangeUDP(t, udp, question("printer."+testDomain, layers.DNSTypeA))
+	if n := asked.Load(); n != 1 {
+		t.Errorf("%d mDNS questions sent, want 1", n)
+	}
+}
+
+func TestQueryCoalesced(t *testing.T) {
+	asked := make(chan struct{}, 10)
+	g, cache := newGateway(func(...layers.DNSQuestion) error {
+		asked <- struct{}{}
+		return nil
+	})
+	g.QueryTimeout = 5 * time.Second
+
+	var wg sync.WaitGroup
+	answers := make([][]layers.DNSResourceRecord, 4)
+	for i := range answers {
+		wg.Add(1)
+		i := i
+		go func() {
+			defer wg.Done()
+			answers[i] = g.Answer(context.Background(), question("printer."+testDomain, layers.DNSTypeA)).Answers
+		}()
+	}
+	<-asked
+	// Let the other clients join the question before it is answered.
+	time.Sleep(50 * time.Millisecond)
+	cache.Observe(printer())
+	wg.Wait()
+
+	if n := len(asked); n != 0 {
+		t.Errorf("%d more mDNS questions sent, want 0", n)
+	}
+	for i, records := range answers {
+		if len(records) != 1 {
+			t.Errorf("client %d got %q", i, lines(records))
+		}
+	}
+}
+
+func TestTranslateTTL(t *testing.T) {
+	records := translate([]layers.DNSResourceRecord{
+		{Name: []byte("a.local"), Type: layers.DNSTypeA, TTL: 4500, IP: net.IPv4(10, 0, 0, 1)},
+		{Name: []byte("b.local"), Type: layers.DNSTypeA, TTL: 3, IP: net.IPv4(10, 0, 0, 2)},
+		{Name: []byte("c.local"), Type: layers.DNSTypeA, TTL: 60, IP: net.IPv4(127, 0, 0, 1)},
+		{Name: []byte("d.local"), Type: layers.DNSTypeAAAA, TTL: 60, IP: net.ParseIP("fe80::2")},
+	}, testDomain)
+	want := []string{"a.iot.home.arpa A 10 10.0.0.1", "b.iot.home.arpa A 3 10.0.0.2"}
+	if got := lines(records); !equal(got, want) {
+		t.Errorf("translate = %q, want %q", got, want)
+	}
+}
+
+func TestEncodeTruncates(t *testing.T) {
+	var answers, additionals []layers.DNSResourceRecord
+	for i := 0; i < 40; i++ {
+		instance := fmt.Sprintf("Printer %d._ipp._tcp.%s", i, testDomain)
+		answers = append(answers, layers.DNSResourceRecord{
+			Name: []byte("_ipp._tcp." + testDomain), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: 10, PTR: []byte(instance),
+		})
+		additionals = append(additionals, layers.DNSResourceRecord{
+			Name: []byte(instance), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN, TTL: 10, TXTs: [][]byte{[]byte("txtvers=1")},
+		})
+	}
+	for _, tt := range []struct {
+		name        string
+		answers     int
+		size        int
+		additionals bool
+		tc          bool
+	}{
+		{"fits", 40, 0xffff, true, false},
+		{"without additionals", 5, maxUDPSize, false, false},
+		{"truncated", 40, maxUDPSize, false, true},
+		{"truncated to EDNS size", 40, 1232, false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			q := question("_ipp._tcp."+testDomain, layers.DNSTypePTR)
+			res := &layers.DNS{ID: q.ID, QR: true, AA: true, Questions: q.Questions,
+				Answers: answers[:tt.answers:tt.answers], Additionals: additionals[:tt.answers:tt.answers]}
+			b, err := encode(res, tt.size)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if len(b) > tt.size {
+				t.Errorf("encoded %d bytes, more than %d", len(b), tt.size)
+			}
+			got := decode(t, b)
+			wantAnswers := tt.answers
+			if tt.tc {
+				wantAnswers = 0
+			}
+			if got.TC != tt.tc || len(got.Answers) != wantAnswers || (len(got.Additionals) > 0) != tt.additionals {
+				t.Errorf("TC %v, %d answers, %d additionals; want TC %v, %d answers, additionals %v",
+					got.TC, len(got.Answers), len(got.Additionals), tt.tc, wantAnswers, tt.additionals)
+			}
+		})
+	}
+}
+
+func TestServeTruncatesUDP(t *testing.T) {
+	g, cache := newGateway(nil)
+	msg := &layers.DNS{QR: true}
+	for i := 0; i < 40; i++ {
+		msg.Answers = append(msg.Answers, layers.DNSResourceRecord{
+			Name: []byte("_ipp._tcp.local"), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: 120,
+			PTR: []byte(fmt.Sprintf("Printer %d._ipp._tcp.local", i)),
+		})
+	}
+	cache.Observe(msg)
+	udp, tcp := serve(t, g)
+
+	q := question("_ipp._tcp."+testDomain, layers.DNSTypePTR)
+	if res := exchangeUDP(t, udp, q); !res.TC || len(res.Answers) != 0 {
+		t.Errorf("UDP response TC %v with %d answers, want truncated", res.TC, len(res.Answers))
+	}
+	edns := question("_ipp._tcp."+testDomain, layers.DNSTypePTR)
+	edns.Additionals = []layers.DNSResourceRecord{{Type: layers.DNSTypeOPT, Class: 4096}}
+	if res := exchangeUDP(t, udp, edns); res.TC || len(res.Answers) != 40 {
+		t.Errorf("EDNS UDP response TC %v with %d answers, want 40", res.TC, len(res.Answers))
+	}
+	if res := exchangeTCP(t, tcp, q); res.TC || len(res.Answers) != 40 {
+		t.Errorf("TCP response TC %v with %d answers, want 40", res.TC, len(res.Answers))
+	}
+}
+
+func TestServeTCPLimit(t *testing.T) {
+	g, _ := newGateway(nil)
+	_, tcp := serve(t, g)
+	q := question("printer."+testDomain, layers.DNSTypeA)
+
+	conns := make([]net.Conn, maxConnections+1)
+	for i := range conns {
+		conn, err := net.Dial("tcp", tcp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	// The first connections are served, and held open.
+	for _, conn := range conns[:maxConnections] {
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := writeTCP(t, conn, q); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readTCP(t, conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	last := conns[maxConnections]
+	if err := writeTCP(t, last, q); err != nil {
+		t.Fatal(err)
+	}
+	_ = last.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := readTCP(t, last); err == nil {
+		t.Fatalf("connection %d served while %d were open", maxConnections+1, maxConnections)
+	}
+	_ = conns[0].Close()
+	_ = last.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := readTCP(t, last); err != nil {
+		t.Errorf("connection not served once another closed: %v", err)
+	}
+}
+
+func TestServeClosesConnectionsOnError(t *testing.T) {
+	g, _ := newGateway(nil)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Serve(context.Background(), pc, l)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeTCP(t, conn, question(testDomain, layers.DNSTypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readTCP(t, conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failing to read UDP stops serving TCP too.
+	_ = pc.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Serve after a read error = nil, want the error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read on an open connection after Serve returned = %v, want EOF", err)
+	}
+}
@@ -0,0 +1,239 @@
+package dnssd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// maxUDPSize is the size of UDP responses to clients without EDNS
+	// (RFC 1035, section 4.2.1).
+	maxUDPSize = 512
+	// maxEDNSSize bounds the UDP payload size clients may ask for.
+	maxEDNSSize = 4096
+	// maxConcurrency bounds the number of UDP queries answered at once;
+	// further datagrams wait in the socket buffer.
+	maxConcurrency = 64
+	// maxConnections bounds the number of TCP connections served at once;
+	// further connections wait in the listen backlog.
+	maxConnections = 64
+	// tcpIdleTimeout closes idle TCP connections.
+	tcpIdleTimeout = 10 * time.Second
+)
+
+// ListenAndServe answers DNS queries on address, over UDP and TCP, until ctx
+// is cancelled.
+func (g *Gateway) ListenAndServe(ctx context.Context, address string) error {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		_ = pc.Close()
+		return err
+	}
+	g.logger().Info("Serving DNS gateway", "address", pc.LocalAddr())
+	return g.Serve(ctx, pc, l)
+}
+
+// Serve answers DNS queries received on pc and on connections accepted from
+// l until ctx is cancelled, then closes them. Either may be nil.
+func (g *Gateway) Serve(ctx context.Context, pc net.PacketConn, l net.Listener) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	if pc != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- g.serveUDP(ctx, pc)
+		}()
+	}
+	if l != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- g.serveTCP(ctx, l)
+		}()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+	if pc != nil {
+		_ = pc.Close()
+	}
+	if l != nil {
+		_ = l.Close()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (g *Gateway) serveUDP(ctx context.Context, pc net.PacketConn) error {
+	var running sync.WaitGroup
+	defer running.Wait()
+	slots := make(chan struct{}, maxConcurrency)
+	for {
+		buf := make([]byte, maxEDNSSize)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		running.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				running.Done()
+			}()
+			req := &layers.DNS{}
+			if err := req.DecodeFromBytes(buf[:n], gopacket.NilDecodeFeedback); err != nil {
+				return
+			}
+			res, err := encode(g.Answer(ctx, req), udpSize(req))
+			if err != nil {
+				g.logger().Warn("dnssd: failed to encode response", "error", err)
+				return
+			}
+			_, _ = pc.WriteTo(res, addr)
+		}()
+	}
+}
+
+func (g *Gateway) serveTCP(ctx context.Context, l net.Listener) error {
+	var (
+		lock    sync.Mutex
+		conns   = make(map[net.Conn]bool)
+		running sync.WaitGroup
+	)
+	// Connections left open are closed on return, whatever the reason.
+	defer func() {
+		lock.Lock()
+		for conn := range conns {
+			_ = conn.Close()
+		}
+		lock.Unlock()
+		running.Wait()
+	}()
+	slots := make(chan struct{}, maxConnections)
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		conns[conn] = true
+		lock.Unlock()
+		running.Add(1)
+		go func() {
+			defer func() {
+				lock.Lock()
+				delete(conns, conn)
+				lock.Unlock()
+				<-slots
+				running.Done()
+			}()
+			g.serveConn(ctx, conn)
+		}()
+	}
+}
+
+// serveConn answers the length-prefixed queries of a TCP connection (RFC
+// 1035, section 4.2.2) until it is idle or closed.
+func (g *Gateway) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+	for {
+		_ = conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		req := &layers.DNS{}
+		if err := req.DecodeFromBytes(buf, gopacket.NilDecodeFeedback); err != nil {
+			return
+		}
+		res, err := encode(g.Answer(ctx, req), 0xffff)
+		if err != nil {
+			g.logger().Warn("dnssd: failed to encode response", "error", err)
+			return
+		}
+		msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(res)), uint16(len(res)))
+		if _, err := conn.Write(append(msg, res...)); err != nil {
+			return
+		}
+	}
+}
+
+// udpSize returns the size of the UDP responses the client of req accepts.
+func udpSize(req *layers.DNS) int {
+	for _, rr := range req.Additionals {
+		if rr.Type == layers.DNSTypeOPT {
+			return min(max(int(rr.Class), maxUDPSize), maxEDNSSize)
+		}
+	}
+	return maxUDPSize
+}
+
+var errTooLarge = errors.New("response too large")
+
+// encode serializes res within size bytes, dropping the additional records
+// if needed and setting the TC bit if the answers do not fit either.
+func encode(res *layers.DNS, size int) ([]byte, error) {
+	serialize := func() ([]byte, error) {
+		res.QDCount = uint16(len(res.Questions))
+		res.ANCount = uint16(len(res.Answers))
+		res.NSCount = uint16(len(res.Authorities))
+		res.ARCount = uint16(len(res.Additionals))
+		buf := gopacket.NewSerializeBuffer()
+		if err := res.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+			return nil, err
+		}
+		if len(buf.Bytes()) > size {
+			return nil, errTooLarge
+		}
+		return buf.Bytes(), nil
+	}
+
+	b, err := serialize()
+	if !errors.Is(err, errTooLarge) {
+		return b, err
+	}
+	res.Additionals = nil
+	if b, err = serialize(); !errors.Is(err, errTooLarge) {
+		return b, err
+	}
+	res.Answers = nil
+	res.TC = true
+	return serialize()
+}
@@ -0,0 +1,125 @@
+package httpu
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// HeaderOrderHeader records the header names of a received message in their
+// original order and case, so that relayed messages are written as received.
+// Serve sets it on requests and clients set it on responses.
+const HeaderOrderHeader = "X-header-order"
+
+// requestHeaderOrder and responseHeaderOrder are the canonical orders of the
+// headers of originated messages. Other headers follow in alphabetical order.
+var (
+	requestHeaderOrder  = []string{"HOST", "MAN", "MX", "ST", "NT", "NTS", "USN", "LOCATION", "CACHE-CONTROL", "SERVER"}
+	responseHeaderOrder = []string{"CACHE-CONTROL", "DATE", "EXT", "LOCATION", "SERVER", "ST", "USN"}
+)
+
+// SetHeaderOrder records names as the order of the headers in h.
+func SetHeaderOrder(h http.Header, names []string) {
+	h[http.CanonicalHeaderKey(HeaderOrderHeader)] = []string{strings.Join(names, ",")}
+}
+
+// HeaderOrder returns the header names recorded in h by SetHeaderOrder.
+func HeaderOrder(h http.Header) []string {
+	order := h.Get(HeaderOrderHeader)
+	if order == "" {
+		return nil
+	}
+	return strings.Split(order, ",")
+}
+
+// headerOrder returns the header names of a raw message, in order and with
+// their original case. Repeated headers are repeated.
+func headerOrder(msg []byte) []string {
+	var names []string
+	// Skip the start line.
+	_, msg, _ = bytes.Cut(msg, []byte("\n"))
+	for len(msg) > 0 {
+		var line []byte
+		line, msg, _ = bytes.Cut(msg, []byte("\n"))
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// Continuation of the previous header.
+			continue
+		}
+		name, _, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			continue
+		}
+		if name := strings.TrimSpace(string(name)); name != "" && !strings.Contains(name, ",") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// writeHeader writes the headers of h. If h records an order, headers are
+// written in it with their original names, followed by headers added since.
+// Otherwise, headers are written upper-cased in the canonical order.
+func writeHeader(wr io.Writer, h http.Header, canonical []string) error {
+	// Keys set directly in the map, e.g. "HOST", may not be canonical.
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		if !isAnnotationHeader(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	values := make(map[string][]string, len(keys))
+	for _, k := range keys {
+		key := http.CanonicalHeaderKey(k)
+		values[key] = append(values[key], h[k]...)
+	}
+
+	write := func(name string) error {
+		key := http.CanonicalHeaderKey(name)
+		if len(values[key]) == 0 {
+			// Deleted since the message was received.
+			return nil
+		}
+		v := values[key][0]
+		values[key] = values[key][1:]
+		_, err := fmt.Fprintf(wr, "%s: %s\r\n", name, v)
+		return err
+	}
+	writeAll := func(name string) error {
+		for len(values[http.CanonicalHeaderKey(name)]) > 0 {
+			if err := write(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, name := range HeaderOrder(h) {
+		if err := write(name); err != nil {
+			return err
+		}
+	}
+	for _, name := range canonical {
+		if err := writeAll(name); err != nil {
+			return err
+		}
+	}
+	rest := make([]string, 0, len(values))
+	for key := range values {
+		rest = append(rest, key)
+	}
+	sort.Strings(rest)
+	for _, key := range rest {
+		if err := writeAll(strings.ToUpper(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
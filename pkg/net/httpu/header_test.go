@@ -0,0 +1,130 @@
+package httpu
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// golden returns the SSDP messages captured from real devices, completed
+// with the final empty line where it is missing.
+func golden(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	files, err := filepath.Glob(filepath.Join("..", "ssdp", "testdata", "*.txt"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(files) == 0 {
+		tb.Fatal("no captures in ssdp/testdata")
+	}
+	captures := make(map[string][]byte, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if !bytes.HasSuffix(data, []byte("\r\n\r\n")) {
+			data = append(bytes.TrimRight(data, "\r\n"), "\r\n\r\n"...)
+		}
+		captures[filepath.Base(file)] = data
+	}
+	return captures
+}
+
+// readMessage reads data like Serve and clients do, recording the order of
+// its headers, and returns a function writing it back.
+func readMessage(tb testing.TB, data []byte) (http.Header, func() []byte) {
+	tb.Helper()
+	r := bufio.NewReader(bytes.NewReader(data))
+	var buf bytes.Buffer
+	if bytes.HasPrefix(data, []byte("HTTP/")) {
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			tb.Fatalf("ReadResponse: %v", err)
+		}
+		SetHeaderOrder(res.Header, headerOrder(data))
+		return res.Header, func() []byte {
+			buf.Reset()
+			if err := WriteResponse(&buf, res); err != nil {
+				tb.Fatalf("WriteResponse: %v", err)
+			}
+			return buf.Bytes()
+		}
+	}
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		tb.Fatalf("ReadRequest: %v", err)
+	}
+	SetHeaderOrder(req.Header, headerOrder(data))
+	return req.Header, func() []byte {
+		buf.Reset()
+		if err := WriteRequest(&buf, req); err != nil {
+			tb.Fatalf("WriteRequest: %v", err)
+		}
+		return buf.Bytes()
+	}
+}
+
+// headerLines returns the start line and headers of msg, with a single
+// space after each colon and no trailing space: writers normalise those.
+func headerLines(msg []byte) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(msg), "\r\n\r\n"), "\r\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok && len(lines) > 0 {
+			line = fmt.Sprintf("%s: %s", name, strings.TrimSpace(value))
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestWriteGolden(t *testing.T) {
+	for name, data := range golden(t) {
+		t.Run(name, func(t *testing.T) {
+			_, write := readMessage(t, data)
+			got := headerLines(write())
+			want := headerLines(data)
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("written headers differ:\n got %q\nwant %q", got, want)
+			}
+		})
+	}
+}
+
+func TestWriteGoldenModified(t *testing.T) {
+	for name, data := range golden(t) {
+		t.Run(name, func(t *testing.T) {
+			header, write := readMessage(t, data)
+			want := headerLines(data)
+			// Drop the first header other than HOST, which is kept apart
+			// from the headers of requests.
+			for i, line := range want[1:] {
+				name, _, _ := strings.Cut(line, ":")
+				if !strings.EqualFold(name, "HOST") {
+					header.Del(name)
+					want = append(want[:i+1], want[i+2:]...)
+					break
+				}
+			}
+			header.Set("X-Added", "1")
+			want = append(want, "X-ADDED: 1")
+			header.Set(LocalAddressHeader, "10.0.0.1")
+
+			written := write()
+			if got := headerLines(written); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("written headers differ:\n got %q\nwant %q", got, want)
+			}
+			lower := strings.ToLower(string(written))
+			for _, annotation := range []string{HeaderOrderHeader, LocalAddressHeader} {
+				if strings.Contains(lower, strings.ToLower(annotation)) {
+					t.Errorf("%s written:\n%s", annotation, written)
+				}
+			}
+		})
+	}
+}
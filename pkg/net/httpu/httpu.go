@@ -7,9 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,118 +22,313 @@ const DefaultTimeout = 10 * time.Second
 
 const LocalAddressHeader = "X-local-address"
 
+// RemoteAddressHeader is set on every response to the address it was received
+// from.
+const RemoteAddressHeader = "X-remote-address"
+
+// maxDatagramBytes is the largest payload of a UDP datagram over IPv4.
+const maxDatagramBytes = 65507
+
+// ResponseFunc is called for each response as soon as it is received.
+// Returning an error stops the request.
+type ResponseFunc func(*http.Response) error
+
 // Client is an interface for sending HTTP over UDP requests and receive responses.
 type Client interface {
 	io.Closer
 
 	// Do sends the request and returns the responses. numSends controls the number of times the request is sent.
 	Do(ctx context.Context, req *http.Request, numSends int) ([]*http.Response, error)
+
+	// DoFunc sends the request like Do, and passes each response to fn as it
+	// arrives instead of returning them at the end.
+	DoFunc(ctx context.Context, req *http.Request, numSends int, fn ResponseFunc) error
+
+	// DoAllFunc sends every request like DoFunc, and passes the responses to
+	// all of them to fn within a single response window.
+	DoAllFunc(ctx context.Context, reqs []*http.Request, numSends int, fn ResponseFunc) error
+}
+
+// SendPolicy controls the delay between repeated sends of a request. The
+// delay before send i+1 is Interval * Backoff^i plus a random duration of up
+// to Jitter.
+type SendPolicy struct {
+	Interval time.Duration
+	Backoff  float64
+	Jitter   time.Duration
+}
+
+// DefaultSendPolicy spaces sends by 5ms.
+var DefaultSendPolicy = SendPolicy{
+	Interval: 5 * time.Millisecond,
+	Backoff:  1,
+}
+
+func (p SendPolicy) delay(i int) time.Duration {
+	d := time.Duration(float64(p.Interval) * math.Pow(math.Max(p.Backoff, 1), float64(i)))
+	if p.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(p.Jitter)))
+	}
+	return d
 }
 
 // HttpUClient is a client dealing with HTTP over UDP. Its typical function is for HTTPMU, and particularly SSDP.
 type client struct {
-	connLock sync.Mutex // Protects use of conn.
+	connLock sync.Mutex // Serializes requests on conn.
 	conn     net.PacketConn
+	logger   *slog.Logger
+
+	maxMessageBytes int
+	sendPolicy      SendPolicy
+}
+
+// ClientOption configures a client.
+type ClientOption func(*client)
+
+// WithLogger sets the logger used to report malformed responses.
+func WithLogger(logger *slog.Logger) ClientOption {
+	return func(c *client) {
+		c.logger = logger
+	}
+}
+
+// WithMaxMessageBytes sets the size of the largest response accepted.
+// Larger responses are discarded. It defaults to the maximum UDP payload,
+// which is also used when n is not positive.
+func WithMaxMessageBytes(n int) ClientOption {
+	return func(c *client) {
+		if n > 0 {
+			c.maxMessageBytes = n
+		}
+	}
+}
+
+// WithSendPolicy sets the delay between repeated sends of a request. It
+// defaults to DefaultSendPolicy.
+func WithSendPolicy(p SendPolicy) ClientOption {
+	return func(c *client) {
+		c.sendPolicy = p
+	}
 }
 
-func NewHTTPUClient() (Client, error) {
+func newClient(conn net.PacketConn, opts []ClientOption) *client {
+	c := &client{
+		conn:            conn,
+		logger:          slog.Default(),
+		maxMessageBytes: maxDatagramBytes,
+		sendPolicy:      DefaultSendPolicy,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// optionsLogger returns the logger set by opts, or the default logger.
+func optionsLogger(opts []ClientOption) *slog.Logger {
+	c := client{logger: slog.Default()}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c.logger
+}
+
+func NewHTTPUClient(opts ...ClientOption) (Client, error) {
 	conn, err := net.ListenPacket("udp", ":0")
 	if err != nil {
 		return nil, err
 	}
-	return &client{conn: conn}, nil
+	return newClient(conn, opts), nil
 }
 
 // NewClientAddr creates a new HTTPUClient which will broadcast packets
-// from the specified address, opening up a new UDP socket for the purpose
-func NewClientAddr(addr string) (Client, error) {
-	ip := net.ParseIP(addr)
+// from the specified address, opening up a new UDP socket for the purpose.
+// IPv6 link-local addresses must include their zone, e.g. "fe80::1%eth0".
+func NewClientAddr(addr string, opts ...ClientOption) (Client, error) {
+	host, zone, _ := strings.Cut(addr, "%")
+	ip := net.ParseIP(host)
 	if ip == nil {
 		return nil, errors.New("invalid listening address")
 	}
-	conn, err := net.ListenPacket("udp", ip.String()+":0")
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Zone: zone})
 	if err != nil {
 		return nil, err
 	}
-	return &client{conn: conn}, nil
+	return newClient(conn, opts), nil
 }
 
-// Close shuts down the client. The client will no longer be useful following this.
+// Close shuts down the client, ending any request in progress. The client
+// will no longer be useful following this.
 func (c *client) Close() error {
-	c.connLock.Lock()
-	defer c.connLock.Unlock()
 	return c.conn.Close()
 }
 
 func (c *client) Do(ctx context.Context, req *http.Request, numSends int) ([]*http.Response, error) {
-	c.connLock.Lock()
-	defer c.connLock.Unlock()
+	var responses []*http.Response
+	err := c.DoFunc(ctx, req, numSends, func(response *http.Response) error {
+		responses = append(responses, response)
+		return nil
+	})
+	return responses, err
+}
 
-	var requestBuf bytes.Buffer
+// DoFunc sends the request numSends times and passes responses to fn until
+// the context deadline, or DefaultTimeout if there is none. Reaching the
+// deadline is the normal end of a request and is not reported as an error;
+// cancellation returns ctx.Err() immediately.
+func (c *client) DoFunc(ctx context.Context, req *http.Request, numSends int, fn ResponseFunc) error {
+	return c.DoAllFunc(ctx, []*http.Request{req}, numSends, fn)
+}
 
-	err := WriteRequest(&requestBuf, req)
-	if err != nil {
-		return nil, err
+// DoAllFunc sends each request numSends times, in turn, and then passes
+// responses to fn like DoFunc. Requests on the client are serialized, so
+// concurrent DoFunc calls would each wait for the previous response window
+// to end. A response refers to the request with its ST header, if any, or
+// to the first request.
+func (c *client) DoAllFunc(ctx context.Context, reqs []*http.Request, numSends int, fn ResponseFunc) error {
+	if len(reqs) == 0 {
+		return errors.New("httpu: no request")
 	}
 
-	destAddr, err := net.ResolveUDPAddr("udp", req.Host)
-	if err != nil {
-		return nil, err
-	}
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
 
-	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
-		err = c.conn.SetDeadline(deadline)
+	requestBufs := make([][]byte, len(reqs))
+	destAddrs := make([]*net.UDPAddr, len(reqs))
+	for i, req := range reqs {
+		var requestBuf bytes.Buffer
+		if err := WriteRequest(&requestBuf, req); err != nil {
+			return err
+		}
+		destAddr, err := net.ResolveUDPAddr("udp", req.Host)
 		if err != nil {
-			return nil, err
+			return err
 		}
-	} else {
-		c.conn.SetDeadline(time.Now().Add(DefaultTimeout))
+		requestBufs[i], destAddrs[i] = requestBuf.Bytes(), destAddr
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		deadline = time.Now().Add(DefaultTimeout)
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return err
 	}
+	// Unblock ReadFrom as soon as the context is done.
+	unblocked := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(unblocked)
+		_ = c.conn.SetDeadline(time.Now())
+	})
+	defer func() {
+		if !stop() {
+			// Wait for the callback before releasing the connection, so
+			// that it cannot end the next request.
+			<-unblocked
+		}
+	}()
 
-	// Send request.
+	// Send requests.
 	for i := 0; i < numSends; i++ {
-		if n, err := c.conn.WriteTo(requestBuf.Bytes(), destAddr); err != nil {
-			return nil, err
-		} else if n < len(requestBuf.Bytes()) {
-			return nil, fmt.Errorf("httpu: wrote %d bytes rather than full %d in request",
-				n, len(requestBuf.Bytes()))
+		for j, requestBuf := range requestBufs {
+			if n, err := c.conn.WriteTo(requestBuf, destAddrs[j]); err != nil {
+				if ctx.Err() != nil {
+					return contextError(ctx)
+				}
+				return err
+			} else if n < len(requestBuf) {
+				return fmt.Errorf("httpu: wrote %d bytes rather than full %d in request",
+					n, len(requestBuf))
+			}
+		}
+		if i == numSends-1 {
+			break
+		}
+		timer := time.NewTimer(c.sendPolicy.delay(i))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return contextError(ctx)
+		case <-timer.C:
 		}
-		time.Sleep(5 * time.Millisecond)
 	}
 
 	// Await for responses until timeout.
-	var responses []*http.Response
-	responseBytes := make([]byte, 2048)
+	responseBytes := make([]byte, c.maxMessageBytes+1)
 	for {
-		// 2048 bytes should be sufficient for most networks.
-		n, _, err := c.conn.ReadFrom(responseBytes)
+		n, remoteAddr, err := c.conn.ReadFrom(responseBytes)
 		if err != nil {
-			if err, ok := err.(net.Error); ok {
-				if err.Timeout() {
-					break
-				}
-				continue
+			if ctx.Err() != nil {
+				return contextError(ctx)
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil
 			}
-			return nil, err
+			return err
+		}
+		if n > c.maxMessageBytes {
+			c.logger.Debug("httpu: discarding oversized response", "from", remoteAddr, "max_bytes", c.maxMessageBytes)
+			continue
 		}
 		// Parse response.
-		response, err := http.ReadResponse(bufio.NewReader(bytes.NewBuffer(responseBytes[:n])), req)
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(responseBytes[:n])), reqs[0])
 		if err != nil {
-			log.Printf("httpu: error while parsing response: %v", err)
+			c.logger.Debug("httpu: error while parsing response", "from", remoteAddr, "error", err)
 			continue
 		}
+		response.Request = requestFor(reqs, response)
+
+		SetHeaderOrder(response.Header, headerOrder(responseBytes[:n]))
 
 		// Set the related local address used to discover the device.
 		if a, ok := c.conn.LocalAddr().(*net.UDPAddr); ok {
 			response.Header.Add(LocalAddressHeader, a.IP.String())
 		}
+		response.Header.Set(RemoteAddressHeader, remoteAddr.String())
 
-		responses = append(responses, response)
+		if err := fn(response); err != nil {
+			return err
+		}
+	}
+}
+
+// requestFor returns the request with the ST header of response, or the
+// first request.
+func requestFor(reqs []*http.Request, response *http.Response) *http.Request {
+	if st := searchTarget(response.Header); st != "" && len(reqs) > 1 {
+		for _, req := range reqs {
+			if searchTarget(req.Header) == st {
+				return req
+			}
+		}
+	}
+	return reqs[0]
+}
+
+// searchTarget returns the ST header of h, which may not be in canonical
+// form.
+func searchTarget(h http.Header) string {
+	for name, values := range h {
+		if strings.EqualFold(name, "ST") && len(values) > 0 {
+			return values[0]
+		}
 	}
+	return ""
+}
 
-	return responses, nil
+// contextError returns the error to report once ctx is done. Reaching the
+// deadline ends the response window normally.
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil
+	}
+	return ctx.Err()
 }
 
+// WriteRequest writes req in wire format. Headers received by Serve keep
+// their order and case; otherwise HOST, MAN, MX and ST come first, and names
+// are upper-cased.
 func WriteRequest(wr io.Writer, req *http.Request) error {
 	method := req.Method
 	if method == "" {
@@ -141,12 +339,17 @@ func WriteRequest(wr io.Writer, req *http.Request) error {
 		return err
 	}
 
-	for k, valList := range req.Header {
-		for _, v := range valList {
-			if _, err := fmt.Fprintf(wr, "%s: %s\r\n", strings.ToUpper(k), v); err != nil {
-				return err
-			}
+	header := req.Header
+	if req.Host != "" && header.Get("HOST") == "" && header.Get("Host") == "" {
+		// net/http moves HOST out of the headers of received requests.
+		header = header.Clone()
+		if header == nil {
+			header = make(http.Header)
 		}
+		header["HOST"] = []string{req.Host}
+	}
+	if err := writeHeader(wr, header, requestHeaderOrder); err != nil {
+		return err
 	}
 	if _, err := wr.Write([]byte{'\r', '\n'}); err != nil {
 		return err
@@ -154,23 +357,56 @@ func WriteRequest(wr io.Writer, req *http.Request) error {
 	return nil
 }
 
+// WriteResponse writes res in wire format, with headers ordered as by
+// WriteRequest. Annotations added by clients, such as LocalAddressHeader, are
+// left out.
 func WriteResponse(wr io.Writer, res *http.Response) error {
-	if _, err := fmt.Fprintf(wr, "HTTP/1.1 %s\r\n", res.Status); err != nil {
+	if _, err := fmt.Fprintf(wr, "HTTP/1.1 %s\r\n", statusLine(res)); err != nil {
 		return err
 	}
 
-	for k, valList := range res.Header {
-		if k == "X-Local-Address" {
-			continue
-		}
-		for _, v := range valList {
-			if _, err := fmt.Fprintf(wr, "%s: %s\r\n", strings.ToUpper(k), v); err != nil {
-				return err
-			}
-		}
+	if err := writeHeader(wr, res.Header, responseHeaderOrder); err != nil {
+		return err
 	}
 	if _, err := wr.Write([]byte{'\r', '\n'}); err != nil {
 		return err
 	}
 	return nil
 }
+
+// statusLine returns the status code and reason phrase of res. res.Status
+// usually includes the code, as set by net/http, but may not.
+func statusLine(res *http.Response) string {
+	code := res.StatusCode
+	reason := res.Status
+	if c, r, ok := strings.Cut(res.Status, " "); ok && len(c) == 3 && (code == 0 || c == strconv.Itoa(code)) {
+		if n, err := strconv.Atoi(c); err == nil {
+			code, reason = n, r
+		}
+	} else if len(res.Status) == 3 && (code == 0 || res.Status == strconv.Itoa(code)) {
+		if n, err := strconv.Atoi(res.Status); err == nil {
+			code, reason = n, ""
+		}
+	}
+	if code == 0 {
+		code = http.StatusOK
+	}
+	if reason == "" {
+		reason = http.StatusText(code)
+	}
+	return strconv.Itoa(code) + " " + reason
+}
+
+// isAnnotationHeader reports whether the header was added by a client to
+// describe how a response was received, rather than sent by the peer.
+func isAnnotationHeader(k string) bool {
+	switch http.CanonicalHeaderKey(k) {
+	case http.CanonicalHeaderKey(LocalAddressHeader),
+		http.CanonicalHeaderKey(RemoteAddressHeader),
+		http.CanonicalHeaderKey(HeaderOrderHeader),
+		http.CanonicalHeaderKey(InterfaceHeader),
+		http.CanonicalHeaderKey(InterfaceIndexHeader):
+		return true
+	}
+	return false
+}
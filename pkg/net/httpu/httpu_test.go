@@ -0,0 +1,144 @@
+package httpu
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+)
+
+// respondST answers every request received on conn with a response carrying
+// the same ST header.
+func respondST(t *testing.T, conn net.PacketConn) {
+	t.Helper()
+	go func() {
+		buf := make([]byte, maxDatagramBytes)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+			if err != nil {
+				continue
+			}
+			var response bytes.Buffer
+			_ = WriteResponse(&response, &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"ST": {req.Header.Get("ST")}},
+			})
+			_, _ = conn.WriteTo(response.Bytes(), addr)
+		}
+	}()
+}
+
+func searchRequest(host, st string) *http.Request {
+	return &http.Request{
+		Method: "M-SEARCH",
+		Host:   host,
+		URL:    &url.URL{Opaque: "*"},
+		Header: http.Header{"MAN": {`"ssdp:discover"`}, "MX": {"1"}, "ST": {st}},
+	}
+}
+
+func TestDoAllFuncSendsEveryRequest(t *testing.T) {
+	device, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	respondST(t, device)
+
+	c, err := NewClientAddr("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	host := device.LocalAddr().String()
+	reqs := []*http.Request{searchRequest(host, "a"), searchRequest(host, "b")}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var sts []string
+	err = c.DoAllFunc(ctx, reqs, 1, func(response *http.Response) error {
+		st := response.Header.Get("ST")
+		if got := searchTarget(response.Request.Header); got != st {
+			t.Errorf("response with ST %s refers to request for %s", st, got)
+		}
+		sts = append(sts, st)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DoAllFunc: %v", err)
+	}
+	sort.Strings(sts)
+	if len(sts) != 2 || sts[0] != "a" || sts[1] != "b" {
+		t.Errorf("responses for %v, want [a b]", sts)
+	}
+}
+
+// slowDeadlineConn delays the deadlines that unblock reads, like a context
+// callback running late.
+type slowDeadlineConn struct {
+	net.PacketConn
+	unblocking chan struct{}
+}
+
+func (c *slowDeadlineConn) SetDeadline(t time.Time) error {
+	if !t.After(time.Now()) {
+		select {
+		case <-c.unblocking:
+		default:
+			close(c.unblocking)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return c.PacketConn.SetDeadline(t)
+}
+
+func TestCancelDoesNotEndNextRequest(t *testing.T) {
+	device, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Close()
+	respondST(t, device)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	slow := &slowDeadlineConn{PacketConn: conn, unblocking: make(chan struct{})}
+	c := newClient(slow, nil)
+	host := device.LocalAddr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errStop := errors.New("stop")
+	err = c.DoFunc(ctx, searchRequest(host, "a"), 1, func(*http.Response) error {
+		cancel()
+		<-slow.unblocking
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("DoFunc = %v, want %v", err, errStop)
+	}
+
+	const timeout = 300 * time.Millisecond
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	if err := c.DoFunc(ctx, searchRequest(host, "b"), 1, func(*http.Response) error { return nil }); err != nil {
+		t.Fatalf("DoFunc: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout-20*time.Millisecond {
+		t.Errorf("request ended after %v, want its %v timeout", elapsed, timeout)
+	}
+}
@@ -2,89 +2,363 @@ package httpu
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
 
 	"github.com/home-sol/multicast-proxy/pkg/net/multicast"
-	"golang.org/x/sync/errgroup"
+	"github.com/home-sol/multicast-proxy/pkg/net/netwatch"
 )
 
-type multiClient struct {
-	delegates []Client
+// InterfaceHeader and InterfaceIndexHeader are set on responses received
+// through a MultiClient delegate created for an interface.
+const (
+	InterfaceHeader      = "X-interface"
+	InterfaceIndexHeader = "X-interface-index"
+)
+
+// Origin identifies where a response was received.
+type Origin struct {
+	// Interface and Index identify the receiving interface. They are only
+	// known for responses received through a MultiClient created for
+	// interfaces.
+	Interface string
+	Index     int
+	LocalAddr string
+}
+
+// ResponseOrigin returns where response was received.
+func ResponseOrigin(response *http.Response) Origin {
+	index, _ := strconv.Atoi(response.Header.Get(InterfaceIndexHeader))
+	return Origin{
+		Interface: response.Header.Get(InterfaceHeader),
+		Index:     index,
+		LocalAddr: response.Header.Get(LocalAddressHeader),
+	}
+}
+
+// DelegateError is the error of one delegate of a MultiClient.
+type DelegateError struct {
+	Interface string
+	Addr      string
+	Err       error
+}
+
+func (e *DelegateError) Error() string {
+	switch {
+	case e.Interface != "":
+		return fmt.Sprintf("httpu: client %s on %s: %v", e.Addr, e.Interface, e.Err)
+	case e.Addr != "":
+		return fmt.Sprintf("httpu: client %s: %v", e.Addr, e.Err)
+	default:
+		return fmt.Sprintf("httpu: client: %v", e.Err)
+	}
+}
+
+func (e *DelegateError) Unwrap() error {
+	return e.Err
+}
+
+type delegate struct {
+	client Client
+	intf   *net.Interface
+	addr   string
+}
+
+func (d *delegate) tag(response *http.Response) {
+	if d.intf == nil {
+		return
+	}
+	response.Header.Set(InterfaceHeader, d.intf.Name)
+	response.Header.Set(InterfaceIndexHeader, strconv.Itoa(d.intf.Index))
+}
+
+func (d *delegate) wrap(err error) error {
+	e := &DelegateError{Addr: d.addr, Err: err}
+	if d.intf != nil {
+		e.Interface = d.intf.Name
+	}
+	return e
+}
+
+// MultiClient sends requests through several delegate clients at once,
+// typically one per local address. Delegates can be added and removed while
+// requests are in progress.
+type MultiClient struct {
+	lock      sync.Mutex
+	delegates []*delegate
+	network   string
+	opts      []ClientOption
+	logger    *slog.Logger
 }
 
 // NewClientInterfaces creates a SSDP client that multiplexes to all multicast-capable
 // IPv4 addresses on the host. Returns a function to clean up once the client is
 // no longer required.
-func NewClientInterfaces(interfaceList []net.Interface) (Client, error) {
-	ipv4Addresses, err := multicast.Ipv4Address(interfaceList)
-	if err != nil {
+func NewClientInterfaces(interfaceList []net.Interface, opts ...ClientOption) (*MultiClient, error) {
+	return NewClientNetwork("udp4", interfaceList, opts...)
+}
 
-		return nil, fmt.Errorf("requesting host IPv4 addresses: %w", err)
+// NewClientNetwork creates a client that multiplexes to all multicast-capable
+// addresses of the given network, "udp4" or "udp6", on the interfaces. It
+// fails only if no address can be used.
+func NewClientNetwork(network string, interfaceList []net.Interface, opts ...ClientOption) (*MultiClient, error) {
+	if network != "udp4" && network != "udp6" {
+		return nil, fmt.Errorf("unsupported network %q", network)
 	}
 
-	delegates := make([]Client, 0, len(ipv4Addresses))
-	for _, addr := range ipv4Addresses {
-		c, err := NewClientAddr(addr)
-		if err != nil {
+	mc := &MultiClient{network: network, opts: opts, logger: optionsLogger(opts)}
+	var errs []error
+	for _, intf := range interfaceList {
+		if err := mc.AddInterface(intf); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(mc.delegates) == 0 {
+		if err := errors.Join(errs...); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no multicast-capable %s addresses on the interfaces", network)
+	}
+	if len(errs) > 0 {
+		// Usable without the failed addresses.
+		mc.logger.Warn("httpu: some addresses are unavailable", "network", network, "error", errors.Join(errs...))
+	}
+	return mc, nil
+}
 
-			return nil, fmt.Errorf("creating SSDP client for address %s: %w", addr, err)
+// NewMultiClient creates a client that multiplexes to the delegates. Responses
+// are not tagged with an interface, and interfaces cannot be added.
+func NewMultiClient(delegates []Client) *MultiClient {
+	mc := &MultiClient{logger: slog.Default()}
+	for _, c := range delegates {
+		mc.delegates = append(mc.delegates, &delegate{client: c})
+	}
+	return mc
+}
+
+func interfaceAddresses(network string, intf net.Interface) ([]string, error) {
+	if network == "udp6" {
+		return multicast.Ipv6Address([]net.Interface{intf})
+	}
+	return multicast.Ipv4Address([]net.Interface{intf})
+}
+
+// AddInterface adds delegates for the multicast-capable addresses of intf, or
+// refreshes them if the interface is already known: delegates for addresses
+// the interface no longer has are closed.
+func (mc *MultiClient) AddInterface(intf net.Interface) error {
+	if mc.network == "" {
+		return errors.New("httpu: client was not created for interfaces")
+	}
+	addresses, err := interfaceAddresses(mc.network, intf)
+	if err != nil {
+		return fmt.Errorf("requesting host %s addresses: %w", mc.network, err)
+	}
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	current := make(map[string]bool, len(addresses))
+	var errs []error
+	for _, addr := range addresses {
+		current[addr] = true
+		if mc.find(intf.Name, addr) >= 0 {
+			continue
+		}
+		c, err := NewClientAddr(addr, mc.opts...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("creating SSDP client for address %s: %w", addr, err))
+			continue
 		}
-		delegates = append(delegates, c)
+		intf := intf
+		mc.delegates = append(mc.delegates, &delegate{client: c, intf: &intf, addr: addr})
 	}
+	errs = append(errs, mc.remove(func(d *delegate) bool {
+		return d.intf != nil && d.intf.Name == intf.Name && !current[d.addr]
+	}))
+	return errors.Join(errs...)
+}
 
-	if len(delegates) == 1 {
-		return delegates[0], nil
+// RemoveInterface closes and removes the delegates of the named interface.
+func (mc *MultiClient) RemoveInterface(name string) error {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.remove(func(d *delegate) bool {
+		return d.intf != nil && d.intf.Name == name
+	})
+}
+
+// Watch keeps the delegates in line with the interfaces matching match as
+// they change, until ctx is cancelled.
+func (mc *MultiClient) Watch(ctx context.Context, w *netwatch.Watcher, match func(net.Interface) bool) {
+	events, unsubscribe := w.Subscribe(64)
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if !match(event.Interface) {
+				continue
+			}
+			var err error
+			switch event.Type {
+			case netwatch.InterfaceRemoved, netwatch.InterfaceDown:
+				err = mc.RemoveInterface(event.Interface.Name)
+			default:
+				err = mc.AddInterface(event.Interface)
+			}
+			if err != nil {
+				mc.logger.Warn("httpu: could not follow interface change", "interface", event.Interface.Name, "change", event.Type.String(), "error", err)
+			}
+		}
 	}
+}
 
-	return NewMultiClient(delegates), nil
+// Interfaces returns the names of the interfaces with delegates.
+func (mc *MultiClient) Interfaces() []string {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	var names []string
+	seen := make(map[string]bool)
+	for _, d := range mc.delegates {
+		if d.intf != nil && !seen[d.intf.Name] {
+			seen[d.intf.Name] = true
+			names = append(names, d.intf.Name)
+		}
+	}
+	return names
 }
 
-func NewMultiClient(delegates []Client) Client {
-	return &multiClient{delegates: delegates}
+// find returns the index of the delegate for addr on the named interface, or
+// -1. mc.lock must be held.
+func (mc *MultiClient) find(name, addr string) int {
+	for i, d := range mc.delegates {
+		if d.intf != nil && d.intf.Name == name && d.addr == addr {
+			return i
+		}
+	}
+	return -1
 }
 
-func (mc multiClient) Close() error {
+// remove closes and removes the delegates for which drop returns true.
+// mc.lock must be held.
+func (mc *MultiClient) remove(drop func(*delegate) bool) error {
+	var errs []error
+	kept := mc.delegates[:0]
 	for _, d := range mc.delegates {
-		if err := d.Close(); err != nil {
-			return err
+		if !drop(d) {
+			kept = append(kept, d)
+			continue
+		}
+		if err := d.client.Close(); err != nil {
+			errs = append(errs, d.wrap(err))
 		}
 	}
-	return nil
+	for i := len(kept); i < len(mc.delegates); i++ {
+		mc.delegates[i] = nil
+	}
+	mc.delegates = kept
+	return errors.Join(errs...)
 }
 
-func (mc multiClient) Do(ctx context.Context, req *http.Request, numSends int) ([]*http.Response, error) {
-	results := make(chan []*http.Response)
-	tasks, taskCtx := errgroup.WithContext(ctx)
-	tasks.Go(func() error {
-		defer close(results)
-		return mc.sendRequests(taskCtx, results, req, numSends)
-	})
+func (mc *MultiClient) contains(d *delegate) bool {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	for _, other := range mc.delegates {
+		if other == d {
+			return true
+		}
+	}
+	return false
+}
 
+// Close closes all delegates, returning their errors joined.
+func (mc *MultiClient) Close() error {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.remove(func(*delegate) bool { return true })
+}
+
+func (mc *MultiClient) Do(ctx context.Context, req *http.Request, numSends int) ([]*http.Response, error) {
 	var responses []*http.Response
-	tasks.Go(func() error {
-		for rs := range results {
-			responses = append(responses, rs...)
-		}
+	err := mc.DoFunc(ctx, req, numSends, func(response *http.Response) error {
+		responses = append(responses, response)
 		return nil
 	})
+	return responses, err
+}
 
-	return responses, tasks.Wait()
+// DoFunc sends the request through every delegate concurrently. Calls to fn
+// are serialized, and responses are tagged with the interface of the
+// delegate they were received through.
+//
+// A failing delegate does not stop the others: DoFunc returns the errors of
+// all failed delegates joined, each as a *DelegateError. An error returned by
+// fn stops all delegates and is returned as is.
+func (mc *MultiClient) DoFunc(ctx context.Context, req *http.Request, numSends int, fn ResponseFunc) error {
+	return mc.DoAllFunc(ctx, []*http.Request{req}, numSends, fn)
 }
 
-func (mc multiClient) sendRequests(ctx context.Context, results chan []*http.Response, req *http.Request, numSends int) error {
-	tasks, taskCtx := errgroup.WithContext(ctx)
-	for _, d := range mc.delegates {
-		d := d
-		tasks.Go(func() error {
-			responses, err := d.Do(taskCtx, req, numSends)
-			if err != nil {
-				return err
+// DoAllFunc sends the requests through every delegate concurrently, each
+// delegate sending all of them in one response window. Responses and errors
+// are handled like DoFunc.
+func (mc *MultiClient) DoAllFunc(ctx context.Context, reqs []*http.Request, numSends int, fn ResponseFunc) error {
+	mc.lock.Lock()
+	delegates := append([]*delegate(nil), mc.delegates...)
+	mc.lock.Unlock()
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		fnLock sync.Mutex
+		fnErr  error
+		wg     sync.WaitGroup
+		errs   = make([]error, len(delegates))
+	)
+	for i, d := range delegates {
+		i, d := i, d
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := d.client.DoAllFunc(ctx, reqs, numSends, func(response *http.Response) error {
+				d.tag(response)
+				fnLock.Lock()
+				defer fnLock.Unlock()
+				if fnErr != nil {
+					return fnErr
+				}
+				if err := fn(response); err != nil {
+					fnErr = err
+					cancel()
+					return err
+				}
+				return nil
+			})
+			if err == nil || errors.Is(err, context.Canceled) && ctx.Err() != nil {
+				return
 			}
-			results <- responses
-			return nil
-		})
+			if errors.Is(err, net.ErrClosed) && !mc.contains(d) {
+				// Removed while the request was in progress.
+				return
+			}
+			errs[i] = d.wrap(err)
+		}()
+	}
+	wg.Wait()
+
+	if fnErr != nil {
+		return fnErr
+	}
+	if err := contextError(parent); err != nil {
+		return err
 	}
-	return tasks.Wait()
+	return errors.Join(errs...)
 }
@@ -4,18 +4,26 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"regexp"
+	"runtime/debug"
 	"sync"
+	"time"
 
 	"golang.org/x/net/ipv4"
-	"golang.org/x/sync/errgroup"
 )
 
 const (
 	DefaultMaxMessageBytes = 2048
+	// DefaultMaxConcurrency is the default number of messages handled at once.
+	DefaultMaxConcurrency = 64
+	// DefaultShutdownTimeout is how long Serve waits for handlers to finish
+	// once its context is cancelled, by default.
+	DefaultShutdownTimeout = 5 * time.Second
 )
 
 var (
@@ -38,70 +46,223 @@ func (f HandlerFunc) ServeMessage(r *http.Request) ([]*http.Response, error) {
 	return f(r)
 }
 
-type server struct {
-	Handler         Handler
+// Ingress describes where a request was received. It is available from the
+// request context with IngressFromContext.
+type Ingress struct {
+	// Interface and Index identify the interface the request arrived on.
+	Interface string
+	Index     int
+	// Dst is the destination address of the request, e.g. the multicast
+	// group it was sent to.
+	Dst net.IP
+}
+
+type ingressKey struct{}
+
+// IngressFromContext returns where the request with context ctx was received,
+// if the listener reported it.
+func IngressFromContext(ctx context.Context) (Ingress, bool) {
+	ingress, ok := ctx.Value(ingressKey{}).(Ingress)
+	return ingress, ok
+}
+
+// interfaceNames caches interface names by index, since looking one up lists
+// all interfaces.
+type interfaceNames struct {
+	lock  sync.Mutex
+	names map[int]string
+}
+
+func (c *interfaceNames) name(index int) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if name, ok := c.names[index]; ok {
+		return name
+	}
+	intf, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return ""
+	}
+	if c.names == nil {
+		c.names = make(map[int]string)
+	}
+	c.names[index] = intf.Name
+	return intf.Name
+}
+
+// Server passes HTTPU messages received on a packet listener to a Handler.
+type Server struct {
+	Handler Handler
+	// MaxMessageBytes bounds the size of the messages read; longer ones are
+	// truncated. It defaults to DefaultMaxMessageBytes.
 	MaxMessageBytes int
+	// MaxConcurrency bounds the number of messages handled at once; reading
+	// pauses while all are busy. It defaults to DefaultMaxConcurrency.
+	MaxConcurrency int
+	// ShutdownTimeout bounds how long Serve waits for running handlers once
+	// its context is cancelled. It defaults to DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+	// Logger reports malformed messages and failing handlers. If nil,
+	// slog.Default() is used.
+	Logger *slog.Logger
 }
 
 // Serve messages received on the given packet listener to the given handler.
 func Serve(ctx context.Context, conn *ipv4.PacketConn, handler Handler) error {
-	srv := server{
+	srv := Server{
 		Handler:         handler,
 		MaxMessageBytes: DefaultMaxMessageBytes,
 	}
 	return srv.Serve(ctx, conn)
 }
 
-func (srv *server) Serve(ctx context.Context, conn *ipv4.PacketConn) error {
+// Serve passes the messages received on conn to the handler until ctx is
+// cancelled or reading fails. Either way it stops reading and waits up to
+// ShutdownTimeout for running handlers; on cancellation it then returns nil
+// unless some are still running. The caller remains responsible for closing
+// conn.
+func (srv *Server) Serve(ctx context.Context, conn *ipv4.PacketConn) error {
 	maxMessageBytes := DefaultMaxMessageBytes
-	if srv.MaxMessageBytes != 0 {
+	if srv.MaxMessageBytes > 0 {
 		maxMessageBytes = srv.MaxMessageBytes
 	}
+	maxConcurrency := DefaultMaxConcurrency
+	if srv.MaxConcurrency > 0 {
+		maxConcurrency = srv.MaxConcurrency
+	}
+	shutdownTimeout := DefaultShutdownTimeout
+	if srv.ShutdownTimeout > 0 {
+		shutdownTimeout = srv.ShutdownTimeout
+	}
+	logger := srv.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
 
+	// Ask for the ingress interface and destination of each message, to pass
+	// them to the handler and reply through the same interface.
+	if err := conn.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
+		logger.Debug("httpu: ingress interface unavailable", "error", err)
+	}
+
+	// Unblock ReadFrom as soon as the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	w := &worker{
+		srv:    srv,
+		conn:   conn,
+		logger: logger,
+		slots:  make(chan struct{}, maxConcurrency),
+	}
 	bufPool := &sync.Pool{
 		New: func() interface{} {
 			return make([]byte, maxMessageBytes)
 		},
 	}
-	tasks, _ := errgroup.WithContext(ctx)
-	defer tasks.Wait()
 	for {
 		buf := bufPool.Get().([]byte)
-		n, _, peerAddr, err := conn.ReadFrom(buf)
+		n, cm, peerAddr, err := conn.ReadFrom(buf)
 		if err != nil {
-			return err
+			if ctx.Err() != nil {
+				return w.drain(shutdownTimeout)
+			}
+			return errors.Join(err, w.drain(shutdownTimeout))
 		}
 
-		tasks.Go(func() error {
-			defer bufPool.Put(buf)
-			// At least one router's UPnP implementation has added a trailing space
-			// after "HTTP/1.1" - trim it.
-			reqBuf := trailingWhitespaceRx.ReplaceAllLiteral(buf[:n], crlf)
+		select {
+		case w.slots <- struct{}{}:
+		case <-ctx.Done():
+			return w.drain(shutdownTimeout)
+		}
+		w.running.Add(1)
+		go func() {
+			defer func() {
+				bufPool.Put(buf)
+				<-w.slots
+				w.running.Done()
+			}()
+			w.serve(ctx, buf[:n], cm, peerAddr)
+		}()
+	}
+}
 
-			req, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(reqBuf)))
-			if err != nil {
-				log.Printf("httpu: Failed to parse request: %v", err)
-				return err
-			}
-			req.RemoteAddr = peerAddr.String()
-			responses, err := srv.Handler.ServeMessage(req)
-			// No need to call req.Body.Close - underlying reader is bytes.Buffer.
-			if err != nil {
-				log.Printf("httpu: Failed to handle request: %v", err)
-				return nil
-			}
-			wr := bytes.Buffer{}
-			for _, resp := range responses {
-				wr.Reset()
-				if err := WriteResponse(&wr, resp); err != nil {
-					fmt.Printf("Error while encoding response: %v\n", err)
-				}
-				if _, err := conn.WriteTo(wr.Bytes(), nil, peerAddr); err != nil {
-					fmt.Printf("Error writing response: %v\n", err)
-					return nil
-				}
-			}
-			return nil
+// worker handles messages for Server.Serve.
+type worker struct {
+	srv     *Server
+	conn    *ipv4.PacketConn
+	logger  *slog.Logger
+	names   interfaceNames
+	slots   chan struct{}
+	running sync.WaitGroup
+}
+
+// drain waits up to timeout for running handlers.
+func (w *worker) drain(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		w.running.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("httpu: %d handlers still running after %v", len(w.slots), timeout)
+	}
+}
+
+// serve handles one message, recovering from a panicking handler.
+func (w *worker) serve(ctx context.Context, msg []byte, cm *ipv4.ControlMessage, peerAddr net.Addr) {
+	defer func() {
+		if p := recover(); p != nil {
+			w.logger.Error("httpu: handler panicked", "from", peerAddr, "panic", p, "stack", string(debug.Stack()))
+		}
+	}()
+
+	// At least one router's UPnP implementation has added a trailing space
+	// after "HTTP/1.1" - trim it.
+	reqBuf := trailingWhitespaceRx.ReplaceAllLiteral(msg, crlf)
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(reqBuf)))
+	if err != nil {
+		w.logger.Debug("httpu: failed to parse request", "from", peerAddr, "error", err)
+		return
+	}
+	req.RemoteAddr = peerAddr.String()
+	SetHeaderOrder(req.Header, headerOrder(reqBuf))
+	reqCtx := ctx
+	// Replies leave through the interface the request arrived on.
+	var replyCM *ipv4.ControlMessage
+	if cm != nil && cm.IfIndex != 0 {
+		reqCtx = context.WithValue(ctx, ingressKey{}, Ingress{
+			Interface: w.names.name(cm.IfIndex),
+			Index:     cm.IfIndex,
+			Dst:       cm.Dst,
 		})
+		replyCM = &ipv4.ControlMessage{IfIndex: cm.IfIndex}
+	}
+	req = req.WithContext(reqCtx)
+	responses, err := w.srv.Handler.ServeMessage(req)
+	// No need to call req.Body.Close - underlying reader is bytes.Buffer.
+	if err != nil {
+		w.logger.Warn("httpu: failed to handle request", "from", peerAddr, "error", err)
+		return
+	}
+	wr := bytes.Buffer{}
+	for _, resp := range responses {
+		wr.Reset()
+		if err := WriteResponse(&wr, resp); err != nil {
+			w.logger.Warn("httpu: failed to encode response", "error", err)
+			continue
+		}
+		if _, err := w.conn.WriteTo(wr.Bytes(), replyCM, peerAddr); err != nil {
+			w.logger.Warn("httpu: failed to write response", "to", peerAddr, "error", err)
+			return
+		}
 	}
 }
@@ -0,0 +1,210 @@
+package httpu
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+const searchMessage = "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: ssdp:all\r\n\r\n"
+
+// okHandler answers every request with an empty response.
+var okHandler = HandlerFunc(func(r *http.Request) ([]*http.Response, error) {
+	return []*http.Response{{StatusCode: http.StatusOK, Header: http.Header{}}}, nil
+})
+
+// serve runs srv on a loopback listener and returns its address and a
+// channel receiving the result of Serve. Serve is stopped when the test ends.
+func serve(t *testing.T, ctx context.Context, srv *Server) (string, <-chan error) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(ctx, ipv4.NewPacketConn(pc))
+	}()
+	return pc.LocalAddr().String(), done
+}
+
+// dial returns a connection sending to the server at addr.
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// exchange sends a search request on conn and returns the status of the
+// response.
+func exchange(t *testing.T, conn net.Conn) int {
+	t.Helper()
+	if _, err := conn.Write([]byte(searchMessage)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	return res.StatusCode
+}
+
+func TestServeIgnoresNonPositiveMaxMessageBytes(t *testing.T) {
+	addr, _ := serve(t, context.Background(), &Server{Handler: okHandler, MaxMessageBytes: -1})
+	if status := exchange(t, dial(t, addr)); status != http.StatusOK {
+		t.Errorf("status = %d", status)
+	}
+}
+
+// blockingHandler counts the requests it handles, reporting each on
+// started, and blocks them until release is closed.
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+	running atomic.Int32
+	peak    atomic.Int32
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{started: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (h *blockingHandler) ServeMessage(r *http.Request) ([]*http.Response, error) {
+	n := h.running.Add(1)
+	defer h.running.Add(-1)
+	for {
+		peak := h.peak.Load()
+		if n <= peak || h.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	h.started <- struct{}{}
+	<-h.release
+	return nil, nil
+}
+
+func waitResult(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return")
+		return nil
+	}
+}
+
+func TestServeCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, done := serve(t, ctx, &Server{Handler: okHandler})
+	if status := exchange(t, dial(t, addr)); status != http.StatusOK {
+		t.Errorf("status = %d", status)
+	}
+	cancel()
+	if err := waitResult(t, done); err != nil {
+		t.Errorf("Serve after cancellation = %v, want nil", err)
+	}
+}
+
+func TestServeDrainTimeout(t *testing.T) {
+	h := newBlockingHandler()
+	defer close(h.release)
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, done := serve(t, ctx, &Server{Handler: h, ShutdownTimeout: 50 * time.Millisecond})
+	if _, err := dial(t, addr).Write([]byte(searchMessage)); err != nil {
+		t.Fatal(err)
+	}
+	<-h.started
+	cancel()
+	if err := waitResult(t, done); err == nil {
+		t.Error("Serve with a handler still running = nil, want an error")
+	}
+}
+
+func TestServeReadErrorDrains(t *testing.T) {
+	h := newBlockingHandler()
+	defer close(h.release)
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		srv := &Server{Handler: h, ShutdownTimeout: 50 * time.Millisecond}
+		done <- srv.Serve(context.Background(), ipv4.NewPacketConn(pc))
+	}()
+	if _, err := dial(t, pc.LocalAddr().String()).Write([]byte(searchMessage)); err != nil {
+		t.Fatal(err)
+	}
+	<-h.started
+	_ = pc.Close()
+	if err := waitResult(t, done); err == nil {
+		t.Error("Serve after a read error = nil, want an error")
+	}
+}
+
+func TestServeMaxConcurrency(t *testing.T) {
+	h := newBlockingHandler()
+	addr, _ := serve(t, context.Background(), &Server{Handler: h, MaxConcurrency: 2})
+	conn := dial(t, addr)
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write([]byte(searchMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-h.started
+	<-h.started
+	select {
+	case <-h.started:
+		t.Error("a third handler started while two were running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(h.release)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-h.started:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d requests handled, want 5", 2+i)
+		}
+	}
+	if peak := h.peak.Load(); peak > 2 {
+		t.Errorf("%d handlers ran at once, want at most 2", peak)
+	}
+}
+
+func TestServeRecoversFromPanic(t *testing.T) {
+	var calls atomic.Int32
+	handler := HandlerFunc(func(r *http.Request) ([]*http.Response, error) {
+		if calls.Add(1) == 1 {
+			panic("handler bug")
+		}
+		return okHandler(r)
+	})
+	addr, done := serve(t, context.Background(), &Server{Handler: handler})
+	conn := dial(t, addr)
+	if _, err := conn.Write([]byte(searchMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if status := exchange(t, conn); status != http.StatusOK {
+		t.Errorf("status after a panic = %d", status)
+	}
+	select {
+	case err := <-done:
+		t.Errorf("Serve returned %v after a panic", err)
+	default:
+	}
+}
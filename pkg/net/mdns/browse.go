@@ -0,0 +1,566 @@
+package mdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ServicesType is the DNS-SD service type enumeration name. Browsing it finds
+// the service types announced on the network (RFC 6763, section 9).
+const ServicesType = "_services._dns-sd._udp.local"
+
+const (
+	// minQueryInterval and maxQueryInterval bound the interval between
+	// repeated browse queries, which doubles after each (RFC 6762, section
+	// 5.2).
+	minQueryInterval = time.Second
+	maxQueryInterval = time.Minute
+	// resolveInterval is the interval between queries for the SRV, TXT and
+	// address records of an instance, and maxResolveQueries their number.
+	resolveInterval   = time.Second
+	maxResolveQueries = 5
+	// maxQuestions bounds the number of questions sent in one message.
+	maxQuestions = 16
+)
+
+// EventType says how a browsed service changed.
+type EventType int
+
+const (
+	// ServiceAdded reports a service once its host, port and an address are
+	// known.
+	ServiceAdded EventType = iota
+	// ServiceUpdated reports a change of an added service.
+	ServiceUpdated
+	// ServiceRemoved reports a service that said goodbye or expired.
+	ServiceRemoved
+)
+
+func (t EventType) String() string {
+	switch t {
+	case ServiceAdded:
+		return "added"
+	case ServiceUpdated:
+		return "updated"
+	case ServiceRemoved:
+		return "removed"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Service is a DNS-SD service instance.
+type Service struct {
+	// Instance is the full instance name, e.g.
+	// "Living Room._airplay._tcp.local".
+	Instance string
+	// Type is the service type, e.g. "_airplay._tcp.local".
+	Type string
+	// Host and Port are the target of the SRV record.
+	Host string
+	Port uint16
+	// Text holds the TXT record strings, e.g. "model=AppleTV6,2".
+	Text  []string
+	Addrs []net.IP
+	// Interface is the name of the interface the service was seen on.
+	Interface string
+}
+
+// Resolved reports whether the host, port and an address of s are known.
+func (s Service) Resolved() bool {
+	return s.Host != "" && len(s.Addrs) > 0
+}
+
+func (s Service) equal(other Service) bool {
+	if s.Instance != other.Instance || s.Host != other.Host || s.Port != other.Port ||
+		len(s.Text) != len(other.Text) || len(s.Addrs) != len(other.Addrs) {
+		return false
+	}
+	for i := range s.Text {
+		if s.Text[i] != other.Text[i] {
+			return false
+		}
+	}
+	for i := range s.Addrs {
+		if !s.Addrs[i].Equal(other.Addrs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Event reports a change of a browsed service.
+type Event struct {
+	Type    EventType
+	Service Service
+}
+
+// Browse queries conn for instances of serviceType, e.g. "_ipp._tcp", and
+// resolves them. Browsing ServicesType browses every service type found.
+// Events are sent on the returned channel until ctx is cancelled or reading
+// fails; the channel is then closed and wait returns the error, if any.
+func Browse(ctx context.Context, conn *Conn, serviceType string) (events <-chan Event, wait func() error) {
+	b := newBrowser(conn)
+	serviceType = qualify(serviceType)
+	if strings.EqualFold(serviceType, ServicesType) {
+		b.all = true
+	}
+	b.types[strings.ToLower(serviceType)] = serviceType
+	return b.start(ctx, b.browseQuery)
+}
+
+// Resolve queries conn for the SRV, TXT and address records of instance, e.g.
+// "Living Room._airplay._tcp", until it is resolved or ctx is done.
+func Resolve(ctx context.Context, conn *Conn, instance string) (Service, error) {
+	browseCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	b := newBrowser(conn)
+	instance = qualify(instance)
+	b.resolving[strings.ToLower(instance)] = true
+	query := func() error {
+		return conn.Query(
+			layers.DNSQuestion{Name: []byte(instance), Type: layers.DNSTypeSRV, Class: layers.DNSClassIN},
+			layers.DNSQuestion{Name: []byte(instance), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN},
+		)
+	}
+	events, wait := b.start(browseCtx, query)
+	var found *Service
+	for event := range events {
+		if event.Type == ServiceAdded && found == nil {
+			found = &event.Service
+			cancel()
+		}
+	}
+	err := wait()
+	switch {
+	case found != nil:
+		return *found, nil
+	case err != nil:
+		return Service{}, err
+	default:
+		return Service{}, fmt.Errorf("resolving %s: %w", instance, ctx.Err())
+	}
+}
+
+// browser follows PTR records to SRV and TXT records and SRV records to
+// address records, per interface.
+type browser struct {
+	conn *Conn
+	// all browses the service types found by browsing ServicesType.
+	all bool
+	// types holds the browsed service types by lower-cased name.
+	types map[string]string
+	// resolving holds the lower-cased instance names resolved without a PTR
+	// record.
+	resolving map[string]bool
+	instances map[string]*instance
+	// hosts holds the expiry of addresses by interface and host name.
+	hosts map[string]map[string]hostAddr
+
+	events chan Event
+	now    func() time.Time
+}
+
+type instance struct {
+	service   Service
+	expiry    time.Time
+	hasSRV    bool
+	hasTXT    bool
+	announced *Service
+	// goodbye is set when the SRV or TXT record of the instance said
+	// goodbye, which removes it unless a new record follows.
+	goodbye   bool
+	queries   int
+	lastQuery time.Time
+}
+
+type hostAddr struct {
+	ip     net.IP
+	expiry time.Time
+}
+
+type received struct {
+	msg *layers.DNS
+	src Source
+}
+
+func newBrowser(conn *Conn) *browser {
+	return &browser{
+		conn:      conn,
+		types:     make(map[string]string),
+		resolving: make(map[string]bool),
+		instances: make(map[string]*instance),
+		hosts:     make(map[string]map[string]hostAddr),
+		events:    make(chan Event, 16),
+		now:       time.Now,
+	}
+}
+
+func (b *browser) start(ctx context.Context, query func() error) (<-chan Event, func() error) {
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		defer close(b.events)
+		err = b.run(ctx, query)
+	}()
+	return b.events, func() error {
+		<-done
+		return err
+	}
+}
+
+func (b *browser) run(ctx context.Context, query func() error) error {
+	// Unblock ReadMessage once run returns or the context is done, and let
+	// the connection be read again afterwards.
+	ctx, cancel := context.WithCancel(ctx)
+	conn := b.conn
+	context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	messages := make(chan received)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			msg, src, err := b.conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case messages <- received{msg, src}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		<-readErr
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	if err := query(); err != nil {
+		return err
+	}
+	interval := minQueryInterval
+	nextQuery := time.Now().Add(interval)
+
+	ticker := time.NewTicker(resolveInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErr:
+			// Let the deferred function see the error too.
+			readErr <- err
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		case r := <-messages:
+			if !r.msg.QR {
+				continue
+			}
+			b.handle(r.msg, r.src)
+		case now := <-ticker.C:
+			b.expireAddrs(now)
+			if now.After(nextQuery) {
+				if err := query(); err != nil && !errors.Is(err, net.ErrClosed) {
+					return err
+				}
+				interval = min(2*interval, maxQueryInterval)
+				nextQuery = now.Add(interval)
+			}
+		}
+		if err := b.followUp(); err != nil {
+			return err
+		}
+		if !b.announce(ctx) {
+			return nil
+		}
+	}
+}
+
+// browseQuery asks for the instances of every browsed service type.
+func (b *browser) browseQuery() error {
+	questions := make([]layers.DNSQuestion, 0, len(b.types))
+	for _, name := range b.types {
+		questions = append(questions, layers.DNSQuestion{Name: []byte(name), Type: layers.DNSTypePTR, Class: layers.DNSClassIN})
+	}
+	return b.query(questions)
+}
+
+func (b *browser) query(questions []layers.DNSQuestion) error {
+	for len(questions) > 0 {
+		n := min(len(questions), maxQuestions)
+		if err := b.conn.Query(questions[:n]...); err != nil {
+			return err
+		}
+		questions = questions[n:]
+	}
+	return nil
+}
+
+// handle updates the instances from the records of a response. PTR records
+// are handled first, so that the SRV and TXT records usually sent along find
+// their instance.
+func (b *browser) handle(msg *layers.DNS, src Source) {
+	records := append(append([]layers.DNSResourceRecord(nil), msg.Answers...), msg.Additionals...)
+	now := b.now()
+	var newTypes []layers.DNSQuestion
+	for _, rr := range records {
+		if rr.Type != layers.DNSTypePTR {
+			continue
+		}
+		name := strings.ToLower(trimDot(string(rr.Name)))
+		target := trimDot(string(rr.PTR))
+		switch {
+		case b.all && name == ServicesType:
+			key := strings.ToLower(target)
+			if _, ok := b.types[key]; !ok && rr.TTL > 0 {
+				b.types[key] = target
+				newTypes = append(newTypes, layers.DNSQuestion{Name: []byte(target), Type: layers.DNSTypePTR, Class: layers.DNSClassIN})
+			}
+		case b.types[name] != "":
+			key := instanceKey(src.Interface, target)
+			inst := b.instances[key]
+			if rr.TTL == 0 {
+				if inst != nil {
+					inst.expiry = now
+				}
+				continue
+			}
+			if inst == nil {
+				inst = &instance{service: Service{Instance: target, Type: b.types[name], Interface: src.Interface}}
+				b.instances[key] = inst
+			}
+			inst.expiry = now.Add(time.Duration(rr.TTL) * time.Second)
+		}
+	}
+	if len(newTypes) > 0 {
+		_ = b.query(newTypes)
+	}
+
+	for _, rr := range records {
+		name := trimDot(string(rr.Name))
+		switch rr.Type {
+		case layers.DNSTypeSRV:
+			inst := b.instance(src.Interface, name, rr.TTL, now)
+			if inst == nil {
+				continue
+			}
+			host, port := trimDot(string(rr.SRV.Name)), rr.SRV.Port
+			if rr.TTL == 0 {
+				if inst.hasSRV && strings.EqualFold(inst.service.Host, host) && inst.service.Port == port {
+					inst.goodbye = true
+				}
+				continue
+			}
+			inst.goodbye = false
+			if !inst.hasSRV {
+				// Start over for the addresses.
+				inst.queries = 0
+			}
+			inst.hasSRV = true
+			inst.service.Host = host
+			inst.service.Port = port
+		case layers.DNSTypeTXT:
+			inst := b.instance(src.Interface, name, rr.TTL, now)
+			if inst == nil {
+				continue
+			}
+			text := txtStrings(rr.TXTs)
+			if rr.TTL == 0 {
+				if inst.hasTXT && strings.Join(inst.service.Text, "\x00") == strings.Join(text, "\x00") {
+					inst.goodbye = true
+				}
+				continue
+			}
+			inst.goodbye = false
+			inst.hasTXT = true
+			inst.service.Text = text
+		case layers.DNSTypeA, layers.DNSTypeAAAA:
+			key := instanceKey(src.Interface, name)
+			addrs := b.hosts[key]
+			if rr.TTL == 0 {
+				delete(addrs, rr.IP.String())
+				if len(addrs) == 0 {
+					delete(b.hosts, key)
+				}
+				continue
+			}
+			if addrs == nil {
+				addrs = make(map[string]hostAddr)
+				b.hosts[key] = addrs
+			}
+			addrs[rr.IP.String()] = hostAddr{ip: rr.IP, expiry: now.Add(time.Duration(rr.TTL) * time.Second)}
+		}
+	}
+}
+
+// txtStrings returns the non-empty strings of a TXT record.
+func txtStrings(txts [][]byte) []string {
+	var text []string
+	for _, txt := range txts {
+		if len(txt) > 0 {
+			text = append(text, string(txt))
+		}
+	}
+	return text
+}
+
+// instance returns the instance an SRV or TXT record named name belongs to.
+// Instances being resolved are created by their SRV or TXT records, and
+// expire with them.
+func (b *browser) instance(iface, name string, ttl uint32, now time.Time) *instance {
+	key := instanceKey(iface, name)
+	inst := b.instances[key]
+	if !b.resolving[strings.ToLower(name)] {
+		return inst
+	}
+	if inst == nil {
+		serviceType := ""
+		if i := strings.Index(name, "._"); i >= 0 {
+			serviceType = name[i+1:]
+		}
+		inst = &instance{service: Service{Instance: name, Type: serviceType, Interface: iface}}
+		b.instances[key] = inst
+	}
+	inst.expiry = now.Add(time.Duration(ttl) * time.Second)
+	return inst
+}
+
+// followUp asks for the records missing to resolve instances.
+func (b *browser) followUp() error {
+	now := b.now()
+	var questions []layers.DNSQuestion
+	asked := make(map[string]bool)
+	ask := func(name string, t layers.DNSType) {
+		key := strings.ToLower(name) + "/" + t.String()
+		if !asked[key] {
+			asked[key] = true
+			questions = append(questions, layers.DNSQuestion{Name: []byte(name), Type: t, Class: layers.DNSClassIN})
+		}
+	}
+	for _, inst := range b.instances {
+		if inst.queries >= maxResolveQueries || now.Sub(inst.lastQuery) < resolveInterval {
+			continue
+		}
+		n := len(questions)
+		if !inst.hasSRV {
+			ask(inst.service.Instance, layers.DNSTypeSRV)
+		}
+		if !inst.hasTXT {
+			ask(inst.service.Instance, layers.DNSTypeTXT)
+		}
+		if inst.hasSRV && len(b.addrs(inst)) == 0 {
+			ask(inst.service.Host, layers.DNSTypeA)
+			ask(inst.service.Host, layers.DNSTypeAAAA)
+		}
+		if len(questions) > n {
+			inst.queries++
+			inst.lastQuery = now
+		}
+	}
+	if err := b.query(questions); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// addrs returns the known addresses of the host of inst, sorted.
+func (b *browser) addrs(inst *instance) []net.IP {
+	var ips []net.IP
+	for _, addr := range b.hosts[instanceKey(inst.service.Interface, inst.service.Host)] {
+		ips = append(ips, addr.ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return ips[i].String() < ips[j].String()
+	})
+	return ips
+}
+
+// expireAddrs drops the addresses whose records expired, and the hosts left
+// without any. Expired instances are dropped by announce.
+func (b *browser) expireAddrs(now time.Time) {
+	for host, addrs := range b.hosts {
+		for key, addr := range addrs {
+			if now.After(addr.expiry) {
+				delete(addrs, key)
+			}
+		}
+		if len(addrs) == 0 {
+			delete(b.hosts, host)
+		}
+	}
+}
+
+// announce sends the events for instances that were resolved, changed or
+// removed. It returns false if ctx is done.
+func (b *browser) announce(ctx context.Context) bool {
+	now := b.now()
+	keys := make([]string, 0, len(b.instances))
+	for key := range b.instances {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		inst := b.instances[key]
+		var event *Event
+		switch {
+		case inst.goodbye || !now.Before(inst.expiry):
+			delete(b.instances, key)
+			if inst.announced != nil {
+				event = &Event{Type: ServiceRemoved, Service: *inst.announced}
+			}
+		default:
+			service := inst.service
+			service.Text = append([]string(nil), service.Text...)
+			service.Addrs = b.addrs(inst)
+			switch {
+			case inst.announced == nil && service.Resolved():
+				event = &Event{Type: ServiceAdded, Service: service}
+			case inst.announced != nil && !inst.announced.equal(service):
+				event = &Event{Type: ServiceUpdated, Service: service}
+			}
+			if event != nil {
+				inst.announced = &service
+			}
+		}
+		if event == nil {
+			continue
+		}
+		select {
+		case b.events <- *event:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+func instanceKey(iface, name string) string {
+	return iface + "/" + strings.ToLower(name)
+}
+
+// qualify appends the ".local" domain to name unless it has it.
+func qualify(name string) string {
+	name = trimDot(name)
+	if !strings.HasSuffix(strings.ToLower(name), ".local") {
+		name += ".local"
+	}
+	return name
+}
+
+func trimDot(name string) string {
+	return strings.TrimSuffix(name, ".")
+}
@@ -0,0 +1,203 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+var eth0 = Source{Interface: "eth0"}
+
+func ptr(name, target string, ttl uint32) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypePTR, Class: layers.DNSClassIN, TTL: ttl, PTR: []byte(target)}
+}
+
+func srv(name, host string, port uint16, ttl uint32) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeSRV, Class: layers.DNSClassIN, TTL: ttl,
+		SRV: layers.DNSSRV{Name: []byte(host), Port: port}}
+}
+
+func txt(name string, ttl uint32, text ...string) layers.DNSResourceRecord {
+	rr := layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN, TTL: ttl}
+	for _, s := range text {
+		rr.TXTs = append(rr.TXTs, []byte(s))
+	}
+	return rr
+}
+
+func a(name, ip string, ttl uint32) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: ttl, IP: net.ParseIP(ip).To4()}
+}
+
+func response(records ...layers.DNSResourceRecord) *layers.DNS {
+	return &layers.DNS{QR: true, AA: true, Answers: records}
+}
+
+// newTestBrowser returns a browser of serviceType whose clock is at *now.
+func newTestBrowser(serviceType string, now *time.Time) *browser {
+	b := newBrowser(nil)
+	b.types[strings.ToLower(serviceType)] = serviceType
+	b.now = func() time.Time { return *now }
+	return b
+}
+
+// events announces the changes of b and returns the events sent, formatted.
+func events(t *testing.T, b *browser) []string {
+	t.Helper()
+	if !b.announce(context.Background()) {
+		t.Fatal("announce = false")
+	}
+	var got []string
+	for {
+		select {
+		case e := <-b.events:
+			s := e.Service
+			got = append(got, fmt.Sprintf("%s %s %s:%d %v %v", e.Type, s.Instance, s.Host, s.Port, s.Text, s.Addrs))
+		default:
+			return got
+		}
+	}
+}
+
+func expectEvents(t *testing.T, b *browser, want ...string) {
+	t.Helper()
+	if got := events(t, b); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+const (
+	ippType     = "_ipp._tcp.local"
+	ippInstance = "Printer._ipp._tcp.local"
+)
+
+func TestBrowseEvents(t *testing.T) {
+	now := time.Now()
+	b := newTestBrowser(ippType, &now)
+
+	b.handle(response(ptr(ippType, ippInstance, 4500), srv(ippInstance, "printer.local", 631, 120)), eth0)
+	expectEvents(t, b)
+
+	b.handle(response(txt(ippInstance, 4500, "rp=ipp/print"), a("printer.local", "192.168.1.50", 120)), eth0)
+	expectEvents(t, b, "added Printer._ipp._tcp.local printer.local:631 [rp=ipp/print] [192.168.1.50]")
+
+	b.handle(response(txt(ippInstance, 4500, "rp=ipp/print", "color=T")), eth0)
+	expectEvents(t, b, "updated Printer._ipp._tcp.local printer.local:631 [rp=ipp/print color=T] [192.168.1.50]")
+
+	// Refreshing the same records changes nothing.
+	b.handle(response(srv(ippInstance, "printer.local", 631, 120), a("printer.local", "192.168.1.50", 120)), eth0)
+	expectEvents(t, b)
+
+	b.handle(response(ptr(ippType, ippInstance, 0)), eth0)
+	expectEvents(t, b, "removed Printer._ipp._tcp.local printer.local:631 [rp=ipp/print color=T] [192.168.1.50]")
+	if len(b.instances) != 0 {
+		t.Errorf("%d instances left", len(b.instances))
+	}
+}
+
+func TestBrowseGoodbyes(t *testing.T) {
+	resolved := func(t *testing.T, now *time.Time) *browser {
+		b := newTestBrowser(ippType, now)
+		b.handle(response(ptr(ippType, ippInstance, 4500), srv(ippInstance, "printer.local", 631, 120),
+			txt(ippInstance, 4500, "rp=ipp/print"), a("printer.local", "192.168.1.50", 120)), eth0)
+		expectEvents(t, b, "added Printer._ipp._tcp.local printer.local:631 [rp=ipp/print] [192.168.1.50]")
+		return b
+	}
+	const removed = "removed Printer._ipp._tcp.local printer.local:631 [rp=ipp/print] [192.168.1.50]"
+
+	for _, tt := range []struct {
+		name    string
+		records []layers.DNSResourceRecord
+		want    []string
+	}{
+		{"SRV goodbye", []layers.DNSResourceRecord{srv(ippInstance, "printer.local", 631, 0)}, []string{removed}},
+		{"TXT goodbye", []layers.DNSResourceRecord{txt(ippInstance, 0, "rp=ipp/print")}, []string{removed}},
+		{"goodbye of an old SRV", []layers.DNSResourceRecord{srv(ippInstance, "old.local", 631, 0)}, nil},
+		{"goodbye of an old TXT", []layers.DNSResourceRecord{txt(ippInstance, 0, "rp=old")}, nil},
+		{"SRV goodbye and replacement", []layers.DNSResourceRecord{
+			srv(ippInstance, "printer.local", 631, 0), srv(ippInstance, "printer.local", 8631, 120),
+		}, []string{"updated Printer._ipp._tcp.local printer.local:8631 [rp=ipp/print] [192.168.1.50]"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			b := resolved(t, &now)
+			b.handle(response(tt.records...), eth0)
+			expectEvents(t, b, tt.want...)
+		})
+	}
+}
+
+func TestBrowseExpiry(t *testing.T) {
+	now := time.Now()
+	b := newTestBrowser(ippType, &now)
+	b.handle(response(ptr(ippType, ippInstance, 60), srv(ippInstance, "printer.local", 631, 120),
+		txt(ippInstance, 4500), a("printer.local", "192.168.1.50", 120)), eth0)
+	expectEvents(t, b, "added Printer._ipp._tcp.local printer.local:631 [] [192.168.1.50]")
+
+	now = now.Add(61 * time.Second)
+	expectEvents(t, b, "removed Printer._ipp._tcp.local printer.local:631 [] [192.168.1.50]")
+}
+
+func TestBrowseHosts(t *testing.T) {
+	now := time.Now()
+	b := newTestBrowser(ippType, &now)
+	b.handle(response(a("printer.local", "192.168.1.50", 120), a("scanner.local", "192.168.1.51", 10)), eth0)
+	if len(b.hosts) != 2 {
+		t.Fatalf("%d hosts, want 2", len(b.hosts))
+	}
+
+	b.handle(response(a("printer.local", "192.168.1.50", 0)), eth0)
+	if _, ok := b.hosts[instanceKey("eth0", "printer.local")]; ok {
+		t.Error("host kept after the goodbye of its last address")
+	}
+	b.expireAddrs(now.Add(11 * time.Second))
+	if len(b.hosts) != 0 {
+		t.Errorf("%d hosts kept after their addresses expired", len(b.hosts))
+	}
+	b.handle(response(a("other.local", "192.168.1.52", 0)), eth0)
+	if len(b.hosts) != 0 {
+		t.Errorf("goodbye of an unknown host added %d hosts", len(b.hosts))
+	}
+}
+
+func TestBrowseInterfaces(t *testing.T) {
+	now := time.Now()
+	b := newTestBrowser(ippType, &now)
+	records := response(ptr(ippType, ippInstance, 4500), srv(ippInstance, "printer.local", 631, 120),
+		txt(ippInstance, 4500), a("printer.local", "192.168.1.50", 120))
+	b.handle(records, eth0)
+	b.handle(response(ptr(ippType, ippInstance, 4500), srv(ippInstance, "printer.local", 631, 120)), Source{Interface: "wlan0"})
+	// The instance on wlan0 has no address there.
+	expectEvents(t, b, "added Printer._ipp._tcp.local printer.local:631 [] [192.168.1.50]")
+
+	b.handle(response(srv(ippInstance, "printer.local", 631, 0)), Source{Interface: "wlan0"})
+	expectEvents(t, b)
+	if len(b.instances) != 1 {
+		t.Errorf("%d instances, want the one on eth0", len(b.instances))
+	}
+}
+
+func TestResolveCreatesInstances(t *testing.T) {
+	now := time.Now()
+	b := newBrowser(nil)
+	b.now = func() time.Time { return now }
+	b.resolving[strings.ToLower(ippInstance)] = true
+
+	b.handle(response(srv(ippInstance, "printer.local", 631, 120), a("printer.local", "192.168.1.50", 120)), eth0)
+	expectEvents(t, b, "added Printer._ipp._tcp.local printer.local:631 [] [192.168.1.50]")
+	if typ := b.instances[instanceKey("eth0", ippInstance)].service.Type; typ != ippType {
+		t.Errorf("type = %q, want %q", typ, ippType)
+	}
+	b.handle(response(srv("Other._ipp._tcp.local", "other.local", 631, 120)), eth0)
+	if len(b.instances) != 1 {
+		t.Errorf("%d instances, want only the resolved one", len(b.instances))
+	}
+
+	b.handle(response(srv(ippInstance, "printer.local", 631, 0)), eth0)
+	expectEvents(t, b, "removed Printer._ipp._tcp.local printer.local:631 [] [192.168.1.50]")
+}
@@ -0,0 +1,217 @@
+package mdns
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/home-sol/multicast-proxy/pkg/net/multicast"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// Port is the mDNS port.
+	Port = 5353
+	// IPv4Group and IPv6Group are the mDNS multicast groups.
+	IPv4Group = "224.0.0.251"
+	IPv6Group = "ff02::fb"
+
+	// maxMessageBytes bounds the size of received messages; mDNS messages
+	// may exceed the Ethernet MTU through fragmentation (RFC 6762, section 17).
+	maxMessageBytes = 9000
+)
+
+// Source describes where a message was received from.
+type Source struct {
+	Addr *net.UDPAddr
+	// Dst is the destination address, the group for multicast messages.
+	Dst net.IP
+	// Interface is the name of the interface the message arrived on, if
+	// known.
+	Interface string
+}
+
+// Conn sends mDNS queries and receives mDNS messages on a set of interfaces,
+// over either IPv4 or IPv6. It shares port 5353 with other responders such as
+// avahi, so responses to its queries are multicast and seen by everyone.
+type Conn struct {
+	// Exactly one of v4 and v6 is set.
+	v4         *ipv4.PacketConn
+	v6         *ipv6.PacketConn
+	group      *net.UDPAddr
+	interfaces []net.Interface
+
+	lock  sync.Mutex
+	names map[int]string
+}
+
+// Listen joins the IPv4 mDNS group on ifaces.
+func Listen(ifaces []net.Interface, opts ...multicast.Option) (*Conn, error) {
+	group := &net.UDPAddr{IP: net.ParseIP(IPv4Group), Port: Port}
+	conn, err := multicast.Listen(group, group, ifaces, listenOptions(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{v4: conn, group: group, interfaces: multicastInterfaces(ifaces)}, nil
+}
+
+// ListenIPv6 joins the IPv6 mDNS group on ifaces.
+func ListenIPv6(ifaces []net.Interface, opts ...multicast.Option) (*Conn, error) {
+	group := &net.UDPAddr{IP: net.ParseIP(IPv6Group), Port: Port}
+	conn, err := multicast.ListenIPv6(group, group, ifaces, listenOptions(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{v6: conn, group: group, interfaces: multicastInterfaces(ifaces)}, nil
+}
+
+// listenOptions prepends the options mDNS needs to opts: sharing the port,
+// a TTL of 255 (RFC 6762, section 11) and the ingress of each message.
+func listenOptions(opts []multicast.Option) []multicast.Option {
+	return append([]multicast.Option{
+		multicast.WithReuseAddr(),
+		multicast.WithReusePort(),
+		multicast.WithTTL(255),
+		multicast.WithControlMessages(ipv4.FlagDst | ipv4.FlagInterface),
+	}, opts...)
+}
+
+func multicastInterfaces(ifaces []net.Interface) []net.Interface {
+	var multicastIfaces []net.Interface
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagMulticast != 0 && ifi.Flags&net.FlagUp != 0 {
+			multicastIfaces = append(multicastIfaces, ifi)
+		}
+	}
+	return multicastIfaces
+}
+
+// GroupConn returns the underlying connection, e.g. for multicast.Rejoin.
+func (c *Conn) GroupConn() multicast.GroupConn {
+	if c.v6 != nil {
+		return c.v6
+	}
+	return c.v4
+}
+
+// SetReadDeadline sets the deadline of ReadMessage.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if c.v6 != nil {
+		return c.v6.SetReadDeadline(t)
+	}
+	return c.v4.SetReadDeadline(t)
+}
+
+// Group returns the multicast group joined.
+func (c *Conn) Group() *net.UDPAddr {
+	return c.group
+}
+
+// Close leaves the group and closes the connection.
+func (c *Conn) Close() error {
+	if c.v6 != nil {
+		return c.v6.Close()
+	}
+	return c.v4.Close()
+}
+
+// Query sends questions to the group on every interface. It fails only if
+// they could not be sent on any interface.
+func (c *Conn) Query(questions ...layers.DNSQuestion) error {
+	msg := &layers.DNS{Questions: questions, QDCount: uint16(len(questions))}
+	buf := gopacket.NewSerializeBuffer()
+	if err := msg.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return err
+	}
+
+	var lastErr error
+	sent := 0
+	for _, ifi := range c.interfaces {
+		var err error
+		if c.v6 != nil {
+			_, err = c.v6.WriteTo(buf.Bytes(), &ipv6.ControlMessage{IfIndex: ifi.Index, HopLimit: 255}, c.group)
+		} else {
+			_, err = c.v4.WriteTo(buf.Bytes(), &ipv4.ControlMessage{IfIndex: ifi.Index}, c.group)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", ifi.Name, err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 && lastErr != nil {
+		return lastErr
+	}
+	return nil
+}
+
+// ReadMessage reads the next mDNS message. Datagrams that are not DNS
+// messages are skipped.
+func (c *Conn) ReadMessage() (*layers.DNS, Source, error) {
+	buf := make([]byte, maxMessageBytes)
+	for {
+		n, src, err := c.readFrom(buf)
+		if err != nil {
+			return nil, Source{}, err
+		}
+		msg := &layers.DNS{}
+		if err := msg.DecodeFromBytes(buf[:n], gopacket.NilDecodeFeedback); err != nil {
+			continue
+		}
+		return msg, src, nil
+	}
+}
+
+func (c *Conn) readFrom(buf []byte) (int, Source, error) {
+	var (
+		n       int
+		addr    net.Addr
+		ifIndex int
+		src     Source
+		err     error
+	)
+	if c.v6 != nil {
+		var cm *ipv6.ControlMessage
+		n, cm, addr, err = c.v6.ReadFrom(buf)
+		if cm != nil {
+			ifIndex, src.Dst = cm.IfIndex, cm.Dst
+		}
+	} else {
+		var cm *ipv4.ControlMessage
+		n, cm, addr, err = c.v4.ReadFrom(buf)
+		if cm != nil {
+			ifIndex, src.Dst = cm.IfIndex, cm.Dst
+		}
+	}
+	if err != nil {
+		return 0, Source{}, err
+	}
+	src.Addr, _ = addr.(*net.UDPAddr)
+	if ifIndex != 0 {
+		src.Interface = c.interfaceName(ifIndex)
+	}
+	return n, src, nil
+}
+
+// interfaceName returns the name of the interface with the given index,
+// caching it since looking one up lists all interfaces.
+func (c *Conn) interfaceName(index int) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if name, ok := c.names[index]; ok {
+		return name
+	}
+	ifi, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return ""
+	}
+	if c.names == nil {
+		c.names = make(map[int]string)
+	}
+	c.names[index] = ifi.Name
+	return ifi.Name
+}
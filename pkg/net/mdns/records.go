@@ -0,0 +1,24 @@
+package mdns
+
+import "github.com/google/gopacket/layers"
+
+// classTopBit is the top bit of the class of a question or record, which
+// mDNS reuses: in a question it asks for a unicast response (RFC 6762,
+// section 5.4), in a record it flushes the cached records of the same name
+// and type (section 10.2).
+const classTopBit = 0x8000
+
+// UnicastResponse reports whether q asks for a unicast response, the QU bit.
+func UnicastResponse(q layers.DNSQuestion) bool {
+	return q.Class&classTopBit != 0
+}
+
+// CacheFlush reports whether rr has the cache-flush bit set.
+func CacheFlush(rr layers.DNSResourceRecord) bool {
+	return rr.Class&classTopBit != 0
+}
+
+// Class returns the class of a question or record without the top bit.
+func Class(class layers.DNSClass) layers.DNSClass {
+	return class &^ classTopBit
+}
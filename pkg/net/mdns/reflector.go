@@ -2,7 +2,7 @@ package mdns
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"time"
 
@@ -10,7 +10,13 @@ import (
 	"github.com/google/gopacket/pcap"
 )
 
-func Reflector(intfName string, poolsMap map[uint16][]uint16, deviceToVLanTags map[string][]uint16) error {
+// Reflector copies the mDNS packets captured on intfName between VLANs. It
+// logs to logger, or to slog.Default() if nil.
+func Reflector(intfName string, poolsMap map[uint16][]uint16, deviceToVLanTags map[string][]uint16, logger *slog.Logger) error {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
 	// Get a handle on the network interface
 	rawTraffic, err := pcap.OpenLive(intfName, 65536, true, time.Second)
 	if err != nil {
@@ -29,7 +35,7 @@ func Reflector(intfName string, poolsMap map[uint16][]uint16, deviceToVLanTags m
 	filterTemplate := "not (ether src %s) and vlan and dst net (224.0.0.251 or ff02::fb) and udp dst port 5353"
 	err = rawTraffic.SetBPFFilter(fmt.Sprintf(filterTemplate, intfMACAddress))
 	if err != nil {
-		log.Fatalf("Could not apply filter on network interface: %v", err)
+		return fmt.Errorf("could not apply filter on network interface %s: %w", intfName, err)
 	}
 
 	// Get a channel of Bonjour packets to process
@@ -39,7 +45,7 @@ func Reflector(intfName string, poolsMap map[uint16][]uint16, deviceToVLanTags m
 
 	// Process Bonjours packets
 	for bonjourPacket := range bonjourPackets {
-		fmt.Println(bonjourPacket.packet.String())
+		logger.Debug("Captured mDNS packet", "packet", bonjourPacket.packet)
 		var vlanTags []uint16
 		var hasVlanMapping bool
 		// Forward the mDNS query or response to appropriate VLANs
@@ -54,7 +60,7 @@ func Reflector(intfName string, poolsMap map[uint16][]uint16, deviceToVLanTags m
 		}
 		for _, tag := range vlanTags {
 			if err := sendBonjourPacket(rawTraffic, &bonjourPacket, tag, intfMACAddress); err != nil {
-				log.Printf("Could not send packet to VLAN %d: %v", tag, err)
+				logger.Warn("Could not send packet", "vlan", tag, "error", err)
 			}
 		}
 	}
@@ -35,3 +35,36 @@ func Ipv4Address(intfs []net.Interface) ([]string, error) {
 	}
 	return addrs, nil
 }
+
+// Ipv6Address returns the IPv6 addresses of the interfaces that support
+// multicast. Link-local addresses carry their zone, e.g. "fe80::1%eth0".
+func Ipv6Address(intfs []net.Interface) ([]string, error) {
+	var addrs []string
+	for _, intf := range intfs {
+		if intf.Flags&net.FlagMulticast == 0 || intf.Flags&net.FlagLoopback != 0 || intf.Flags&net.FlagUp == 0 {
+			// Does not support multicast or is a loopback address.
+			continue
+		}
+		ifaceAddrs, err := intf.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("finding addresses on interface %s: %w", intf.Name, err)
+		}
+		for _, netAddr := range ifaceAddrs {
+			addr, ok := netAddr.(*net.IPNet)
+			if !ok {
+				// Not an IPNet address.
+				continue
+			}
+			if addr.IP.To4() != nil {
+				// Not IPv6.
+				continue
+			}
+			if addr.IP.IsLinkLocalUnicast() {
+				addrs = append(addrs, addr.IP.String()+"%"+intf.Name)
+				continue
+			}
+			addrs = append(addrs, addr.IP.String())
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,85 @@
+package multicast
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ListenIPv6 is Listen for IPv6 groups such as ff02::fb. The TTL set with
+// WithTTL is used as the hop limit.
+func ListenIPv6(lAddr *net.UDPAddr, rAddr *net.UDPAddr, ifList []net.Interface, opts ...Option) (*ipv6.PacketConn, error) {
+	o := newOptions(opts)
+
+	conn, err := listenUDP("udp6", lAddr, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	pconn, err := joinGroupIPv6(conn, ifList, rAddr, &o)
+	if err != nil {
+		if err := conn.Close(); err != nil {
+			o.logger.Warn("Failed to close UDP connection", "error", err)
+		}
+		return nil, err
+	}
+
+	return pconn, nil
+}
+
+func joinGroupIPv6(conn *net.UDPConn, iflist []net.Interface, gaddr net.Addr, o *options) (*ipv6.PacketConn, error) {
+	wrap := ipv6.NewPacketConn(conn)
+	err := wrap.SetMulticastLoopback(o.loopback)
+	if err != nil {
+		return nil, err
+	}
+	if o.ttl > 0 {
+		if err := wrap.SetMulticastHopLimit(o.ttl); err != nil {
+			return nil, err
+		}
+	}
+	if o.outbound != nil {
+		if err := wrap.SetMulticastInterface(o.outbound); err != nil {
+			return nil, err
+		}
+	}
+	if flags := ipv6ControlFlags(o.controlFlags); flags != 0 {
+		if err := wrap.SetControlMessage(flags, true); err != nil {
+			return nil, err
+		}
+	}
+	// add interfaces to multicast group.
+	joined := 0
+	for _, ifi := range iflist {
+		if err := join(wrap, &ifi, gaddr, o); err != nil {
+			o.logger.Warn("Failed to join multicast group", "group", gaddr.String(), "interface", ifi.Name, "error", err)
+			continue
+		}
+		joined++
+		o.logger.Info("Joined multicast group", "group", gaddr.String(), "interface", ifi.Name, "index", ifi.Index)
+	}
+	if joined == 0 {
+		return nil, errors.New("no interfaces had joined to group")
+	}
+	return wrap, nil
+}
+
+// ipv6ControlFlags returns the IPv6 equivalent of IPv4 control flags.
+func ipv6ControlFlags(flags ipv4.ControlFlags) ipv6.ControlFlags {
+	var f ipv6.ControlFlags
+	if flags&ipv4.FlagTTL != 0 {
+		f |= ipv6.FlagHopLimit
+	}
+	if flags&ipv4.FlagSrc != 0 {
+		f |= ipv6.FlagSrc
+	}
+	if flags&ipv4.FlagDst != 0 {
+		f |= ipv6.FlagDst
+	}
+	if flags&ipv4.FlagInterface != 0 {
+		f |= ipv6.FlagInterface
+	}
+	return f
+}
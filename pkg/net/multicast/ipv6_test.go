@@ -0,0 +1,71 @@
+package multicast
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestIPv6ControlFlags(t *testing.T) {
+	for _, tt := range []struct {
+		flags ipv4.ControlFlags
+		want  ipv6.ControlFlags
+	}{
+		{0, 0},
+		{ipv4.FlagTTL, ipv6.FlagHopLimit},
+		{ipv4.FlagSrc, ipv6.FlagSrc},
+		{ipv4.FlagDst, ipv6.FlagDst},
+		{ipv4.FlagInterface, ipv6.FlagInterface},
+		{ipv4.FlagDst | ipv4.FlagInterface, ipv6.FlagDst | ipv6.FlagInterface},
+		{ipv4.FlagTTL | ipv4.FlagSrc | ipv4.FlagDst | ipv4.FlagInterface, ipv6.FlagHopLimit | ipv6.FlagSrc | ipv6.FlagDst | ipv6.FlagInterface},
+	} {
+		if got := ipv6ControlFlags(tt.flags); got != tt.want {
+			t.Errorf("ipv6ControlFlags(%v) = %v, want %v", tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestListenIPv6(t *testing.T) {
+	// Messages sent to the group come back through multicast loopback.
+	var ifi *net.Interface
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ifaces {
+		if ifaces[i].Flags&(net.FlagUp|net.FlagMulticast) == net.FlagUp|net.FlagMulticast {
+			ifi = &ifaces[i]
+			break
+		}
+	}
+	if ifi == nil {
+		t.Skip("no multicast interface")
+	}
+	group := &net.UDPAddr{IP: net.ParseIP("ff02::114")}
+	conn, err := ListenIPv6(&net.UDPAddr{IP: net.IPv6unspecified}, group, []net.Interface{*ifi},
+		WithLoopback(true), WithOutboundInterface(ifi), WithControlMessages(ipv4.FlagDst|ipv4.FlagInterface))
+	if err != nil {
+		t.Skipf("IPv6 multicast unavailable: %v", err)
+	}
+	defer conn.Close()
+
+	dst := &net.UDPAddr{IP: group.IP, Port: conn.LocalAddr().(*net.UDPAddr).Port, Zone: ifi.Name}
+	if _, err := conn.WriteTo([]byte("ping"), nil, dst); err != nil {
+		t.Skipf("sending to the group: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	n, cm, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("received %q", buf[:n])
+	}
+	if cm == nil || !cm.Dst.Equal(group.IP) || cm.IfIndex != ifi.Index {
+		t.Errorf("control message %v, want destination %v on interface %d", cm, group.IP, ifi.Index)
+	}
+}
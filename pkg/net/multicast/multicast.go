@@ -1,24 +1,125 @@
 package multicast
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
-	"os"
+	"syscall"
 
 	"golang.org/x/net/ipv4"
 )
 
-func Listen(lAddr *net.UDPAddr, rAddr *net.UDPAddr, ifList []net.Interface) (*ipv4.PacketConn, error) {
-	conn, err := net.ListenUDP("udp4", lAddr)
+// Option configures Listen.
+type Option func(*options)
+
+type options struct {
+	logger       *slog.Logger
+	loopback     bool
+	ttl          int
+	outbound     *net.Interface
+	reuseAddr    bool
+	reusePort    bool
+	readBuffer   int
+	controlFlags ipv4.ControlFlags
+	sources      []net.IP
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		logger:   slog.Default(),
+		loopback: true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger sets the logger used to report group membership.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithLoopback sets whether packets sent to the group are looped back to
+// the host. It defaults to true.
+func WithLoopback(on bool) Option {
+	return func(o *options) {
+		o.loopback = on
+	}
+}
+
+// WithTTL sets the TTL of packets sent to the group. The system default,
+// usually 1, is kept otherwise.
+func WithTTL(ttl int) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// WithOutboundInterface sets the interface packets sent to the group leave
+// through. The system chooses it from the routing table otherwise.
+func WithOutboundInterface(ifi *net.Interface) Option {
+	return func(o *options) {
+		o.outbound = ifi
+	}
+}
+
+// WithReuseAddr sets SO_REUSEADDR, so that other processes such as avahi or
+// minissdpd can listen on the same port. The net package already sets it
+// when lAddr is a multicast address.
+func WithReuseAddr() Option {
+	return func(o *options) {
+		o.reuseAddr = true
+	}
+}
+
+// WithReusePort sets SO_REUSEPORT where the platform supports it.
+func WithReusePort() Option {
+	return func(o *options) {
+		o.reusePort = true
+	}
+}
+
+// WithReadBuffer sets the size of the socket receive buffer in bytes.
+func WithReadBuffer(bytes int) Option {
+	return func(o *options) {
+		o.readBuffer = bytes
+	}
+}
+
+// WithControlMessages enables the control messages received with each
+// packet, e.g. ipv4.FlagDst|ipv4.FlagInterface for the destination address
+// and the ingress interface. ListenIPv6 enables the equivalent IPv6 flags.
+func WithControlMessages(flags ipv4.ControlFlags) Option {
+	return func(o *options) {
+		o.controlFlags = flags
+	}
+}
+
+// WithSources makes the group source-specific: it is joined for packets sent
+// by the sources only.
+func WithSources(sources ...net.IP) Option {
+	return func(o *options) {
+		o.sources = sources
+	}
+}
+
+func Listen(lAddr *net.UDPAddr, rAddr *net.UDPAddr, ifList []net.Interface, opts ...Option) (*ipv4.PacketConn, error) {
+	o := newOptions(opts)
+
+	conn, err := listenUDP("udp4", lAddr, &o)
 	if err != nil {
 		return nil, err
 	}
 
-	pconn, err := joinGroupIPv4(conn, ifList, rAddr)
+	pconn, err := joinGroupIPv4(conn, ifList, rAddr, &o)
 	if err != nil {
 		if err := conn.Close(); err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "failed to close UDP connection: %s\n", err)
+			o.logger.Warn("Failed to close UDP connection", "error", err)
 		}
 		return nil, err
 	}
@@ -26,24 +127,111 @@ func Listen(lAddr *net.UDPAddr, rAddr *net.UDPAddr, ifList []net.Interface) (*ip
 	return pconn, nil
 }
 
-func joinGroupIPv4(conn *net.UDPConn, iflist []net.Interface, gaddr net.Addr) (*ipv4.PacketConn, error) {
+func listenUDP(network string, lAddr *net.UDPAddr, o *options) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if o.reuseAddr {
+					if sockErr = setReuseAddr(fd); sockErr != nil {
+						return
+					}
+				}
+				if o.reusePort {
+					sockErr = setReusePort(fd)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	address := ""
+	if lAddr != nil {
+		address = lAddr.String()
+	}
+	pc, err := lc.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+	if o.readBuffer > 0 {
+		if err := conn.SetReadBuffer(o.readBuffer); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("setting receive buffer: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func joinGroupIPv4(conn *net.UDPConn, iflist []net.Interface, gaddr net.Addr, o *options) (*ipv4.PacketConn, error) {
 	wrap := ipv4.NewPacketConn(conn)
-	err := wrap.SetMulticastLoopback(true)
+	err := wrap.SetMulticastLoopback(o.loopback)
 	if err != nil {
 		return nil, err
 	}
+	if o.ttl > 0 {
+		if err := wrap.SetMulticastTTL(o.ttl); err != nil {
+			return nil, err
+		}
+	}
+	if o.outbound != nil {
+		if err := wrap.SetMulticastInterface(o.outbound); err != nil {
+			return nil, err
+		}
+	}
+	if o.controlFlags != 0 {
+		if err := wrap.SetControlMessage(o.controlFlags, true); err != nil {
+			return nil, err
+		}
+	}
 	// add interfaces to multicast group.
 	joined := 0
 	for _, ifi := range iflist {
-		if err := wrap.JoinGroup(&ifi, gaddr); err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "failed to join group %s on %s: %s\n", gaddr.String(), ifi.Name, err)
+		if err := join(wrap, &ifi, gaddr, o); err != nil {
+			o.logger.Warn("Failed to join multicast group", "group", gaddr.String(), "interface", ifi.Name, "error", err)
 			continue
 		}
 		joined++
-		fmt.Printf("joined group %s on %s (#%d)\n", gaddr.String(), ifi.Name, ifi.Index)
+		o.logger.Info("Joined multicast group", "group", gaddr.String(), "interface", ifi.Name, "index", ifi.Index)
 	}
 	if joined == 0 {
 		return nil, errors.New("no interfaces had joined to group")
 	}
 	return wrap, nil
 }
+
+// GroupConn is a connection joining multicast groups, either an
+// *ipv4.PacketConn or an *ipv6.PacketConn.
+type GroupConn interface {
+	JoinGroup(ifi *net.Interface, group net.Addr) error
+	LeaveGroup(ifi *net.Interface, group net.Addr) error
+	JoinSourceSpecificGroup(ifi *net.Interface, group, source net.Addr) error
+	LeaveSourceSpecificGroup(ifi *net.Interface, group, source net.Addr) error
+}
+
+// join joins the group on ifi, for the configured sources only if any.
+func join(conn GroupConn, ifi *net.Interface, group net.Addr, o *options) error {
+	if len(o.sources) == 0 {
+		return conn.JoinGroup(ifi, group)
+	}
+	for _, source := range o.sources {
+		if err := conn.JoinSourceSpecificGroup(ifi, group, &net.UDPAddr{IP: source}); err != nil {
+			return fmt.Errorf("source %s: %w", source, err)
+		}
+	}
+	return nil
+}
+
+// leave leaves the group on ifi, for the configured sources only if any.
+func leave(conn GroupConn, ifi *net.Interface, group net.Addr, o *options) error {
+	if len(o.sources) == 0 {
+		return conn.LeaveGroup(ifi, group)
+	}
+	var errs []error
+	for _, source := range o.sources {
+		errs = append(errs, conn.LeaveSourceSpecificGroup(ifi, group, &net.UDPAddr{IP: source}))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,38 @@
+package multicast
+
+import (
+	"context"
+	"net"
+
+	"github.com/home-sol/multicast-proxy/pkg/net/netwatch"
+)
+
+// Rejoin keeps conn a member of group on the interfaces matching match as
+// they are added, come up or get a new address, until ctx is cancelled.
+// Listen and ListenIPv6 only join the interfaces present when they are called.
+// opts should be those given to them.
+func Rejoin(ctx context.Context, conn GroupConn, group net.Addr, w *netwatch.Watcher, match func(net.Interface) bool, opts ...Option) {
+	o := newOptions(opts)
+
+	events, unsubscribe := w.Subscribe(64)
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if !event.Joinable() || !match(event.Interface) {
+				continue
+			}
+			ifi := event.Interface
+			// Membership survives address changes and flaps, but not a
+			// recreated interface; leaving first makes joining idempotent.
+			_ = leave(conn, &ifi, group, &o)
+			if err := join(conn, &ifi, group, &o); err != nil {
+				o.logger.Warn("Failed to rejoin multicast group", "group", group.String(), "interface", ifi.Name, "error", err)
+				continue
+			}
+			o.logger.Info("Rejoined multicast group", "group", group.String(), "interface", ifi.Name, "index", ifi.Index, "reason", event.Type.String())
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build (!unix && !windows) || solaris
+
+package multicast
+
+import (
+	"errors"
+	"fmt"
+)
+
+func setReuseAddr(fd uintptr) error {
+	return fmt.Errorf("SO_REUSEADDR: %w", errors.ErrUnsupported)
+}
+
+func setReusePort(fd uintptr) error {
+	return fmt.Errorf("SO_REUSEPORT: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package multicast
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+func setReuseAddr(fd uintptr) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
+
+// setReusePort fails: Windows has no SO_REUSEPORT, and its SO_REUSEADDR
+// already lets sockets share a port.
+func setReusePort(fd uintptr) error {
+	return fmt.Errorf("SO_REUSEPORT: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,300 @@
+// Package netwatch reports network interfaces coming and going, changing
+// state and gaining or losing addresses, so that multicast listeners and
+// clients can follow them.
+package netwatch
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultPollInterval is how often interfaces are listed when change
+// notifications are not available.
+const DefaultPollInterval = 5 * time.Second
+
+// settleDelay coalesces bursts of change notifications into one listing.
+const settleDelay = 100 * time.Millisecond
+
+// EventType is the kind of an interface change.
+type EventType int
+
+const (
+	InterfaceAdded EventType = iota
+	InterfaceRemoved
+	InterfaceUp
+	InterfaceDown
+	AddressAdded
+	AddressRemoved
+)
+
+func (t EventType) String() string {
+	switch t {
+	case InterfaceAdded:
+		return "added"
+	case InterfaceRemoved:
+		return "removed"
+	case InterfaceUp:
+		return "up"
+	case InterfaceDown:
+		return "down"
+	case AddressAdded:
+		return "address added"
+	case AddressRemoved:
+		return "address removed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a change of one interface. Addr is set for address events.
+type Event struct {
+	Type      EventType
+	Interface net.Interface
+	Addr      string
+}
+
+// Joinable reports whether the event may let a multicast group be joined on
+// the interface that could not be joined before.
+func (e Event) Joinable() bool {
+	switch e.Type {
+	case InterfaceAdded, InterfaceUp, AddressAdded:
+		return e.Interface.Flags&net.FlagUp != 0
+	}
+	return false
+}
+
+// MatchNames returns a function matching the named interfaces, or all
+// interfaces if no name is given.
+func MatchNames(names ...string) func(net.Interface) bool {
+	if len(names) == 0 {
+		return func(net.Interface) bool { return true }
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return func(intf net.Interface) bool {
+		return set[intf.Name]
+	}
+}
+
+// Option configures a Watcher.
+type Option func(*Watcher)
+
+// WithLogger sets the logger used to report changes.
+func WithLogger(logger *slog.Logger) Option {
+	return func(w *Watcher) {
+		w.logger = logger
+	}
+}
+
+// WithPolling makes the Watcher list interfaces at the given interval
+// instead of using change notifications from the operating system.
+func WithPolling(interval time.Duration) Option {
+	return func(w *Watcher) {
+		w.poll = true
+		w.pollInterval = interval
+	}
+}
+
+// Watcher reports interface changes to its subscribers. On Linux it relies on
+// rtnetlink notifications and falls back to polling elsewhere, or if they are
+// not available.
+type Watcher struct {
+	logger       *slog.Logger
+	poll         bool
+	pollInterval time.Duration
+
+	lock        sync.Mutex
+	interfaces  map[string]snapshot
+	subscribers map[chan Event]struct{}
+}
+
+type snapshot struct {
+	intf  net.Interface
+	addrs map[string]bool
+}
+
+// New creates a Watcher. It reports nothing until Run is called.
+func New(opts ...Option) (*Watcher, error) {
+	w := &Watcher{
+		logger:       slog.Default(),
+		pollInterval: DefaultPollInterval,
+		subscribers:  make(map[chan Event]struct{}),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	interfaces, err := list()
+	if err != nil {
+		return nil, err
+	}
+	w.interfaces = interfaces
+	return w, nil
+}
+
+// Interfaces returns the interfaces matching match, as last listed.
+func (w *Watcher) Interfaces(match func(net.Interface) bool) []net.Interface {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var interfaces []net.Interface
+	for _, s := range w.interfaces {
+		if match(s.intf) {
+			interfaces = append(interfaces, s.intf)
+		}
+	}
+	return interfaces
+}
+
+// Subscribe returns a channel receiving events until the returned function
+// is called. Events are dropped if the subscriber falls behind by more than
+// buffer events.
+func (w *Watcher) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	w.lock.Lock()
+	w.subscribers[ch] = struct{}{}
+	w.lock.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			w.lock.Lock()
+			delete(w.subscribers, ch)
+			w.lock.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Run reports interface changes until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) error {
+	if !w.poll {
+		changes, err := notifications(ctx)
+		if err == nil {
+			w.logger.Debug("Watching interfaces with change notifications")
+			return w.run(ctx, changes, nil)
+		}
+		w.logger.Warn("Interface change notifications unavailable, polling", "interval", w.pollInterval, "error", err)
+	}
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+	return w.run(ctx, nil, ticker.C)
+}
+
+func (w *Watcher) run(ctx context.Context, changes <-chan struct{}, ticks <-chan time.Time) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-changes:
+			if !ok {
+				// The notification source failed; keep going by polling.
+				w.logger.Warn("Interface change notifications stopped, polling", "interval", w.pollInterval)
+				changes = nil
+				ticker := time.NewTicker(w.pollInterval)
+				defer ticker.Stop()
+				ticks = ticker.C
+				continue
+			}
+			timer := time.NewTimer(settleDelay)
+		settle:
+			for {
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil
+				case <-changes:
+				case <-timer.C:
+					break settle
+				}
+			}
+		case <-ticks:
+		}
+		w.refresh()
+	}
+}
+
+// refresh lists the interfaces and reports the differences with the last
+// listing.
+func (w *Watcher) refresh() {
+	interfaces, err := list()
+	if err != nil {
+		w.logger.Warn("Could not list interfaces", "error", err)
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	events := diff(w.interfaces, interfaces)
+	w.interfaces = interfaces
+	for _, event := range events {
+		w.logger.Info("Interface changed", "interface", event.Interface.Name, "index", event.Interface.Index, "change", event.Type.String(), "address", event.Addr)
+		for ch := range w.subscribers {
+			select {
+			case ch <- event:
+			default:
+				w.logger.Warn("Dropping interface event for slow subscriber", "interface", event.Interface.Name)
+			}
+		}
+	}
+}
+
+func list() (map[string]snapshot, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make(map[string]snapshot, len(interfaces))
+	for _, intf := range interfaces {
+		s := snapshot{intf: intf, addrs: make(map[string]bool)}
+		// An interface may disappear while it is being listed.
+		if addrs, err := intf.Addrs(); err == nil {
+			for _, addr := range addrs {
+				s.addrs[addr.String()] = true
+			}
+		}
+		snapshots[intf.Name] = s
+	}
+	return snapshots, nil
+}
+
+// diff returns the events turning old into current. An interface recreated
+// with the same name is reported as removed and added again.
+func diff(old, current map[string]snapshot) []Event {
+	var events []Event
+	for name, o := range old {
+		if c, ok := current[name]; !ok || c.intf.Index != o.intf.Index {
+			events = append(events, Event{Type: InterfaceRemoved, Interface: o.intf})
+		}
+	}
+	for name, c := range current {
+		o, ok := old[name]
+		if !ok || c.intf.Index != o.intf.Index {
+			events = append(events, Event{Type: InterfaceAdded, Interface: c.intf})
+			for addr := range c.addrs {
+				events = append(events, Event{Type: AddressAdded, Interface: c.intf, Addr: addr})
+			}
+			continue
+		}
+		wasUp, isUp := o.intf.Flags&net.FlagUp != 0, c.intf.Flags&net.FlagUp != 0
+		if !wasUp && isUp {
+			events = append(events, Event{Type: InterfaceUp, Interface: c.intf})
+		} else if wasUp && !isUp {
+			events = append(events, Event{Type: InterfaceDown, Interface: c.intf})
+		}
+		for addr := range o.addrs {
+			if !c.addrs[addr] {
+				events = append(events, Event{Type: AddressRemoved, Interface: c.intf, Addr: addr})
+			}
+		}
+		for addr := range c.addrs {
+			if !o.addrs[addr] {
+				events = append(events, Event{Type: AddressAdded, Interface: c.intf, Addr: addr})
+			}
+		}
+	}
+	return events
+}
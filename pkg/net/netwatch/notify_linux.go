@@ -0,0 +1,62 @@
+//go:build linux
+
+package netwatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// notifications subscribes to rtnetlink link and address changes. The
+// returned channel receives a value for each batch of notifications, and is
+// closed if the socket fails.
+func notifications(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("opening netlink socket: %w", err)
+	}
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("binding netlink socket: %w", err)
+	}
+	// A non-blocking file goes through the runtime poller, so closing it
+	// interrupts a pending Read.
+	f := os.NewFile(uintptr(fd), "netlink")
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		_ = f.Close()
+	}()
+	go func() {
+		defer close(changes)
+		buf := make([]byte, os.Getpagesize())
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if errors.Is(err, unix.ENOBUFS) {
+					// Notifications were lost; a listing catches up.
+					n = 1
+				} else {
+					return
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
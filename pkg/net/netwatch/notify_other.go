@@ -0,0 +1,13 @@
+//go:build !linux
+
+package netwatch
+
+import (
+	"context"
+	"errors"
+)
+
+// notifications is only implemented on Linux; other platforms poll.
+func notifications(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("not supported on this platform")
+}
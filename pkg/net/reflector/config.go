@@ -3,12 +3,72 @@ package reflector
 type MacAddress string
 
 type Config struct {
-	NetInterface     string `mapstructure:"net_interface"`
-	WindowsInterface string `mapstructure:"windows_net_interface"`
-	Devices          map[MacAddress]Device
+	NetInterface     string `mapstructure:"net_interface" json:"net_interface,omitempty"`
+	WindowsInterface string `mapstructure:"windows_net_interface" json:"windows_net_interface,omitempty"`
+	// Pools names the VLANs and the rules for sharing services between them.
+	Pools map[string]Pool `mapstructure:"pools" json:"pools,omitempty"`
+	// Devices override the pool rules for individual devices.
+	Devices map[MacAddress]Device `json:"devices,omitempty"`
+	// Selectors identify devices by what they announce rather than by MAC
+	// address. They are tried in order after Devices, and the first match
+	// decides the pools a device is shared with.
+	Selectors []Selector `mapstructure:"selectors" json:"selectors,omitempty"`
+}
+
+// Pool is a VLAN whose services can be shared with other pools.
+type Pool struct {
+	VLAN        uint16      `mapstructure:"vlan" json:"vlan,omitempty"`
+	Description string      `mapstructure:"description" json:"description,omitempty"`
+	Share       []ShareRule `mapstructure:"share" json:"share,omitempty"`
+	// UPnPProxy is the base URL of the UPnP proxy as reached from the pool,
+	// e.g. "http://10.30.0.1:8200". If set, the LOCATION of SSDP messages
+	// reflected into the pool points at the proxy rather than the device.
+	// Control points connecting to the proxy on this host only reach the
+	// devices announced to the pool. Only the multicast NOTIFY messages the
+	// reflector captures are rewritten: devices answer M-SEARCH requests
+	// with unicast responses the reflector never sees, so these still carry
+	// the device LOCATION and control points must wait for announcements.
+	UPnPProxy string `mapstructure:"upnp_proxy" json:"upnp_proxy,omitempty"`
+	// DNSDomain is the unicast DNS domain under which the DNS gateway
+	// publishes the mDNS services of the pool, e.g. "iot.home.arpa".
+	DNSDomain string `mapstructure:"dns_domain" json:"dns_domain,omitempty"`
+	// MDNSInterface is an interface on the pool, e.g. "enp7s0.30", on which
+	// the DNS gateway sends mDNS queries for names it has not seen. Without
+	// it, only announcements and responses captured on the pool are served.
+	MDNSInterface string `mapstructure:"mdns_interface" json:"mdns_interface,omitempty"`
+}
+
+// ShareRule makes the services announced on a pool visible on the listed
+// pools. Sharing is directional: queries from the target pools reach the
+// source pool, but not the other way around.
+type ShareRule struct {
+	// To lists the names of the pools the services are shared with.
+	To []string `mapstructure:"to" json:"to,omitempty"`
+	// Protocols restricts the rule to "mdns" and/or "ssdp". Empty means both.
+	Protocols []string `mapstructure:"protocols" json:"protocols,omitempty"`
 }
 
 type Device struct {
-	OriginPool  uint16   `mapstructure:"origin_pool"`
-	SharedPools []uint16 `mapstructure:"shared_pools"`
+	OriginPool  uint16   `mapstructure:"origin_pool" json:"origin_pool,omitempty"`
+	SharedPools []uint16 `mapstructure:"shared_pools" json:"shared_pools,omitempty"`
+}
+
+// Selector matches a device by its IP address, hostname, or announced mDNS
+// or SSDP identity. Every criterion that is set must match.
+type Selector struct {
+	Name string `mapstructure:"name" json:"name,omitempty"`
+	// CIDR matches the source IP address, e.g. "10.20.0.0/24" or "10.20.0.5/32".
+	CIDR string `mapstructure:"cidr" json:"cidr,omitempty"`
+	// Hostname matches the DHCP hostname or an mDNS A/AAAA/SRV host name,
+	// with or without the ".local" suffix.
+	Hostname string `mapstructure:"hostname" json:"hostname,omitempty"`
+	// MDNSInstance matches an mDNS service instance, either by its full name
+	// or by its instance label, e.g. "Living Room".
+	MDNSInstance string `mapstructure:"mdns_instance" json:"mdns_instance,omitempty"`
+	// MDNSService matches an announced mDNS service type, e.g. "_airplay._tcp".
+	MDNSService string `mapstructure:"mdns_service" json:"mdns_service,omitempty"`
+	// USNPrefix matches the beginning of the SSDP USN header.
+	USNPrefix string `mapstructure:"ssdp_usn_prefix" json:"ssdp_usn_prefix,omitempty"`
+
+	Device `mapstructure:",squash"`
 }
@@ -0,0 +1,65 @@
+package reflector
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "multicast_proxy"
+
+var (
+	packetsCaptured = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reflector",
+		Name:      "packets_captured_total",
+		Help:      "Packets captured, by protocol and VLAN.",
+	}, []string{"protocol", "vlan"})
+
+	packetsForwarded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reflector",
+		Name:      "packets_forwarded_total",
+		Help:      "Packets forwarded, by protocol, source VLAN and destination VLAN.",
+	}, []string{"protocol", "src_vlan", "dst_vlan"})
+
+	packetsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reflector",
+		Name:      "packets_dropped_total",
+		Help:      "Packets not forwarded because no route matched, by protocol and VLAN.",
+	}, []string{"protocol", "vlan"})
+
+	sendErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reflector",
+		Name:      "send_errors_total",
+		Help:      "Failures to write a forwarded packet, by protocol and destination VLAN.",
+	}, []string{"protocol", "dst_vlan"})
+
+	decodeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reflector",
+		Name:      "decode_failures_total",
+		Help:      "Captured packets that could not be decoded as mDNS or SSDP.",
+	})
+
+	packetBacklog = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reflector",
+		Name:      "packet_backlog",
+		Help:      "Decoded packets waiting to be processed.",
+	})
+
+	deviceLastSeen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reflector",
+		Name:      "device_last_seen_timestamp_seconds",
+		Help:      "Unix time a configured device was last seen, by device MAC address or selector.",
+	}, []string{"device"})
+)
+
+func vlanLabel(vlan uint16) string {
+	return strconv.FormatUint(uint64(vlan), 10)
+}
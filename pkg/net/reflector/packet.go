@@ -1,12 +1,26 @@
 package reflector
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/home-sol/multicast-proxy/pkg/net/ssdp"
+	"github.com/home-sol/multicast-proxy/pkg/net/upnp"
+)
+
+const (
+	protocolMDNS = "mDNS"
+	protocolSSDP = "SSDP"
+	protocolDHCP = "DHCP"
 )
 
 type packet struct {
@@ -20,12 +34,44 @@ type packet struct {
 	dstIP    net.IP
 	protocol string
 	queries  []string
+	// dns is the decoded mDNS message.
+	dns *layers.DNS
+
+	// Identity announced by the sender, used to match selectors.
+	hostnames []string
+	instances []string
+	services  []string
+	usn       string
+	// ownHostname is the hostname the sender claimed for itself, through DHCP
+	// or an mDNS address record for its source address. It is remembered for
+	// its MAC address.
+	ownHostname string
 }
 
 func (p packet) String() string {
 	return fmt.Sprintf("[%3s] SRC: %1s, DST:%2s, query: %4v", p.protocol, p.srcIP, p.dstIP, p.queries)
 }
 
+// LogValue implements slog.LogValuer, so packets are only formatted when the
+// record is actually logged.
+func (p packet) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("protocol", p.protocol),
+		slog.String("src", p.srcIP.String()),
+		slog.String("dst", p.dstIP.String()),
+	}
+	if p.vlanTag != nil {
+		attrs = append(attrs, slog.Int("vlan", int(*p.vlanTag)))
+	}
+	if p.srcMAC != nil {
+		attrs = append(attrs, slog.String("src_mac", p.srcMAC.String()))
+	}
+	if len(p.queries) > 0 {
+		attrs = append(attrs, slog.Any("queries", p.queries))
+	}
+	return slog.GroupValue(attrs...)
+}
+
 func parsePacketsLazily(source *gopacket.PacketSource) chan packet {
 	// Process packets, and forward Bonjour traffic to the returned channel
 
@@ -46,36 +92,37 @@ func parsePacketsLazily(source *gopacket.PacketSource) chan packet {
 
 			payload := parseUDPLayer(p)
 
-			var isSSDPPacket, isMDNSPacket, isQuery bool
-			var protocol string
-			var queries []string
-
-			isSSDPPacket, isQuery, queries = parseSSDPLayer(payload)
-
-			if isSSDPPacket {
-				protocol = "SSDP"
-			} else {
-				isMDNSPacket, isQuery, queries = parseMDNSPayload(payload)
-				if isMDNSPacket {
-					protocol = "mDNS"
-				}
-			}
-
-			// Pass on the p for its next adventure
-			packetChan <- packet{
+			pkt := packet{
 				packet:  p,
 				vlanTag: tag,
 				srcMAC:  srcMAC,
 				dstMAC:  dstMAC,
 				isIPv6:  isIPv6,
-				isQuery: isQuery,
 
-				srcIP:    srcIP,
-				dstIP:    dstIP,
-				protocol: protocol,
-				queries:  queries,
+				srcIP: srcIP,
+				dstIP: dstIP,
+			}
+
+			if hostname, clientMAC, ok := parseDHCPLayer(p); ok {
+				pkt.protocol = protocolDHCP
+				pkt.srcMAC = &clientMAC
+				pkt.hostnames = []string{hostname}
+				pkt.ownHostname = hostname
+			} else if isSSDPPacket, isQuery, queries, usn := parseSSDPLayer(p); isSSDPPacket {
+				pkt.protocol = protocolSSDP
+				pkt.isQuery = isQuery
+				pkt.queries = queries
+				pkt.usn = usn
+			} else if isMDNSPacket, isQuery, queries := parseMDNSPayload(payload, &pkt); isMDNSPacket {
+				pkt.protocol = protocolMDNS
+				pkt.isQuery = isQuery
+				pkt.queries = queries
 			}
+
+			// Pass on the p for its next adventure
+			packetChan <- pkt
 		}
+		close(packetChan)
 	}()
 
 	return packetChan
@@ -113,22 +160,45 @@ func parseUDPLayer(packet gopacket.Packet) (payload []byte) {
 	return
 }
 
-func parseSSDPLayer(payload []byte) (bool, bool, []string) {
-	packet := gopacket.NewPacket(payload, ssdp.LayerTypeSSDP, gopacket.Default)
+// parseDHCPLayer returns the hostname a DHCP client sent in its request
+// (option 12) together with the client hardware address.
+func parseDHCPLayer(packet gopacket.Packet) (string, net.HardwareAddr, bool) {
+	parsedDHCP := packet.Layer(layers.LayerTypeDHCPv4)
+	if parsedDHCP == nil {
+		return "", nil, false
+	}
+	dhcp := parsedDHCP.(*layers.DHCPv4)
+	if dhcp.Operation != layers.DHCPOpRequest {
+		return "", nil, false
+	}
+	for _, opt := range dhcp.Options {
+		if opt.Type == layers.DHCPOptHostname && len(opt.Data) > 0 {
+			return string(opt.Data), dhcp.ClientHWAddr, true
+		}
+	}
+	return "", nil, false
+}
+
+// parseSSDPLayer reads the SSDP layer gopacket decodes for UDP port 1900.
+func parseSSDPLayer(packet gopacket.Packet) (bool, bool, []string, string) {
 	if parsedSSDP := packet.Layer(ssdp.LayerTypeSSDP); parsedSSDP != nil {
 		ssdpPacket := parsedSSDP.(*ssdp.SSDP)
 		if ssdpPacket.Method == ssdp.MethodSearch {
-			return true, true, []string{ssdpPacket.Headers["ST"]}
+			return true, true, []string{ssdpPacket.Get("ST")}, ""
 		}
-		return true, false, nil
+		return true, false, nil, ssdpPacket.Get("USN")
 	}
-	return false, false, nil
+	return false, false, nil, ""
 }
 
-func parseMDNSPayload(payload []byte) (bool, bool, []string) {
+// parseMDNSPayload decodes an mDNS message. For responses, the host names,
+// service instances and service types announced in the records are stored in
+// p so that the sender can be matched against selectors.
+func parseMDNSPayload(payload []byte, p *packet) (bool, bool, []string) {
 	packet := gopacket.NewPacket(payload, layers.LayerTypeDNS, gopacket.Default)
 	if parsedDNS := packet.Layer(layers.LayerTypeDNS); parsedDNS != nil {
 		dnsPacket := parsedDNS.(*layers.DNS)
+		p.dns = dnsPacket
 		if !dnsPacket.QR {
 			queries := make([]string, len(dnsPacket.Questions))
 			for i, question := range dnsPacket.Questions {
@@ -136,31 +206,175 @@ func parseMDNSPayload(payload []byte) (bool, bool, []string) {
 			}
 			return true, !dnsPacket.QR, queries
 		}
+		for _, records := range [][]layers.DNSResourceRecord{dnsPacket.Answers, dnsPacket.Additionals} {
+			for _, rr := range records {
+				parseMDNSRecord(rr, p)
+			}
+		}
 		return true, !dnsPacket.QR, nil
 	}
 	return false, false, nil
 }
 
+func parseMDNSRecord(rr layers.DNSResourceRecord, p *packet) {
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		p.hostnames = appendUnique(p.hostnames, normalizeName(string(rr.Name)))
+		if p.ownHostname == "" && p.srcIP != nil && rr.IP.Equal(p.srcIP) {
+			p.ownHostname = normalizeName(string(rr.Name))
+		}
+	case layers.DNSTypePTR:
+		// Skip reverse lookups and the DNS-SD service type enumeration.
+		name := normalizeName(string(rr.Name))
+		if !strings.HasPrefix(name, "_") || name == "_services._dns-sd._udp" {
+			return
+		}
+		p.services = appendUnique(p.services, name)
+		p.instances = appendUnique(p.instances, normalizeName(string(rr.PTR)))
+	case layers.DNSTypeSRV:
+		instance := normalizeName(string(rr.Name))
+		p.instances = appendUnique(p.instances, instance)
+		if i := strings.Index(instance, "._"); i >= 0 {
+			p.services = appendUnique(p.services, instance[i+1:])
+		}
+		p.hostnames = appendUnique(p.hostnames, normalizeName(string(rr.SRV.Name)))
+	}
+}
+
+// normalizeName lower-cases an mDNS name and strips the root dot and the
+// ".local" domain.
+func normalizeName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return strings.TrimSuffix(name, ".local")
+}
+
+func appendUnique(list []string, s string) []string {
+	if s == "" {
+		return list
+	}
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
 type packetWriter interface {
 	WritePacketData([]byte) error
 }
 
-func sendPacket(handle packetWriter, packet *packet, tag uint16, brMACAddress net.HardwareAddr) error {
+// sendPacket sends packet on the VLAN tag. If proxy is set, the LOCATION of an
+// SSDP message points at the UPnP proxy at that base URL instead of the
+// device.
+func sendPacket(handle packetWriter, packet *packet, tag uint16, brMACAddress net.HardwareAddr, proxy *url.URL) error {
 	*packet.vlanTag = tag
 	*packet.srcMAC = brMACAddress
 
 	// Network devices may set dstMAC to the local MAC address
 	// Rewrite dstMAC to ensure that it is set to the appropriate multicast MAC address
-	if packet.isIPv6 {
-		*packet.dstMAC = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0xFB}
-	} else {
-		*packet.dstMAC = net.HardwareAddr{0x01, 0x00, 0x5E, 0x00, 0x00, 0xFB}
+	*packet.dstMAC = multicastMAC(packet.dstIP)
+
+	// Decoded layers such as SSDP and DNS are re-encoded rather than copied,
+	// which may change the payload length.
+	if parsedUDP := packet.packet.Layer(layers.LayerTypeUDP); parsedUDP != nil {
+		if network := packet.packet.NetworkLayer(); network != nil {
+			_ = parsedUDP.(*layers.UDP).SetNetworkLayerForChecksum(network)
+		}
+	}
+
+	if proxy != nil {
+		defer rewriteLocation(packet, proxy)()
 	}
 
 	buf := gopacket.NewSerializeBuffer()
-	err := gopacket.SerializePacket(buf, gopacket.SerializeOptions{}, packet.packet)
+	err := gopacket.SerializePacket(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, packet.packet)
 	if err != nil {
 		return fmt.Errorf("failed to serialize packet: %w", err)
 	}
 	return handle.WritePacketData(buf.Bytes())
 }
+
+// rewriteLocation points the LOCATION of an SSDP message at the UPnP proxy at
+// base, and returns a function restoring it for other VLANs.
+func rewriteLocation(packet *packet, base *url.URL) (restore func()) {
+	parsedSSDP := packet.packet.Layer(ssdp.LayerTypeSSDP)
+	if parsedSSDP == nil {
+		return func() {}
+	}
+	ssdpPacket := parsedSSDP.(*ssdp.SSDP)
+	location := ssdpPacket.Get("LOCATION")
+	target, err := url.Parse(location)
+	if location == "" || err != nil || target.Scheme != "http" {
+		return func() {}
+	}
+	// Restore the message as decoded, so that other VLANs get it as
+	// received rather than re-encoded.
+	saved := *ssdpPacket
+	saved.Headers = append([]ssdp.Header(nil), ssdpPacket.Headers...)
+	ssdpPacket.Set("LOCATION", upnp.ProxyURL(base, target).String())
+	return func() {
+		*ssdpPacket = saved
+	}
+}
+
+// multicastMAC returns the Ethernet address of the multicast group ip.
+func multicastMAC(ip net.IP) net.HardwareAddr {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.HardwareAddr{0x01, 0x00, 0x5E, ip4[1] & 0x7F, ip4[2], ip4[3]}
+	}
+	if len(ip) == net.IPv6len {
+		return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+	}
+	// Fall back to the mDNS group.
+	return net.HardwareAddr{0x01, 0x00, 0x5E, 0x00, 0x00, 0xFB}
+}
+
+// ownLocation returns the host:port of the LOCATION of an SSDP message, and
+// whether it is on the sender of the message. Devices only announce their own
+// descriptions; any other LOCATION is spoofed.
+func ownLocation(p *packet) (string, bool) {
+	location, err := url.Parse(ssdpLocation(p))
+	if err != nil || location.Scheme != "http" {
+		return "", false
+	}
+	if !p.srcIP.Equal(net.ParseIP(location.Hostname())) {
+		return "", false
+	}
+	port := location.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(location.Hostname(), port), true
+}
+
+// ssdpLocation returns the LOCATION of an SSDP message, if any.
+func ssdpLocation(p *packet) string {
+	if parsedSSDP := p.packet.Layer(ssdp.LayerTypeSSDP); parsedSSDP != nil {
+		return parsedSSDP.(*ssdp.SSDP).Get("LOCATION")
+	}
+	return ""
+}
+
+// registerSSDP passes a captured SSDP NOTIFY message to the registry.
+// Messages with a LOCATION on another host than the sender are dropped.
+func (r *Reflector) registerSSDP(p *packet) {
+	parsedUDP := p.packet.Layer(layers.LayerTypeUDP)
+	if parsedUDP == nil {
+		return
+	}
+	if location := ssdpLocation(p); location != "" {
+		if _, ok := ownLocation(p); !ok {
+			r.logger.Debug("Ignoring SSDP message with a LOCATION on another host", "packet", p, "location", location)
+			return
+		}
+	}
+	udp := parsedUDP.(*layers.UDP)
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(udp.Payload)))
+	if err != nil {
+		// Search responses are not requests and are expected to fail here.
+		return
+	}
+	req.RemoteAddr = net.JoinHostPort(ipString(p.srcIP), strconv.Itoa(int(udp.SrcPort)))
+	r.registry.ServeMessage(req)
+}
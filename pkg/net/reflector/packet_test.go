@@ -0,0 +1,164 @@
+package reflector
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/home-sol/multicast-proxy/pkg/net/ssdp"
+)
+
+// frameSource yields the frames, then io.EOF.
+type frameSource [][]byte
+
+func (s *frameSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(*s) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := (*s)[0]
+	*s = (*s)[1:]
+	return data, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}, nil
+}
+
+type frameWriter [][]byte
+
+func (w *frameWriter) WritePacketData(data []byte) error {
+	*w = append(*w, append([]byte(nil), data...))
+	return nil
+}
+
+// captureSSDP builds a tagged frame carrying payload from 10.0.0.2 to the
+// SSDP group and parses it as the capture does.
+func captureSSDP(t *testing.T, vlan uint16, payload []byte) packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{1, 0, 0x5e, 0x7f, 0xff, 0xfa},
+		EthernetType: layers.EthernetTypeDot1Q,
+	}
+	dot1q := &layers.Dot1Q{VLANIdentifier: vlan, Type: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 4, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(10, 0, 0, 2), DstIP: net.IPv4(239, 255, 255, 250)}
+	udp := &layers.UDP{SrcPort: 1900, DstPort: 1900}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, dot1q, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := frameSource{buf.Bytes()}
+	packets := parsePacketsLazily(gopacket.NewPacketSource(&frames, layers.LinkTypeEthernet))
+	p, ok := <-packets
+	if !ok {
+		t.Fatal("frame not parsed")
+	}
+	if p.protocol != protocolSSDP {
+		t.Fatalf("protocol = %q, want %q", p.protocol, protocolSSDP)
+	}
+	return p
+}
+
+func udpPayload(t *testing.T, frame []byte) []byte {
+	t.Helper()
+	p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	udp, ok := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		t.Fatalf("no UDP layer in %v", p)
+	}
+	return udp.Payload
+}
+
+func TestSendPacketRelaysSSDPAsReceived(t *testing.T) {
+	// Header names in odd case, no space after the colon and no final blank
+	// line, as some devices send them.
+	payload := []byte("NOTIFY * HTTP/1.1\r\nHost:239.255.255.250:1900\r\nnt: upnp:rootdevice\r\nNTS: ssdp:alive\r\n" +
+		"Location: http://10.0.0.2:1400/desc.xml\r\nUSN: uuid:x::upnp:rootdevice\r\nmalformed line")
+	p := captureSSDP(t, 10, payload)
+	proxy, _ := url.Parse("http://10.30.0.1:8200")
+
+	var w frameWriter
+	mac := net.HardwareAddr{0, 0xa, 0xb, 0xc, 0xd, 0xe}
+	for _, send := range []struct {
+		vlan  uint16
+		proxy *url.URL
+	}{{20, nil}, {30, proxy}, {40, nil}} {
+		if err := sendPacket(&w, &p, send.vlan, mac, send.proxy); err != nil {
+			t.Fatalf("sendPacket to vlan %d: %v", send.vlan, err)
+		}
+	}
+
+	if got := udpPayload(t, w[0]); !bytes.Equal(got, payload) {
+		t.Errorf("vlan 20 payload = %q, want as received %q", got, payload)
+	}
+	rewritten := udpPayload(t, w[1])
+	if !bytes.Contains(rewritten, []byte("Location: http://10.30.0.1:8200/upnp/10.0.0.2:1400/desc.xml\r\n")) {
+		t.Errorf("vlan 30 payload = %q, want LOCATION through the proxy", rewritten)
+	}
+	if got := udpPayload(t, w[2]); !bytes.Equal(got, payload) {
+		t.Errorf("vlan 40 payload = %q, want as received %q", got, payload)
+	}
+}
+
+func TestRegisterSSDPRefusesSpoofedLocation(t *testing.T) {
+	for _, tt := range []struct {
+		location string
+		known    bool
+	}{
+		{"http://10.0.0.2:1400/desc.xml", true},
+		{"http://10.0.0.2/desc.xml", true},
+		{"http://192.168.1.1:80/", false},
+		{"http://router.local/desc.xml", false},
+	} {
+		payload := []byte("NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nCACHE-CONTROL: max-age=1800\r\n" +
+			"LOCATION: " + tt.location + "\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:x::upnp:rootdevice\r\n\r\n")
+		p := captureSSDP(t, 10, payload)
+		r := &Reflector{registry: ssdp.NewRegistry(), logger: slog.Default()}
+		r.registerSSDP(&p)
+		if known := len(r.registry.Entries()) == 1; known != tt.known {
+			t.Errorf("LOCATION %s: registered = %v, want %v", tt.location, known, tt.known)
+		}
+		if _, ok := ownLocation(&p); ok != tt.known {
+			t.Errorf("LOCATION %s: ownLocation = %v, want %v", tt.location, ok, tt.known)
+		}
+	}
+}
+
+func TestProxied(t *testing.T) {
+	st, err := newState(&Config{Pools: map[string]Pool{
+		"iot":    {VLAN: 10},
+		"guests": {VLAN: 30, UPnPProxy: "http://10.30.0.1:8200"},
+		"media":  {VLAN: 40, UPnPProxy: "http://10.40.0.1:8200"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Reflector{proxied: newProxiedTable()}
+	r.state.Store(st)
+	r.proxied.add(40, "10.0.0.2:1400")
+
+	for _, tt := range []struct {
+		proxyIP  string
+		hostport string
+		want     bool
+	}{
+		{"10.40.0.1", "10.0.0.2:1400", true},
+		{"10.30.0.1", "10.0.0.2:1400", false},
+		{"10.40.0.1", "10.0.0.3:1400", false},
+	} {
+		if got := r.Proxied(net.ParseIP(tt.proxyIP), tt.hostport); got != tt.want {
+			t.Errorf("Proxied(%s, %s) = %v, want %v", tt.proxyIP, tt.hostport, got, tt.want)
+		}
+	}
+
+	now := time.Now().Add(proxiedTTL)
+	r.proxied.now = func() time.Time { return now }
+	if r.Proxied(net.ParseIP("10.40.0.1"), "10.0.0.2:1400") {
+		t.Error("location still proxied after its TTL")
+	}
+}
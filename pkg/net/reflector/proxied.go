@@ -0,0 +1,88 @@
+package reflector
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// proxiedTTL is how long a device location is reachable through the
+	// UPnP proxy after it was last announced to a pool; the registry decides
+	// whether the device is still alive within that.
+	proxiedTTL = 24 * time.Hour
+	// maxProxied bounds the number of locations remembered; the least
+	// recently announced ones are forgotten first.
+	maxProxied = 4096
+)
+
+// proxiedKey is a device location announced to the pool on a VLAN.
+type proxiedKey struct {
+	vlan     uint16
+	hostport string
+}
+
+// proxiedTable remembers the device locations whose SSDP messages were
+// reflected into a pool with their LOCATION pointing at the UPnP proxy, so
+// that the proxy only reaches devices shared with the pool of a control
+// point.
+type proxiedTable struct {
+	lock  sync.Mutex
+	byKey map[proxiedKey]time.Time
+	now   func() time.Time
+}
+
+func newProxiedTable() *proxiedTable {
+	return &proxiedTable{byKey: make(map[proxiedKey]time.Time), now: time.Now}
+}
+
+// add records that the device at hostport was announced to the pool on vlan.
+func (t *proxiedTable) add(vlan uint16, hostport string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	key := proxiedKey{vlan, hostport}
+	if _, ok := t.byKey[key]; !ok && len(t.byKey) >= maxProxied {
+		t.evictLocked(now)
+	}
+	t.byKey[key] = now
+}
+
+// evictLocked drops the expired entries, or the least recently announced one
+// if none has expired.
+func (t *proxiedTable) evictLocked(now time.Time) {
+	var oldest *proxiedKey
+	for key, announced := range t.byKey {
+		if now.Sub(announced) >= proxiedTTL {
+			delete(t.byKey, key)
+			continue
+		}
+		if oldest == nil || announced.Before(t.byKey[*oldest]) {
+			key := key
+			oldest = &key
+		}
+	}
+	if len(t.byKey) >= maxProxied {
+		delete(t.byKey, *oldest)
+	}
+}
+
+// has reports whether the device at hostport was recently announced to the
+// pool on vlan.
+func (t *proxiedTable) has(vlan uint16, hostport string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	announced, ok := t.byKey[proxiedKey{vlan, hostport}]
+	return ok && t.now().Sub(announced) < proxiedTTL
+}
+
+// Proxied reports whether the device at hostport was announced through the
+// UPnP proxy to a pool reaching the proxy at proxyIP, its upnp_proxy host.
+func (r *Reflector) Proxied(proxyIP net.IP, hostport string) bool {
+	for vlan, base := range r.state.Load().proxies {
+		if proxyIP.Equal(net.ParseIP(base.Hostname())) && r.proxied.has(vlan, hostport) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package reflector
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Reload validates cfg and atomically replaces the configuration used by the
+// packet loop. Packets already being processed finish with the previous
+// configuration. The capture interface cannot be changed without a restart.
+func (r *Reflector) Reload(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	old := r.state.Load()
+	if cfg.NetInterface != old.cfg.NetInterface || cfg.WindowsInterface != old.cfg.WindowsInterface {
+		return fmt.Errorf("changing the network interface from %q to %q requires a restart", old.cfg.NetInterface, cfg.NetInterface)
+	}
+
+	next, err := newState(cfg)
+	if err != nil {
+		return err
+	}
+	r.state.Store(next)
+
+	r.logStateDiff(old, next)
+	return nil
+}
+
+// logStateDiff logs the devices, selectors and pools added, removed or
+// changed between two configuration snapshots.
+func (r *Reflector) logStateDiff(old, next *state) {
+	var added, removed, changed []string
+	for mac, device := range next.cfg.Devices {
+		prev, ok := old.cfg.Devices[mac]
+		switch {
+		case !ok:
+			added = append(added, string(mac))
+		case !device.equal(prev):
+			changed = append(changed, string(mac))
+		}
+	}
+	for mac := range old.cfg.Devices {
+		if _, ok := next.cfg.Devices[mac]; !ok {
+			removed = append(removed, string(mac))
+		}
+	}
+
+	oldSelectors := make(map[string]Selector, len(old.cfg.Selectors))
+	for _, selector := range old.cfg.Selectors {
+		oldSelectors[selector.Name] = selector
+	}
+	nextSelectors := make(map[string]bool, len(next.cfg.Selectors))
+	for _, selector := range next.cfg.Selectors {
+		nextSelectors[selector.Name] = true
+		prev, ok := oldSelectors[selector.Name]
+		switch {
+		case !ok:
+			added = append(added, "selector "+selector.Name)
+		case !selector.equal(prev):
+			changed = append(changed, "selector "+selector.Name)
+		}
+	}
+	for name := range oldSelectors {
+		if !nextSelectors[name] {
+			removed = append(removed, "selector "+name)
+		}
+	}
+
+	var addedPools, removedPools []string
+	for name, pool := range next.cfg.Pools {
+		prev, ok := old.cfg.Pools[name]
+		switch {
+		case !ok:
+			addedPools = append(addedPools, name)
+		case !pool.equal(prev):
+			changed = append(changed, "pool "+name)
+		}
+	}
+	for name := range old.cfg.Pools {
+		if _, ok := next.cfg.Pools[name]; !ok {
+			removedPools = append(removedPools, name)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	sort.Strings(addedPools)
+	sort.Strings(removedPools)
+
+	r.logger.Info("Configuration reloaded",
+		"added", added,
+		"removed", removed,
+		"changed", changed,
+		"pools_added", addedPools,
+		"pools_removed", removedPools,
+		"routed_vlans", next.routes.vlans(),
+	)
+}
+
+func (d Device) equal(other Device) bool {
+	if d.OriginPool != other.OriginPool || len(d.SharedPools) != len(other.SharedPools) {
+		return false
+	}
+	for i := range d.SharedPools {
+		if d.SharedPools[i] != other.SharedPools[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) equal(other Selector) bool {
+	return s.CIDR == other.CIDR &&
+		s.Hostname == other.Hostname &&
+		s.MDNSInstance == other.MDNSInstance &&
+		s.MDNSService == other.MDNSService &&
+		s.USNPrefix == other.USNPrefix &&
+		s.Device.equal(other.Device)
+}
+
+func (p Pool) equal(other Pool) bool {
+	if p.VLAN != other.VLAN || p.Description != other.Description || p.UPnPProxy != other.UPnPProxy ||
+		p.DNSDomain != other.DNSDomain || p.MDNSInterface != other.MDNSInterface || len(p.Share) != len(other.Share) {
+		return false
+	}
+	for i := range p.Share {
+		if !equalStrings(p.Share[i].To, other.Share[i].To) || !equalStrings(p.Share[i].Protocols, other.Share[i].Protocols) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package reflector
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func reloadConfig() *Config {
+	return &Config{
+		NetInterface: "lo",
+		Pools: map[string]Pool{
+			"iot":   {VLAN: 30, Share: []ShareRule{{To: []string{"home"}}}},
+			"home":  {VLAN: 10},
+			"guest": {VLAN: 40},
+		},
+		Devices: map[MacAddress]Device{
+			"00:00:00:00:00:01": {OriginPool: 30, SharedPools: []uint16{10}},
+			"00:00:00:00:00:02": {OriginPool: 30, SharedPools: []uint16{10}},
+		},
+	}
+}
+
+func TestReloadKeepsStateOnFailure(t *testing.T) {
+	r, err := New(reloadConfig(), WithLogger(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := r.state.Load()
+
+	invalid := reloadConfig()
+	invalid.Pools["guest"] = Pool{VLAN: 4095}
+	if err := r.Reload(invalid); err == nil {
+		t.Error("Reload of an invalid configuration = nil, want an error")
+	}
+	otherInterface := reloadConfig()
+	otherInterface.NetInterface = "eth9"
+	if err := r.Reload(otherInterface); err == nil {
+		t.Error("Reload changing the interface = nil, want an error")
+	}
+	if r.state.Load() != old {
+		t.Error("failed reload replaced the configuration")
+	}
+
+	if err := r.Reload(reloadConfig()); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if r.state.Load() == old {
+		t.Error("Reload kept the previous configuration")
+	}
+}
+
+func TestReloadLogsDiff(t *testing.T) {
+	var logs bytes.Buffer
+	r, err := New(reloadConfig(), WithLogger(slog.New(slog.NewJSONHandler(&logs, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := reloadConfig()
+	delete(next.Devices, "00:00:00:00:00:01")
+	next.Devices["00:00:00:00:00:02"] = Device{OriginPool: 30, SharedPools: []uint16{10, 40}}
+	next.Devices["00:00:00:00:00:03"] = Device{OriginPool: 10, SharedPools: []uint16{30}}
+	next.Pools["iot"] = Pool{VLAN: 30, Share: []ShareRule{{To: []string{"office", "guest"}}}}
+	delete(next.Pools, "home")
+	next.Pools["office"] = Pool{VLAN: 10}
+	next.Selectors = []Selector{{Name: "tv", Hostname: "tv", Device: Device{OriginPool: 40, SharedPools: []uint16{10}}}}
+	if err := r.Reload(next); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	var entry struct {
+		Msg          string   `json:"msg"`
+		Added        []string `json:"added"`
+		Removed      []string `json:"removed"`
+		Changed      []string `json:"changed"`
+		PoolsAdded   []string `json:"pools_added"`
+		PoolsRemoved []string `json:"pools_removed"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("log %s: %v", logs.String(), err)
+	}
+	for _, tt := range []struct {
+		name      string
+		got, want []string
+	}{
+		{"added", entry.Added, []string{"00:00:00:00:00:03", "selector tv"}},
+		{"removed", entry.Removed, []string{"00:00:00:00:00:01"}},
+		{"changed", entry.Changed, []string{"00:00:00:00:00:02", "pool iot"}},
+		{"pools_added", entry.PoolsAdded, []string{"office"}},
+		{"pools_removed", entry.PoolsRemoved, []string{"home"}},
+	} {
+		if !equalStrings(tt.got, tt.want) {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+	if entry.Msg != "Configuration reloaded" {
+		t.Errorf("logged %q", entry.Msg)
+	}
+}
@@ -0,0 +1,135 @@
+package reflector
+
+import (
+	"sort"
+	"strings"
+)
+
+// protocols lists the protocols that are reflected between VLANs.
+var protocols = []string{protocolMDNS, protocolSSDP}
+
+// routeKey identifies the VLAN and protocol a packet was captured on.
+type routeKey struct {
+	vlan     uint16
+	protocol string
+}
+
+// routeTable holds the VLANs each packet is forwarded to. It is built from
+// the pool sharing rules and the per-device entries of a configuration.
+type routeTable struct {
+	// queries maps the VLAN a query was sent on to the VLANs whose services
+	// it may discover.
+	queries map[routeKey][]uint16
+	// announcements maps the VLAN a response or announcement was sent on to
+	// the VLANs it is shared with, for devices without their own entry.
+	announcements map[routeKey][]uint16
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		queries:       make(map[routeKey][]uint16),
+		announcements: make(map[routeKey][]uint16),
+	}
+}
+
+// buildRoutes derives the route table from cfg. Pool rules apply to every
+// device on the pool VLAN; device entries add query routes from each of their
+// shared pools back to their origin pool.
+func buildRoutes(cfg *Config, devices []Device) *routeTable {
+	routes := newRouteTable()
+
+	for _, pool := range cfg.Pools {
+		for _, rule := range pool.Share {
+			for _, protocol := range rule.protocols() {
+				for _, name := range rule.To {
+					target, ok := cfg.Pools[name]
+					if !ok {
+						continue
+					}
+					routes.add(routes.announcements, routeKey{pool.VLAN, protocol}, target.VLAN)
+					routes.add(routes.queries, routeKey{target.VLAN, protocol}, pool.VLAN)
+				}
+			}
+		}
+	}
+
+	for _, device := range devices {
+		for _, pool := range device.SharedPools {
+			for _, protocol := range protocols {
+				routes.add(routes.queries, routeKey{pool, protocol}, device.OriginPool)
+			}
+		}
+	}
+
+	return routes
+}
+
+func (t *routeTable) add(m map[routeKey][]uint16, key routeKey, vlan uint16) {
+	for _, v := range m[key] {
+		if v == vlan {
+			return
+		}
+	}
+	m[key] = append(m[key], vlan)
+}
+
+// explainMiss returns the action and reason recorded for a packet without a
+// route for key.
+func (t *routeTable) explainMiss(key routeKey) (string, string) {
+	for _, protocol := range protocols {
+		if protocol == key.protocol {
+			continue
+		}
+		other := routeKey{vlan: key.vlan, protocol: protocol}
+		if _, ok := t.queries[other]; ok {
+			return ActionFiltered, key.protocol + " is not shared from this VLAN"
+		}
+		if _, ok := t.announcements[other]; ok {
+			return ActionFiltered, key.protocol + " is not shared from this VLAN"
+		}
+	}
+	return ActionNoMapping, "no route for VLAN"
+}
+
+// vlans returns the sorted set of VLANs that take part in any route.
+func (t *routeTable) vlans() []uint16 {
+	seen := make(map[uint16]bool)
+	for _, m := range []map[routeKey][]uint16{t.queries, t.announcements} {
+		for key, targets := range m {
+			seen[key.vlan] = true
+			for _, vlan := range targets {
+				seen[vlan] = true
+			}
+		}
+	}
+	vlans := make([]uint16, 0, len(seen))
+	for vlan := range seen {
+		vlans = append(vlans, vlan)
+	}
+	sort.Slice(vlans, func(i, j int) bool { return vlans[i] < vlans[j] })
+	return vlans
+}
+
+// protocols returns the canonical names of the protocols the rule applies
+// to. An empty list means every protocol.
+func (r ShareRule) protocols() []string {
+	if len(r.Protocols) == 0 {
+		return protocols
+	}
+	var result []string
+	for _, p := range r.Protocols {
+		if canonical, ok := canonicalProtocol(p); ok {
+			result = append(result, canonical)
+		}
+	}
+	return result
+}
+
+func canonicalProtocol(name string) (string, bool) {
+	for _, p := range protocols {
+		if strings.EqualFold(p, name) {
+			return p, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,96 @@
+package reflector
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// selectorMatcher is a Selector with its criteria parsed and normalized.
+type selectorMatcher struct {
+	Selector
+
+	ipNet    *net.IPNet
+	hostname string
+	instance string
+	service  string
+}
+
+func compileSelector(s Selector) (*selectorMatcher, error) {
+	m := &selectorMatcher{
+		Selector: s,
+		hostname: normalizeName(s.Hostname),
+		instance: normalizeName(s.MDNSInstance),
+		service:  normalizeName(s.MDNSService),
+	}
+	if s.CIDR != "" {
+		_, ipNet, err := net.ParseCIDR(s.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		m.ipNet = ipNet
+	}
+	if m.ipNet == nil && m.hostname == "" && m.instance == "" && m.service == "" && s.USNPrefix == "" {
+		return nil, errors.New("at least one of cidr, hostname, mdns_instance, mdns_service or ssdp_usn_prefix is required")
+	}
+	return m, nil
+}
+
+// matches reports whether the sender of p satisfies every criterion of the
+// selector. learnedHostname is the hostname previously seen for the sender's
+// MAC address, if any.
+func (m *selectorMatcher) matches(p *packet, learnedHostname string) bool {
+	if m.ipNet != nil && (p.srcIP == nil || !m.ipNet.Contains(p.srcIP)) {
+		return false
+	}
+	if m.hostname != "" && m.hostname != learnedHostname && !contains(p.hostnames, m.hostname) {
+		return false
+	}
+	if m.instance != "" && !m.matchesInstance(p.instances) {
+		return false
+	}
+	if m.service != "" && !contains(p.services, m.service) {
+		return false
+	}
+	if m.USNPrefix != "" && !strings.HasPrefix(p.usn, m.USNPrefix) {
+		return false
+	}
+	return true
+}
+
+// matchesInstance accepts either a full instance name or only its leading
+// instance label.
+func (m *selectorMatcher) matchesInstance(instances []string) bool {
+	for _, instance := range instances {
+		if instance == m.instance || strings.HasPrefix(instance, m.instance+"._") {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupDevice returns the device configuration for the sender of p. Devices
+// configured by MAC address take precedence over selectors, which are tried
+// in order.
+func (s *state) lookupDevice(p *packet, learnedHostname string) (Device, string, bool) {
+	mac := MacAddress(p.srcMAC.String())
+	if device, ok := s.cfg.Devices[mac]; ok {
+		return device, string(mac), true
+	}
+	for _, m := range s.selectors {
+		if m.matches(p, learnedHostname) {
+			return m.Device, fmt.Sprintf("selector %q", m.Name), true
+		}
+	}
+	return Device{}, "", false
+}
@@ -2,22 +2,192 @@ package reflector
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/url"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/home-sol/multicast-proxy/pkg/net/netwatch"
+	"github.com/home-sol/multicast-proxy/pkg/net/ssdp"
 )
 
-func Serve(ctx context.Context, cfg *Config) error {
-	poolsMap := mapByPool(cfg.Devices)
+// Reflector copies mDNS and SSDP packets between VLANs according to its
+// configuration. The configuration can be swapped with Reload while Serve is
+// running.
+type Reflector struct {
+	state     atomic.Pointer[state]
+	devices   *deviceTable
+	decisions *decisionLog
+	proxied   *proxiedTable
+	registry  *ssdp.Registry
+	logger    *slog.Logger
+	watcher   *netwatch.Watcher
+	observer  func(vlan uint16, msg *layers.DNS)
+	dryRun    bool
+}
+
+// Option configures a Reflector.
+type Option func(*Reflector)
+
+// WithLogger sets the logger used by the Reflector. Forwarding decisions for
+// every packet are logged at debug level.
+func WithLogger(logger *slog.Logger) Option {
+	return func(r *Reflector) {
+		r.logger = logger
+	}
+}
+
+// WithDecisionHistory sets how many forwarding decisions are kept for
+// Decisions. It defaults to DefaultDecisionHistory.
+func WithDecisionHistory(size int) Option {
+	return func(r *Reflector) {
+		r.decisions = newDecisionLog(size)
+	}
+}
+
+// WithDryRun makes the Reflector record its decisions without sending any
+// packet, for tracing.
+func WithDryRun() Option {
+	return func(r *Reflector) {
+		r.dryRun = true
+	}
+}
+
+// WithRegistry feeds captured SSDP NOTIFY messages into reg.
+func WithRegistry(reg *ssdp.Registry) Option {
+	return func(r *Reflector) {
+		r.registry = reg
+	}
+}
+
+// WithWatcher reopens the capture when w reports that the interface was
+// recreated or came back up.
+func WithWatcher(w *netwatch.Watcher) Option {
+	return func(r *Reflector) {
+		r.watcher = w
+	}
+}
+
+// WithMDNSObserver passes every captured mDNS response to observe, with the
+// VLAN it was captured on. observe is called from the packet loop and must not
+// block.
+func WithMDNSObserver(observe func(vlan uint16, msg *layers.DNS)) Option {
+	return func(r *Reflector) {
+		r.observer = observe
+	}
+}
+
+// state is an immutable snapshot of the configuration used by the packet
+// loop. It is replaced as a whole on reload.
+type state struct {
+	cfg       *Config
+	selectors []*selectorMatcher
+	routes    *routeTable
+	// proxies holds the UPnP proxy base URL of pools that have one, by VLAN.
+	proxies map[uint16]*url.URL
+}
+
+func newState(cfg *Config) (*state, error) {
+	devices := make([]Device, 0, len(cfg.Devices)+len(cfg.Selectors))
+	for _, device := range cfg.Devices {
+		devices = append(devices, device)
+	}
 
-	return serve(ctx, cfg, poolsMap)
+	selectors := make([]*selectorMatcher, 0, len(cfg.Selectors))
+	for _, s := range cfg.Selectors {
+		m, err := compileSelector(s)
+		if err != nil {
+			return nil, fmt.Errorf("selector %q: %w", s.Name, err)
+		}
+		selectors = append(selectors, m)
+		devices = append(devices, s.Device)
+	}
+
+	proxies := make(map[uint16]*url.URL)
+	for name, pool := range cfg.Pools {
+		if pool.UPnPProxy == "" {
+			continue
+		}
+		u, err := parseProxyURL(pool.UPnPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: upnp_proxy: %w", name, err)
+		}
+		proxies[pool.VLAN] = u
+	}
+
+	return &state{
+		cfg:       cfg,
+		selectors: selectors,
+		routes:    buildRoutes(cfg, devices),
+		proxies:   proxies,
+	}, nil
+}
+
+// New validates cfg and creates a Reflector for it.
+func New(cfg *Config, opts ...Option) (*Reflector, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	st, err := newState(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reflector{
+		devices:   newDeviceTable(),
+		decisions: newDecisionLog(DefaultDecisionHistory),
+		proxied:   newProxiedTable(),
+		logger:    slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.state.Store(st)
+	return r, nil
+}
+
+// Serve creates a Reflector for cfg and runs it until ctx is cancelled.
+func Serve(ctx context.Context, cfg *Config, opts ...Option) error {
+	r, err := New(cfg, opts...)
+	if err != nil {
+		return err
+	}
+	return r.Serve(ctx)
+}
+
+// reopenInterval is how long to wait between attempts to reopen a lost
+// capture when no interface change is reported.
+const reopenInterval = 5 * time.Second
+
+// errInterfaceChanged ends a capture when the interface was recreated or came
+// back up, since the capture handle may no longer receive packets.
+var errInterfaceChanged = errors.New("interface changed")
+
+// capture is an open packet capture on the configured interface.
+type capture struct {
+	handle  *pcap.Handle
+	mac     net.HardwareAddr
+	packets chan packet
 }
 
-func serve(ctx context.Context, cfg *Config, poolsMap map[uint16][]uint16) error {
+func (c *capture) close() {
+	c.handle.Close()
+	// Unblock the decoding goroutine until the closed handle ends it.
+	go func() {
+		for range c.packets {
+		}
+	}()
+}
+
+// openCapture opens a capture of the tagged mDNS, SSDP and DHCP traffic on
+// the configured interface.
+func (r *Reflector) openCapture() (*capture, error) {
+	cfg := r.state.Load().cfg
 	pcapIntername := cfg.NetInterface
 
 	// Windows specific override
@@ -27,77 +197,204 @@ func serve(ctx context.Context, cfg *Config, poolsMap map[uint16][]uint16) error
 	// Get a handle on the network interface
 	rawTraffic, err := pcap.OpenLive(pcapIntername, 65536, true, time.Second)
 	if err != nil {
-		return fmt.Errorf("could not open socket on network interface %s: %w", cfg.NetInterface, err)
+		return nil, fmt.Errorf("could not open socket on network interface %s: %w", cfg.NetInterface, err)
 	}
 
 	// Get the local MAC address, to filter out Bonjour packet generated locally
 	intf, err := net.InterfaceByName(cfg.NetInterface)
 	if err != nil {
-		return err
+		rawTraffic.Close()
+		return nil, err
 	}
 
 	intfMACAddress := intf.HardwareAddr
 
 	// Filter tagged bonjour traffic
-	filterTemplate := "not (ether src %s) and vlan and ((dst net (239.255.255.250 or ff02::c) and udp dst port 1900) or (dst net (224.0.0.251 or ff02::fb) and udp dst port 5353))"
+	filterTemplate := "not (ether src %s) and vlan and ((dst net (239.255.255.250 or ff02::c) and udp dst port 1900) or (dst net (224.0.0.251 or ff02::fb) and udp dst port 5353) or (udp src port 68 and udp dst port 67))"
 	err = rawTraffic.SetBPFFilter(fmt.Sprintf(filterTemplate, intfMACAddress))
 	if err != nil {
-		log.Fatalf("Could not apply filter on network interface: %v", err)
+		rawTraffic.Close()
+		return nil, fmt.Errorf("could not apply filter on network interface %s: %w", cfg.NetInterface, err)
 	}
 
 	// Get a channel of Bonjour packets to process
 	decoder := gopacket.DecodersByLayerName["Ethernet"]
 	source := gopacket.NewPacketSource(rawTraffic, decoder)
-	packets := parsePacketsLazily(source)
+	return &capture{
+		handle:  rawTraffic,
+		mac:     intfMACAddress,
+		packets: parsePacketsLazily(source),
+	}, nil
+}
+
+// Serve captures packets on the configured interface and reflects them until
+// ctx is cancelled. If the capture is lost, or the interface is recreated or
+// comes back up as reported by the watcher set with WithWatcher, the capture
+// is reopened.
+func (r *Reflector) Serve(ctx context.Context) error {
+	name := r.state.Load().cfg.NetInterface
+
+	// A nil channel never reports changes.
+	var events <-chan netwatch.Event
+	if r.watcher != nil {
+		var unsubscribe func()
+		events, unsubscribe = r.watcher.Subscribe(64)
+		defer unsubscribe()
+	}
+
+	c, err := r.openCapture()
+	if err != nil {
+		return err
+	}
+	r.logger.Info("Reflecting multicast traffic", "interface", name)
+	for {
+		err := r.reflect(ctx, c, events)
+		c.close()
+		if ctx.Err() != nil {
+			return nil
+		}
+		r.logger.Warn("Capture interrupted, reopening", "interface", name, "reason", err)
+
+		for {
+			if c, err = r.openCapture(); err == nil {
+				break
+			}
+			r.logger.Warn("Could not reopen capture", "interface", name, "error", err)
+			timer := time.NewTimer(reopenInterval)
+		wait:
+			for {
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil
+				case <-timer.C:
+					break wait
+				case event := <-events:
+					if event.Interface.Name == name && event.Joinable() {
+						timer.Stop()
+						break wait
+					}
+				}
+			}
+		}
+		r.logger.Info("Reopened capture", "interface", name)
+	}
+}
+
+// reflect processes the packets of c until ctx is cancelled, the capture
+// ends, or events report that the interface changed.
+func (r *Reflector) reflect(ctx context.Context, c *capture, events <-chan netwatch.Event) error {
+	packets := c.packets
+	rawTraffic := c.handle
+	intfMACAddress := c.mac
+	name := r.state.Load().cfg.NetInterface
 
 	// Process packets
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case packet := <-packets:
+		case event := <-events:
+			if event.Interface.Name != name {
+				continue
+			}
+			switch event.Type {
+			case netwatch.InterfaceAdded, netwatch.InterfaceUp:
+				return errInterfaceChanged
+			}
+		case packet, ok := <-packets:
+			if !ok {
+				return errors.New("capture ended")
+			}
+			packetBacklog.Set(float64(len(packets)))
+			// Load the current snapshot once per packet, so a concurrent
+			// reload never exposes a half-updated configuration.
+			st := r.state.Load()
+
+			deviceMacAddr := MacAddress(packet.srcMAC.String())
+			if packet.ownHostname != "" {
+				r.devices.learnHostname(deviceMacAddr, packet.ownHostname)
+			}
+			switch packet.protocol {
+			case protocolDHCP:
+				// DHCP requests are only captured to learn hostnames.
+				continue
+			case "":
+				decodeFailures.Inc()
+				continue
+			}
+			packetsCaptured.WithLabelValues(packet.protocol, vlanLabel(*packet.vlanTag)).Inc()
+			if r.registry != nil && packet.protocol == protocolSSDP && !packet.isQuery {
+				r.registerSSDP(&packet)
+			}
+			if r.observer != nil && packet.protocol == protocolMDNS && !packet.isQuery && packet.dns != nil {
+				r.observer(*packet.vlanTag, packet.dns)
+			}
+
 			var vlanTags []uint16
 			var hasVlanMapping bool
+			var matchedBy string
 
+			key := routeKey{vlan: *packet.vlanTag, protocol: packet.protocol}
 			if packet.isQuery {
-				vlanTags, hasVlanMapping = poolsMap[*packet.vlanTag]
+				vlanTags, hasVlanMapping = st.routes.queries[key]
 			} else {
 				var device Device
-				deviceMacAddr := MacAddress(packet.srcMAC.String())
-				device, hasVlanMapping = cfg.Devices[deviceMacAddr]
+				device, matchedBy, hasVlanMapping = st.lookupDevice(&packet, r.devices.hostname(deviceMacAddr))
+				r.devices.seen(deviceMacAddr, &packet, matchedBy)
 				if hasVlanMapping {
 					vlanTags = device.SharedPools
+				} else {
+					vlanTags, hasVlanMapping = st.routes.announcements[key]
 				}
 			}
 
+			decision := newDecision(&packet, *packet.vlanTag)
+			decision.MatchedBy = matchedBy
 			if !hasVlanMapping {
+				decision.Action, decision.Reason = st.routes.explainMiss(key)
+				r.decisions.add(decision)
+				r.logger.Debug("No route for packet", "packet", packet, "reason", decision.Reason)
+				packetsDropped.WithLabelValues(packet.protocol, vlanLabel(*packet.vlanTag)).Inc()
 				continue
 			}
-			fmt.Printf("%s -> Fwd VLANs: %v\n", packet, vlanTags)
-			for _, tag := range vlanTags {
-				if err := sendPacket(rawTraffic, &packet, tag, intfMACAddress); err != nil {
-					log.Printf("Could not send packet to VLAN %d: %v", tag, err)
-				}
+			decision.Action = ActionForwarded
+			decision.VLANs = vlanTags
+			decision.DryRun = r.dryRun
+			switch {
+			case packet.isQuery:
+				decision.Reason = "query route"
+			case matchedBy != "":
+				decision.Reason = "device " + matchedBy
+			default:
+				decision.Reason = "pool sharing rule"
 			}
-		}
-	}
-
-	return nil
-}
-
-func mapByPool(devices map[MacAddress]Device) map[uint16][]uint16 {
-	seen := make(map[uint16]map[uint16]bool)
-	poolsMap := make(map[uint16][]uint16)
-	for _, device := range devices {
-		for _, pool := range device.SharedPools {
-			if _, ok := seen[pool]; !ok {
-				seen[pool] = make(map[uint16]bool)
+			r.decisions.add(decision)
+			if matchedBy != "" {
+				deviceLastSeen.WithLabelValues(matchedBy).SetToCurrentTime()
 			}
-			if _, ok := seen[pool][device.OriginPool]; !ok {
-				seen[pool][device.OriginPool] = true
-				poolsMap[pool] = append(poolsMap[pool], device.OriginPool)
+			r.logger.Debug("Forwarding packet", "packet", packet, "vlans", vlanTags, "matched_by", matchedBy)
+			if r.dryRun {
+				continue
+			}
+			srcVLAN := vlanLabel(*packet.vlanTag)
+			var location string
+			var isOwnLocation bool
+			if packet.protocol == protocolSSDP && !packet.isQuery {
+				location, isOwnLocation = ownLocation(&packet)
+			}
+			for _, tag := range vlanTags {
+				proxy := st.proxies[tag]
+				if err := sendPacket(rawTraffic, &packet, tag, intfMACAddress, proxy); err != nil {
+					sendErrors.WithLabelValues(packet.protocol, vlanLabel(tag)).Inc()
+					r.logger.Warn("Could not send packet", "vlan", tag, "error", err)
+					continue
+				}
+				if proxy != nil && isOwnLocation {
+					r.proxied.add(tag, location)
+				}
+				packetsForwarded.WithLabelValues(packet.protocol, srcVLAN, vlanLabel(tag)).Inc()
 			}
 		}
 	}
-	return poolsMap
 }
@@ -0,0 +1,314 @@
+package reflector
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultDecisionHistory is the number of forwarding decisions kept for
+// inspection when no other size is configured.
+const DefaultDecisionHistory = 256
+
+// Forwarding actions recorded in a Decision.
+const (
+	ActionForwarded = "forwarded"
+	ActionNoMapping = "no_mapping"
+	ActionFiltered  = "filtered"
+)
+
+// Decision records what the reflector did with a captured packet.
+type Decision struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"`
+	VLAN     uint16    `json:"vlan"`
+	SrcMAC   string    `json:"src_mac"`
+	SrcIP    string    `json:"src_ip"`
+	DstIP    string    `json:"dst_ip"`
+	Query    bool      `json:"query"`
+	Queries  []string  `json:"queries,omitempty"`
+	// Names are the host names, service instances and USN announced by the
+	// sender.
+	Names     []string `json:"names,omitempty"`
+	Action    string   `json:"action"`
+	Reason    string   `json:"reason"`
+	MatchedBy string   `json:"matched_by,omitempty"`
+	VLANs     []uint16 `json:"vlans,omitempty"`
+	// DryRun is set when the packet was not actually sent.
+	DryRun bool `json:"dry_run,omitempty"`
+	// Data is the captured frame, as received. It is shared with the
+	// capture and must not be modified.
+	Data []byte `json:"data,omitempty"`
+}
+
+// KnownDevice describes a sender seen by the reflector.
+type KnownDevice struct {
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip,omitempty"`
+	VLAN      uint16    `json:"vlan"`
+	Hostname  string    `json:"hostname,omitempty"`
+	MatchedBy string    `json:"matched_by,omitempty"`
+	Protocols []string  `json:"protocols"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Route lists the VLANs packets captured on a VLAN are forwarded to.
+type Route struct {
+	// Kind is "query" for queries and "announcement" for responses and
+	// announcements of devices without their own entry.
+	Kind     string   `json:"kind"`
+	Protocol string   `json:"protocol"`
+	VLAN     uint16   `json:"vlan"`
+	To       []uint16 `json:"to"`
+}
+
+const (
+	// deviceTTL is how long a device is remembered after it was last seen or
+	// announced its hostname.
+	deviceTTL = 24 * time.Hour
+	// maxDevices bounds the number of devices remembered; the least recently
+	// updated ones are forgotten first.
+	maxDevices = 4096
+)
+
+// deviceTable remembers the senders seen by the reflector, including the
+// last hostname they announced through DHCP requests or mDNS address records
+// for their own address. Entries expire after deviceTTL.
+type deviceTable struct {
+	lock  sync.RWMutex
+	byMAC map[MacAddress]*deviceEntry
+	now   func() time.Time
+}
+
+type deviceEntry struct {
+	KnownDevice
+	// updated is when the device was last seen or learnt a hostname.
+	updated time.Time
+}
+
+func newDeviceTable() *deviceTable {
+	return &deviceTable{byMAC: make(map[MacAddress]*deviceEntry), now: time.Now}
+}
+
+// getLocked returns the entry of mac, creating it if needed, and marks it
+// updated.
+func (t *deviceTable) getLocked(mac MacAddress, now time.Time) *deviceEntry {
+	d, ok := t.byMAC[mac]
+	if !ok || now.Sub(d.updated) >= deviceTTL {
+		if !ok && len(t.byMAC) >= maxDevices {
+			t.evictLocked(now)
+		}
+		d = &deviceEntry{KnownDevice: KnownDevice{MAC: string(mac)}}
+		t.byMAC[mac] = d
+	}
+	d.updated = now
+	return d
+}
+
+// evictLocked drops the expired entries, or the least recently updated one
+// if none has expired.
+func (t *deviceTable) evictLocked(now time.Time) {
+	var oldest MacAddress
+	for mac, d := range t.byMAC {
+		if now.Sub(d.updated) >= deviceTTL {
+			delete(t.byMAC, mac)
+			continue
+		}
+		if oldest == "" || d.updated.Before(t.byMAC[oldest].updated) {
+			oldest = mac
+		}
+	}
+	if len(t.byMAC) >= maxDevices {
+		delete(t.byMAC, oldest)
+	}
+}
+
+func (t *deviceTable) learnHostname(mac MacAddress, hostname string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.getLocked(mac, t.now()).Hostname = normalizeName(hostname)
+}
+
+func (t *deviceTable) hostname(mac MacAddress) string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if d, ok := t.byMAC[mac]; ok && t.now().Sub(d.updated) < deviceTTL {
+		return d.Hostname
+	}
+	return ""
+}
+
+func (t *deviceTable) seen(mac MacAddress, p *packet, matchedBy string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	d := t.getLocked(mac, now)
+	d.IP = ipString(p.srcIP)
+	d.VLAN = *p.vlanTag
+	d.MatchedBy = matchedBy
+	d.Protocols = appendUnique(d.Protocols, p.protocol)
+	d.LastSeen = now
+}
+
+func (t *deviceTable) list() []KnownDevice {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	now := t.now()
+	devices := make([]KnownDevice, 0, len(t.byMAC))
+	for _, d := range t.byMAC {
+		if d.LastSeen.IsZero() || now.Sub(d.updated) >= deviceTTL {
+			// Only known through DHCP so far, or forgotten.
+			continue
+		}
+		device := d.KnownDevice
+		device.Protocols = append([]string(nil), d.Protocols...)
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].MAC < devices[j].MAC })
+	return devices
+}
+
+// decisionLog is a ring buffer of the most recent forwarding decisions. New
+// decisions are also passed to subscribers.
+type decisionLog struct {
+	lock        sync.Mutex
+	decisions   []Decision
+	next        int
+	full        bool
+	subscribers map[chan Decision]struct{}
+}
+
+func newDecisionLog(size int) *decisionLog {
+	if size <= 0 {
+		size = DefaultDecisionHistory
+	}
+	return &decisionLog{
+		decisions:   make([]Decision, size),
+		subscribers: make(map[chan Decision]struct{}),
+	}
+}
+
+func (l *decisionLog) add(d Decision) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.decisions[l.next] = d
+	l.next = (l.next + 1) % len(l.decisions)
+	if l.next == 0 {
+		l.full = true
+	}
+	for c := range l.subscribers {
+		select {
+		case c <- d:
+		default:
+			// Never block the packet loop on a slow subscriber.
+		}
+	}
+}
+
+func (l *decisionLog) subscribe(buffer int) (<-chan Decision, func()) {
+	c := make(chan Decision, buffer)
+	l.lock.Lock()
+	l.subscribers[c] = struct{}{}
+	l.lock.Unlock()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			l.lock.Lock()
+			delete(l.subscribers, c)
+			l.lock.Unlock()
+		})
+	}
+}
+
+// list returns the recorded decisions, oldest first.
+func (l *decisionLog) list() []Decision {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.full {
+		return append([]Decision{}, l.decisions[:l.next]...)
+	}
+	result := make([]Decision, 0, len(l.decisions))
+	result = append(result, l.decisions[l.next:]...)
+	return append(result, l.decisions[:l.next]...)
+}
+
+func newDecision(p *packet, vlan uint16) Decision {
+	var names []string
+	names = append(names, p.hostnames...)
+	names = append(names, p.instances...)
+	if p.usn != "" {
+		names = append(names, p.usn)
+	}
+	return Decision{
+		Time:     p.packet.Metadata().Timestamp,
+		Protocol: p.protocol,
+		VLAN:     vlan,
+		SrcMAC:   p.srcMAC.String(),
+		SrcIP:    ipString(p.srcIP),
+		DstIP:    ipString(p.dstIP),
+		Query:    p.isQuery,
+		Queries:  p.queries,
+		Names:    names,
+		// Captured frames are never modified, so the frame is referenced
+		// rather than copied for every packet.
+		Data: p.packet.Data(),
+	}
+}
+
+// Config returns the configuration currently in use.
+func (r *Reflector) Config() *Config {
+	return r.state.Load().cfg
+}
+
+// Routes returns the route table derived from the current configuration.
+func (r *Reflector) Routes() []Route {
+	routes := r.state.Load().routes
+	result := []Route{}
+	for kind, m := range map[string]map[routeKey][]uint16{"query": routes.queries, "announcement": routes.announcements} {
+		for key, to := range m {
+			result = append(result, Route{
+				Kind:     kind,
+				Protocol: key.protocol,
+				VLAN:     key.vlan,
+				To:       append([]uint16(nil), to...),
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.VLAN != b.VLAN {
+			return a.VLAN < b.VLAN
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Protocol < b.Protocol
+	})
+	return result
+}
+
+// Devices returns the senders seen recently.
+func (r *Reflector) Devices() []KnownDevice {
+	return r.devices.list()
+}
+
+// Decisions returns the most recent forwarding decisions, oldest first.
+func (r *Reflector) Decisions() []Decision {
+	return r.decisions.list()
+}
+
+// SubscribeDecisions returns a channel receiving every new forwarding
+// decision, and a function to unsubscribe. Decisions are dropped while the
+// channel buffer is full.
+func (r *Reflector) SubscribeDecisions(buffer int) (<-chan Decision, func()) {
+	return r.decisions.subscribe(buffer)
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
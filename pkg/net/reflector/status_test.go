@@ -0,0 +1,75 @@
+package reflector
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestDeviceTableExpiry(t *testing.T) {
+	now := time.Now()
+	table := newDeviceTable()
+	table.now = func() time.Time { return now }
+
+	vlan := uint16(10)
+	table.learnHostname("00:00:00:00:00:01", "printer.local")
+	table.seen("00:00:00:00:00:01", &packet{vlanTag: &vlan, protocol: protocolMDNS}, "")
+	if got := table.hostname("00:00:00:00:00:01"); got != "printer" {
+		t.Fatalf("hostname = %q, want printer", got)
+	}
+
+	now = now.Add(deviceTTL)
+	if got := table.hostname("00:00:00:00:00:01"); got != "" {
+		t.Errorf("hostname after TTL = %q, want none", got)
+	}
+	if got := table.list(); len(got) != 0 {
+		t.Errorf("list after TTL = %v, want none", got)
+	}
+}
+
+func TestDeviceTableEvictsOldest(t *testing.T) {
+	now := time.Now()
+	table := newDeviceTable()
+	table.now = func() time.Time { return now }
+
+	for i := 0; i < maxDevices; i++ {
+		now = now.Add(time.Millisecond)
+		table.learnHostname(MacAddress(fmt.Sprintf("host-%d", i)), fmt.Sprintf("host-%d", i))
+	}
+	table.learnHostname("new", "new")
+	if len(table.byMAC) != maxDevices {
+		t.Errorf("table holds %d devices, want %d", len(table.byMAC), maxDevices)
+	}
+	if got := table.hostname("host-0"); got != "" {
+		t.Errorf("oldest device kept with hostname %q", got)
+	}
+	if got := table.hostname("new"); got != "new" {
+		t.Errorf("new device hostname = %q, want new", got)
+	}
+}
+
+func TestOwnHostname(t *testing.T) {
+	src := net.ParseIP("10.0.0.5").To4()
+	for _, tt := range []struct {
+		name string
+		ip   net.IP
+		want string
+	}{
+		{"own address", src, "printer"},
+		{"other address", net.ParseIP("10.0.0.6").To4(), ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &packet{srcIP: src}
+			parseMDNSRecord(layers.DNSResourceRecord{Name: []byte("printer.local"), Type: layers.DNSTypeA, IP: tt.ip}, p)
+			if p.ownHostname != tt.want {
+				t.Errorf("ownHostname = %q, want %q", p.ownHostname, tt.want)
+			}
+			if len(p.hostnames) != 1 || p.hostnames[0] != "printer" {
+				t.Errorf("hostnames = %v, want [printer]", p.hostnames)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package reflector
+
+import (
+	"regexp"
+	"strings"
+)
+
+// TraceFilter selects forwarding decisions. Zero fields match everything.
+type TraceFilter struct {
+	// Protocol is "mdns" or "ssdp", compared case-insensitively.
+	Protocol string
+	// VLAN is the VLAN the packet was captured on.
+	VLAN uint16
+	// SrcMAC is the sender's MAC address.
+	SrcMAC MacAddress
+	// Name matches any queried or announced name.
+	Name *regexp.Regexp
+}
+
+// Match reports whether d satisfies every criterion of the filter.
+func (f *TraceFilter) Match(d *Decision) bool {
+	if f.Protocol != "" && !strings.EqualFold(f.Protocol, d.Protocol) {
+		return false
+	}
+	if f.VLAN != 0 && f.VLAN != d.VLAN {
+		return false
+	}
+	if f.SrcMAC != "" && string(f.SrcMAC) != d.SrcMAC {
+		return false
+	}
+	if f.Name != nil && !matchAny(f.Name, d.Queries) && !matchAny(f.Name, d.Names) {
+		return false
+	}
+	return true
+}
+
+func matchAny(re *regexp.Regexp, names []string) bool {
+	for _, name := range names {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package reflector
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	minVLANID = 1
+	maxVLANID = 4094
+)
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid configuration: " + e.Problems[0]
+	}
+	return fmt.Sprintf("invalid configuration (%d problems):\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
+
+func (e *ValidationError) addf(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// ParseMacAddress parses s as an IEEE 802 MAC-48 address in any notation
+// accepted by net.ParseMAC and returns it in canonical lowercase,
+// colon-separated form, the same form used to look up captured packets.
+func ParseMacAddress(s string) (MacAddress, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(s))
+	if err != nil {
+		return "", err
+	}
+	if len(hw) != 6 {
+		return "", fmt.Errorf("address %s: expected 6 bytes, got %d", s, len(hw))
+	}
+	return MacAddress(hw.String()), nil
+}
+
+// Validate checks the configuration and rewrites device MAC addresses and
+// pool names into their canonical form. Pool names are lower-cased, as viper
+// does for map keys but not for the pools listed in share rules. All
+// problems are reported together in a *ValidationError.
+func (c *Config) Validate() error {
+	verr := &ValidationError{}
+
+	if c.NetInterface == "" {
+		verr.addf("net_interface is required")
+	} else if _, err := net.InterfaceByName(c.NetInterface); err != nil {
+		verr.addf("net_interface %q: %v", c.NetInterface, err)
+	}
+
+	pools := c.validatePools(verr)
+
+	devices := make(map[MacAddress]Device, len(c.Devices))
+	for _, key := range sortedMacs(c.Devices) {
+		device := c.Devices[key]
+		mac, err := ParseMacAddress(string(key))
+		if err != nil {
+			verr.addf("device %q: invalid MAC address: %v", key, err)
+			continue
+		}
+		if _, dup := devices[mac]; dup {
+			verr.addf("device %q: duplicate of %s", key, mac)
+			continue
+		}
+		device.validate(verr, "device "+string(mac))
+		devices[mac] = device
+	}
+
+	names := make(map[string]bool, len(c.Selectors))
+	for i, selector := range c.Selectors {
+		label := fmt.Sprintf("selector %q", selector.Name)
+		switch {
+		case selector.Name == "":
+			label = fmt.Sprintf("selector #%d", i+1)
+			verr.addf("%s: name is required", label)
+		case names[selector.Name]:
+			verr.addf("%s: name is used more than once", label)
+		}
+		names[selector.Name] = true
+		if _, err := compileSelector(selector); err != nil {
+			verr.addf("%s: %v", label, err)
+		}
+		selector.Device.validate(verr, label)
+	}
+
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+	c.Pools = pools
+	c.Devices = devices
+	return nil
+}
+
+// validatePools checks the pools and returns them by lower-cased name, with
+// the targets of their share rules lower-cased too.
+func (c *Config) validatePools(verr *ValidationError) map[string]Pool {
+	keys := make([]string, 0, len(c.Pools))
+	for key := range c.Pools {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pools := make(map[string]Pool, len(c.Pools))
+	for _, key := range keys {
+		name := strings.ToLower(key)
+		if _, dup := pools[name]; dup {
+			verr.addf("pool %q: duplicate of pool %q", key, name)
+			continue
+		}
+		pool := c.Pools[key]
+		pool.Share = append([]ShareRule(nil), pool.Share...)
+		for i, rule := range pool.Share {
+			to := make([]string, len(rule.To))
+			for j, target := range rule.To {
+				to[j] = strings.ToLower(target)
+			}
+			pool.Share[i].To = to
+		}
+		pools[name] = pool
+	}
+
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vlans := make(map[uint16]string, len(pools))
+	domains := make(map[string]string, len(pools))
+	for _, name := range names {
+		pool := pools[name]
+		if !validVLANID(pool.VLAN) {
+			verr.addf("pool %q: vlan %d is not a VLAN ID in range %d-%d", name, pool.VLAN, minVLANID, maxVLANID)
+		} else if other, dup := vlans[pool.VLAN]; dup {
+			verr.addf("pool %q: vlan %d is already used by pool %q", name, pool.VLAN, other)
+		} else {
+			vlans[pool.VLAN] = name
+		}
+		if pool.UPnPProxy != "" {
+			if _, err := parseProxyURL(pool.UPnPProxy); err != nil {
+				verr.addf("pool %q: upnp_proxy: %v", name, err)
+			}
+		}
+		if pool.DNSDomain != "" {
+			domain := strings.ToLower(strings.TrimSuffix(pool.DNSDomain, "."))
+			if err := validateDNSDomain(domain); err != nil {
+				verr.addf("pool %q: dns_domain: %v", name, err)
+			} else if other, dup := domains[domain]; dup {
+				verr.addf("pool %q: dns_domain %q is already used by pool %q", name, pool.DNSDomain, other)
+			} else {
+				domains[domain] = name
+			}
+		}
+		if pool.MDNSInterface != "" {
+			if pool.DNSDomain == "" {
+				verr.addf("pool %q: mdns_interface requires dns_domain", name)
+			} else if _, err := net.InterfaceByName(pool.MDNSInterface); err != nil {
+				verr.addf("pool %q: mdns_interface %q: %v", name, pool.MDNSInterface, err)
+			}
+		}
+		for i, rule := range pool.Share {
+			if len(rule.To) == 0 {
+				verr.addf("pool %q: share rule #%d has no target pools", name, i+1)
+			}
+			for _, target := range rule.To {
+				switch _, ok := pools[target]; {
+				case !ok:
+					verr.addf("pool %q: share rule #%d targets unknown pool %q", name, i+1, target)
+				case target == name:
+					verr.addf("pool %q: share rule #%d targets the pool itself", name, i+1)
+				}
+			}
+			for _, protocol := range rule.Protocols {
+				if _, ok := canonicalProtocol(protocol); !ok {
+					verr.addf("pool %q: share rule #%d has unknown protocol %q, expected mdns or ssdp", name, i+1, protocol)
+				}
+			}
+		}
+	}
+	return pools
+}
+
+// parseProxyURL parses the base URL of a UPnP proxy.
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http URL", s)
+	}
+	return u, nil
+}
+
+// validateDNSDomain checks that domain is a lower-case domain name of at least
+// two labels, outside of the mDNS ".local" domain.
+func validateDNSDomain(domain string) error {
+	if len(domain) > 253 {
+		return fmt.Errorf("%q is longer than 253 characters", domain)
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return fmt.Errorf("%q is not a domain with at least two labels, e.g. iot.home.arpa", domain)
+	}
+	if labels[len(labels)-1] == "local" {
+		return fmt.Errorf("%q is in the mDNS domain local", domain)
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("%q has an invalid label %q", domain, label)
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return fmt.Errorf("%q has an invalid label %q", domain, label)
+			}
+		}
+	}
+	return nil
+}
+
+func (d Device) validate(verr *ValidationError, label string) {
+	if !validVLANID(d.OriginPool) {
+		verr.addf("%s: origin_pool %d is not a VLAN ID in range %d-%d", label, d.OriginPool, minVLANID, maxVLANID)
+	}
+	if len(d.SharedPools) == 0 {
+		verr.addf("%s: shared_pools is empty", label)
+	}
+	seen := make(map[uint16]bool, len(d.SharedPools))
+	for _, pool := range d.SharedPools {
+		switch {
+		case !validVLANID(pool):
+			verr.addf("%s: shared pool %d is not a VLAN ID in range %d-%d", label, pool, minVLANID, maxVLANID)
+		case pool == d.OriginPool:
+			verr.addf("%s: shared pool %d is its own origin pool", label, pool)
+		case seen[pool]:
+			verr.addf("%s: shared pool %d is listed more than once", label, pool)
+		}
+		seen[pool] = true
+	}
+}
+
+func validVLANID(id uint16) bool {
+	return id >= minVLANID && id <= maxVLANID
+}
+
+func sortedMacs(devices map[MacAddress]Device) []MacAddress {
+	macs := make([]MacAddress, 0, len(devices))
+	for mac := range devices {
+		macs = append(macs, mac)
+	}
+	sort.Slice(macs, func(i, j int) bool { return macs[i] < macs[j] })
+	return macs
+}
@@ -0,0 +1,152 @@
+package reflector
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidatePoolNamesCaseInsensitive(t *testing.T) {
+	cfg := &Config{
+		NetInterface: "lo",
+		Pools: map[string]Pool{
+			"IoT":  {VLAN: 30, Share: []ShareRule{{To: []string{"Home"}}}},
+			"home": {VLAN: 10},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	iot, ok := cfg.Pools["iot"]
+	if !ok {
+		t.Fatalf("pools = %v, want lower-cased names", cfg.Pools)
+	}
+	if got := iot.Share[0].To; len(got) != 1 || got[0] != "home" {
+		t.Errorf("share targets = %v, want [home]", got)
+	}
+	if routes := buildRoutes(cfg, nil).announcements[routeKey{30, protocolMDNS}]; len(routes) != 1 || routes[0] != 10 {
+		t.Errorf("mDNS announcements from vlan 30 go to %v, want [10]", routes)
+	}
+}
+
+func TestValidateDuplicatePoolNames(t *testing.T) {
+	cfg := &Config{
+		NetInterface: "lo",
+		Pools: map[string]Pool{
+			"IoT": {VLAN: 30},
+			"iot": {VLAN: 31},
+		},
+	}
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("Validate() = %v, want a duplicate pool error", err)
+	}
+}
+
+func TestParseMacAddress(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"00:1A:2b:3c:4d:5e", "00:1a:2b:3c:4d:5e"},
+		{" 00-1a-2b-3c-4d-5e ", "00:1a:2b:3c:4d:5e"},
+		{"001a.2b3c.4d5e", "00:1a:2b:3c:4d:5e"},
+		{"", ""},
+		{"00:1a:2b:3c:4d", ""},
+		{"00:1a:2b:3c:4d:zz", ""},
+		{"00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01", ""},
+		{"02:00:5e:10:00:00:00:01", ""},
+	} {
+		got, err := ParseMacAddress(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ParseMacAddress(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.want {
+			t.Errorf("ParseMacAddress(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidateProblems(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			NetInterface: "lo",
+			Pools: map[string]Pool{
+				"iot":  {VLAN: 30, Share: []ShareRule{{To: []string{"home"}}}},
+				"home": {VLAN: 10},
+			},
+			Devices: map[MacAddress]Device{
+				"00:1a:2b:3c:4d:5e": {OriginPool: 30, SharedPools: []uint16{10}},
+			},
+		}
+	}
+	for _, tt := range []struct {
+		name   string
+		modify func(c *Config)
+		want   string
+	}{
+		{"bad device MAC", func(c *Config) {
+			c.Devices["00:1a:2b"] = Device{OriginPool: 30, SharedPools: []uint16{10}}
+		}, `device "00:1a:2b": invalid MAC address`},
+		{"duplicate device MAC", func(c *Config) {
+			c.Devices["00-1A-2B-3C-4D-5E"] = Device{OriginPool: 30, SharedPools: []uint16{10}}
+		}, "duplicate of 00:1a:2b:3c:4d:5e"},
+		{"pool VLAN 0", func(c *Config) {
+			c.Pools["guest"] = Pool{VLAN: 0}
+		}, `pool "guest": vlan 0 is not a VLAN ID in range 1-4094`},
+		{"pool VLAN 4095", func(c *Config) {
+			c.Pools["guest"] = Pool{VLAN: 4095}
+		}, `pool "guest": vlan 4095 is not a VLAN ID in range 1-4094`},
+		{"pool VLAN used twice", func(c *Config) {
+			c.Pools["guest"] = Pool{VLAN: 10}
+		}, "vlan 10 is already used by pool"},
+		{"device origin pool 0", func(c *Config) {
+			c.Devices["00:1a:2b:3c:4d:5e"] = Device{OriginPool: 0, SharedPools: []uint16{10}}
+		}, "origin_pool 0 is not a VLAN ID"},
+		{"device shared pool 4095", func(c *Config) {
+			c.Devices["00:1a:2b:3c:4d:5e"] = Device{OriginPool: 30, SharedPools: []uint16{4095}}
+		}, "shared pool 4095 is not a VLAN ID"},
+		{"device shared with its origin", func(c *Config) {
+			c.Devices["00:1a:2b:3c:4d:5e"] = Device{OriginPool: 30, SharedPools: []uint16{30}}
+		}, "shared pool 30 is its own origin pool"},
+		{"pool sharing with itself", func(c *Config) {
+			c.Pools["iot"] = Pool{VLAN: 30, Share: []ShareRule{{To: []string{"IoT"}}}}
+		}, `pool "iot": share rule #1 targets the pool itself`},
+		{"share with an unknown pool", func(c *Config) {
+			c.Pools["iot"] = Pool{VLAN: 30, Share: []ShareRule{{To: []string{"office"}}}}
+		}, `targets unknown pool "office"`},
+		{"unknown net_interface", func(c *Config) {
+			c.NetInterface = "nonexistent0"
+		}, `net_interface "nonexistent0"`},
+		{"missing net_interface", func(c *Config) {
+			c.NetInterface = ""
+		}, "net_interface is required"},
+		{"unknown mdns_interface", func(c *Config) {
+			c.Pools["iot"] = Pool{VLAN: 30, DNSDomain: "iot.home.arpa", MDNSInterface: "nonexistent0"}
+		}, `pool "iot": mdns_interface "nonexistent0"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("Validate() = %v, want a *ValidationError", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() = %v, want a problem with %q", err, tt.want)
+			}
+		})
+	}
+
+	cfg := valid()
+	cfg.Devices = map[MacAddress]Device{"00-1A-2B-3C-4D-5E": {OriginPool: 30, SharedPools: []uint16{10}}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	if _, ok := cfg.Devices["00:1a:2b:3c:4d:5e"]; !ok {
+		t.Errorf("devices = %v, want canonical MAC addresses", cfg.Devices)
+	}
+}
@@ -1,11 +1,10 @@
 package ssdp
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
-	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -15,22 +14,116 @@ var (
 	LayerTypeSSDP = gopacket.RegisterLayerType(1001, gopacket.LayerTypeMetadata{Name: "SSDP", Decoder: gopacket.DecodeFunc(decodeSSDP)})
 )
 
+func init() {
+	// Decode UDP datagrams to or from port 1900 as SSDP.
+	layers.RegisterUDPPortLayerType(SearchPort, LayerTypeSSDP)
+}
+
+// Header is a message header as it appears on the wire.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// SSDP is an SSDP request (NOTIFY, M-SEARCH) or response message. Headers
+// keep their order and case; lookups are case-insensitive.
+//
+// A decoded message is serialized exactly as received unless its headers are
+// changed with Set or Add; fields changed directly are not serialized until
+// then.
 type SSDP struct {
 	layers.BaseLayer
 
-	Method     string
-	URL        string
-	Headers    map[string]string
+	// Method and URL are set for requests.
+	Method string
+	URL    string
+	// Proto is the protocol version, e.g. "HTTP/1.1".
+	Proto string
+	// StatusCode and Status, the reason phrase, are set for responses.
 	StatusCode int
 	Status     string
+	Headers    []Header
+
+	// modified is set when the headers were changed after decoding.
+	modified bool
 }
 
 func (s *SSDP) LayerType() gopacket.LayerType {
 	return LayerTypeSSDP
 }
 
+// CanDecode implements gopacket.DecodingLayer.
+func (s *SSDP) CanDecode() gopacket.LayerClass {
+	return LayerTypeSSDP
+}
+
+// NextLayerType implements gopacket.DecodingLayer. A message body is decoded
+// as payload.
+func (s *SSDP) NextLayerType() gopacket.LayerType {
+	if len(s.BaseLayer.Payload) > 0 {
+		return gopacket.LayerTypePayload
+	}
+	return gopacket.LayerTypeZero
+}
+
+// Payload returns the message body, usually empty.
 func (s *SSDP) Payload() []byte {
-	return nil
+	return s.BaseLayer.Payload
+}
+
+// IsResponse reports whether the message is a response.
+func (s *SSDP) IsResponse() bool {
+	return s.Method == ""
+}
+
+// Get returns the first value of the named header, or "".
+func (s *SSDP) Get(name string) string {
+	for _, h := range s.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// Values returns all values of the named header.
+func (s *SSDP) Values(name string) []string {
+	var values []string
+	for _, h := range s.Headers {
+		if strings.EqualFold(h.Name, name) {
+			values = append(values, h.Value)
+		}
+	}
+	return values
+}
+
+// Set replaces the values of the named header with value, keeping the
+// position and case of its first occurrence, or adds it.
+func (s *SSDP) Set(name, value string) {
+	kept := s.Headers[:0]
+	found := false
+	for _, h := range s.Headers {
+		if !strings.EqualFold(h.Name, name) {
+			kept = append(kept, h)
+			continue
+		}
+		if !found {
+			found = true
+			h.Value = value
+			kept = append(kept, h)
+		}
+	}
+	s.Headers = kept
+	s.modified = true
+	if !found {
+		s.Add(name, value)
+	}
+}
+
+// Add appends a header.
+func (s *SSDP) Add(name, value string) {
+	s.Headers = append(s.Headers, Header{Name: name, Value: value})
+	s.modified = true
 }
 
 func decodeSSDP(data []byte, p gopacket.PacketBuilder) error {
@@ -41,59 +134,171 @@ func decodeSSDP(data []byte, p gopacket.PacketBuilder) error {
 	}
 	p.AddLayer(s)
 	p.SetApplicationLayer(s)
-	return nil
+	return p.NextDecoder(s.NextLayerType())
 }
 
+// DecodeFromBytes parses an SSDP message. Malformed header lines are skipped,
+// since devices are not always strict; a malformed start line is an error.
 func (s *SSDP) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
-	if !bytes.Contains(data, []byte("HTTP/1.1")) {
-		return errSSDPInvalidPacket
+	*s = SSDP{Headers: s.Headers[:0]}
+
+	line, rest, ok := nextLine(data)
+	if !ok {
+		return errSSDPTruncated
+	}
+	if err := s.decodeStartLine(line); err != nil {
+		return err
 	}
-	// since there are no further layers, the baselayer's content is
-	// pointing to this layer
-	s.BaseLayer = layers.BaseLayer{Contents: data[:]}
 
-	rd := bufio.NewReader(bytes.NewReader(data))
-	if bytes.Equal(data[:4], []byte("HTTP/1.1")) {
-		// Response
-		header, _, err := rd.ReadLine()
-		responseHeaderRe, err := regexp.Compile("HTTP/1.1\\s+(\\d+)\\s+(\\w+)")
-		if err != nil {
-			panic(err)
+	for {
+		line, rest, ok = nextLine(rest)
+		if !ok {
+			// No blank line: headers end with the datagram.
+			if len(line) > 0 {
+				s.decodeHeader(line)
+			}
+			break
 		}
-		matches := responseHeaderRe.FindSubmatch(header)
-		s.StatusCode, err = strconv.Atoi(string(matches[1]))
-		s.Status = string(matches[1])
-	} else {
-		header, _, err := rd.ReadLine()
-		re, err := regexp.Compile("(M-SEARCH|NOTIFY)|\\w+\\s+\\w+\\s+HTTP/1.1")
-		if err != nil {
-			panic(err)
+		if len(line) == 0 {
+			break
 		}
-		matches := re.FindSubmatch(header)
-		s.Method = string(matches[1])
+		if (line[0] == ' ' || line[0] == '\t') && len(s.Headers) > 0 {
+			// Obsolete line folding continues the previous value.
+			last := &s.Headers[len(s.Headers)-1]
+			last.Value = strings.TrimSpace(last.Value + " " + string(bytes.TrimSpace(line)))
+			continue
+		}
+		s.decodeHeader(line)
+	}
+
+	headerLen := len(data) - len(rest)
+	s.BaseLayer = layers.BaseLayer{Contents: data[:headerLen], Payload: data[headerLen:]}
+	return nil
+}
 
+func (s *SSDP) decodeStartLine(line []byte) error {
+	first, line := cutSpace(line)
+	second, third := cutSpace(line)
+	third = bytes.TrimSpace(third)
+
+	if bytes.HasPrefix(first, []byte("HTTP/")) {
+		// HTTP/1.1 200 OK
+		if len(second) != 3 {
+			return errSSDPInvalidStatus
+		}
+		code, err := strconv.Atoi(string(second))
+		if err != nil || code < 100 {
+			return errSSDPInvalidStatus
+		}
+		s.Proto = string(first)
+		s.StatusCode = code
+		s.Status = string(third)
+		return nil
 	}
-	headerRe, err := regexp.Compile("(.*?):\\s+(.*)")
-	if err != nil {
-		panic(err)
+
+	// NOTIFY * HTTP/1.1
+	if len(first) == 0 || !isToken(first) || len(second) == 0 || !bytes.HasPrefix(third, []byte("HTTP/")) {
+		return errSSDPInvalidPacket
 	}
-	s.Headers = make(map[string]string)
-	for {
-		headerLine, _, err := rd.ReadLine()
+	s.Method = string(first)
+	s.URL = string(second)
+	s.Proto = string(third)
+	return nil
+}
+
+func (s *SSDP) decodeHeader(line []byte) {
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 {
+		return
+	}
+	name := bytes.TrimRight(line[:i], " \t")
+	if !isToken(name) {
+		return
+	}
+	s.Headers = append(s.Headers, Header{
+		Name:  string(name),
+		Value: string(bytes.TrimSpace(line[i+1:])),
+	})
+}
+
+// SerializeTo writes the start line and the headers, in order, or the message
+// as received if it was decoded and not modified since. A body is serialized
+// as a following gopacket.Payload layer.
+func (s *SSDP) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	if !s.modified && len(s.Contents) > 0 {
+		out, err := b.PrependBytes(len(s.Contents))
 		if err != nil {
-			break
+			return err
 		}
-		if len(headerLine) == 0 {
-			break
+		copy(out, s.Contents)
+		return nil
+	}
+
+	proto := s.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	var buf bytes.Buffer
+	if s.IsResponse() {
+		buf.WriteString(proto + " " + strconv.Itoa(s.StatusCode))
+		if s.Status != "" {
+			buf.WriteString(" " + s.Status)
 		}
-		matches := headerRe.FindSubmatch(headerLine)
-		if len(matches) == 3 {
-			s.Headers[string(matches[1])] = string(matches[2])
+	} else {
+		url := s.URL
+		if url == "" {
+			url = "*"
 		}
+		buf.WriteString(s.Method + " " + url + " " + proto)
+	}
+	buf.WriteString("\r\n")
+	for _, h := range s.Headers {
+		buf.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	out, err := b.PrependBytes(buf.Len())
+	if err != nil {
+		return err
 	}
+	copy(out, buf.Bytes())
 	return nil
 }
 
+// nextLine returns the line at the start of data without its line ending, and
+// the data after it. ok is false if data has no line ending.
+func nextLine(data []byte) (line, rest []byte, ok bool) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return data, nil, false
+	}
+	line = data[:i]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, data[i+1:], true
+}
+
+// cutSpace splits line at its first space, skipping repeated spaces.
+func cutSpace(line []byte) (before, after []byte) {
+	line = bytes.TrimLeft(line, " ")
+	before, after, _ = bytes.Cut(line, []byte(" "))
+	return before, bytes.TrimLeft(after, " ")
+}
+
+// isToken reports whether b is an HTTP token, as methods and header names
+// are.
+func isToken(b []byte) bool {
+	for _, c := range b {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
 var (
 	errSSDPInvalidPacket = errors.New("invalid SSDP packet")
+	errSSDPInvalidStatus = errors.New("invalid SSDP response status")
+	errSSDPTruncated     = errors.New("truncated SSDP packet")
 )
@@ -0,0 +1,235 @@
+package ssdp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// captures returns the datagrams captured from real devices in testdata.
+func captures(tb testing.TB) map[string][]byte {
+	tb.Helper()
+	files, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	captures := make(map[string][]byte, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		captures[filepath.Base(file)] = data
+	}
+	if len(captures) == 0 {
+		tb.Fatal("no captures in testdata")
+	}
+	return captures
+}
+
+func decode(tb testing.TB, data []byte) (*SSDP, error) {
+	tb.Helper()
+	s := &SSDP{}
+	err := s.DecodeFromBytes(data, gopacket.NilDecodeFeedback)
+	return s, err
+}
+
+// equalMessages reports whether a and b decoded to the same message.
+func equalMessages(a, b *SSDP) bool {
+	return a.Method == b.Method && a.URL == b.URL && a.Proto == b.Proto &&
+		a.StatusCode == b.StatusCode && a.Status == b.Status &&
+		reflect.DeepEqual(a.Headers, b.Headers) && string(a.Payload()) == string(b.Payload())
+}
+
+func serialize(tb testing.TB, s *SSDP) []byte {
+	tb.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, s, gopacket.Payload(s.Payload())); err != nil {
+		tb.Fatalf("SerializeTo: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeCaptures(t *testing.T) {
+	for name, data := range captures(t) {
+		t.Run(name, func(t *testing.T) {
+			s, err := decode(t, data)
+			if err != nil {
+				t.Fatalf("DecodeFromBytes: %v", err)
+			}
+			if s.Get("USN") == "" && s.Get("ST") == "" {
+				t.Errorf("no USN or ST header in %+v", s.Headers)
+			}
+			again, err := decode(t, serialize(t, s))
+			if err != nil {
+				t.Fatalf("decoding serialized message: %v", err)
+			}
+			if !equalMessages(s, again) {
+				t.Errorf("round trip changed the message:\n got %+v\nwant %+v", again, s)
+			}
+		})
+	}
+}
+
+func TestDecodeStartLine(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		data       string
+		response   bool
+		method     string
+		statusCode int
+		status     string
+		err        error
+	}{
+		{name: "notify", data: "NOTIFY * HTTP/1.1\r\n\r\n", method: "NOTIFY"},
+		{name: "search", data: "M-SEARCH * HTTP/1.1\r\n\r\n", method: "M-SEARCH"},
+		{name: "response", data: "HTTP/1.1 200 OK\r\n\r\n", response: true, statusCode: 200, status: "OK"},
+		{name: "response HTTP/1.0", data: "HTTP/1.0 200 OK\r\n\r\n", response: true, statusCode: 200, status: "OK"},
+		{name: "response without reason", data: "HTTP/1.1 200\r\n\r\n", response: true, statusCode: 200},
+		{name: "multi-word reason", data: "HTTP/1.1 412 Precondition Failed\r\n\r\n", response: true, statusCode: 412, status: "Precondition Failed"},
+		{name: "bare LF", data: "HTTP/1.1 200 OK\nST: upnp:rootdevice\n\n", response: true, statusCode: 200, status: "OK"},
+		{name: "status not a number", data: "HTTP/1.1 OK\r\n\r\n", err: errSSDPInvalidStatus},
+		{name: "status too short", data: "HTTP/1.1 20 OK\r\n\r\n", err: errSSDPInvalidStatus},
+		{name: "status below 100", data: "HTTP/1.1 099 OK\r\n\r\n", err: errSSDPInvalidStatus},
+		{name: "request without protocol", data: "NOTIFY *\r\n\r\n", err: errSSDPInvalidPacket},
+		{name: "request without URL", data: "NOTIFY\r\n\r\n", err: errSSDPInvalidPacket},
+		{name: "method not a token", data: "NOT(IFY * HTTP/1.1\r\n\r\n", err: errSSDPInvalidPacket},
+		{name: "no line ending", data: "NOTIFY * HTTP/1.1", err: errSSDPTruncated},
+		{name: "empty", data: "", err: errSSDPTruncated},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := decode(t, []byte(tt.data))
+			if err != tt.err {
+				t.Fatalf("DecodeFromBytes error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if s.IsResponse() != tt.response {
+				t.Errorf("IsResponse() = %v, want %v", s.IsResponse(), tt.response)
+			}
+			if s.Method != tt.method || s.StatusCode != tt.statusCode || s.Status != tt.status {
+				t.Errorf("Method, StatusCode, Status = %q, %d, %q, want %q, %d, %q",
+					s.Method, s.StatusCode, s.Status, tt.method, tt.statusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestDecodeHeaders(t *testing.T) {
+	data := "NOTIFY * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"nt: upnp:rootdevice\r\n" +
+		"X-Vendor: a\r\n" +
+		"x-vendor: b\r\n" +
+		"X-VENDOR:c\r\n" +
+		"Folded: first\r\n" +
+		"  second\r\n" +
+		"not a header\r\n" +
+		"(bad): name\r\n" +
+		"Empty:\r\n" +
+		"\r\n" +
+		"body"
+	s, err := decode(t, []byte(data))
+	if err != nil {
+		t.Fatalf("DecodeFromBytes: %v", err)
+	}
+
+	want := []Header{
+		{"HOST", "239.255.255.250:1900"},
+		{"nt", "upnp:rootdevice"},
+		{"X-Vendor", "a"},
+		{"x-vendor", "b"},
+		{"X-VENDOR", "c"},
+		{"Folded", "first second"},
+		{"Empty", ""},
+	}
+	if !reflect.DeepEqual(s.Headers, want) {
+		t.Errorf("Headers = %q, want %q", s.Headers, want)
+	}
+	if got := s.Get("NT"); got != "upnp:rootdevice" {
+		t.Errorf(`Get("NT") = %q, want upnp:rootdevice`, got)
+	}
+	if got := s.Values("x-VENDOR"); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("Values = %q, want [a b c]", got)
+	}
+	if got := string(s.Payload()); got != "body" {
+		t.Errorf("Payload = %q, want body", got)
+	}
+
+	s.Set("X-Vendor", "d")
+	if got := s.Values("x-vendor"); !reflect.DeepEqual(got, []string{"d"}) {
+		t.Errorf("Values after Set = %q, want [d]", got)
+	}
+	if s.Headers[2] != (Header{"X-Vendor", "d"}) {
+		t.Errorf("Set moved or renamed the header: %q", s.Headers)
+	}
+}
+
+func TestDecodeUDPPort(t *testing.T) {
+	data := captures(t)["sonos-notify-alive.txt"]
+	udp := &layers.UDP{SrcPort: 1900, DstPort: SearchPort}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, udp, gopacket.Payload(data)); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeUDP, gopacket.Default)
+	s, ok := packet.Layer(LayerTypeSSDP).(*SSDP)
+	if !ok {
+		t.Fatalf("no SSDP layer in %v", packet)
+	}
+	if s.Get("NTS") != "ssdp:alive" {
+		t.Errorf("NTS = %q, want ssdp:alive", s.Get("NTS"))
+	}
+}
+
+func FuzzDecodeSSDP(f *testing.F) {
+	for _, data := range captures(f) {
+		f.Add(data)
+	}
+	f.Add([]byte("HTTP/1.1 200 OK\r\nA:\r\n b\r\n\r\n"))
+	f.Add([]byte("NOTIFY * HTTP/1.1\nA: b\n \n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s, err := decode(t, data)
+		if err != nil {
+			return
+		}
+		again, err := decode(t, serialize(t, s))
+		if err != nil {
+			t.Fatalf("decoding serialized message: %v\n%q", err, serialize(t, s))
+		}
+		if !equalMessages(s, again) {
+			t.Fatalf("round trip changed the message:\n got %+v\nwant %+v", again, s)
+		}
+	})
+}
+
+func TestSerializeAsReceived(t *testing.T) {
+	for name, data := range captures(t) {
+		t.Run(name, func(t *testing.T) {
+			s, err := decode(t, data)
+			if err != nil {
+				t.Fatalf("DecodeFromBytes: %v", err)
+			}
+			if got := serialize(t, s); string(got) != string(data) {
+				t.Errorf("SerializeTo changed the message:\n got %q\nwant %q", got, data)
+			}
+		})
+	}
+}
+
+func TestSerializeModified(t *testing.T) {
+	s, err := decode(t, []byte("NOTIFY * HTTP/1.1\r\nHost:239.255.255.250:1900\r\nLOCATION: http://10.0.0.2/d.xml"))
+	if err != nil {
+		t.Fatalf("DecodeFromBytes: %v", err)
+	}
+	s.Set("location", "http://10.0.0.1/d.xml")
+	want := "NOTIFY * HTTP/1.1\r\nHost: 239.255.255.250:1900\r\nLOCATION: http://10.0.0.1/d.xml\r\n\r\n"
+	if got := serialize(t, s); string(got) != want {
+		t.Errorf("SerializeTo = %q, want %q", got, want)
+	}
+}
@@ -1,12 +1,31 @@
 package ssdp
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
+
+	"github.com/home-sol/multicast-proxy/pkg/net/httpu"
 )
 
+// ErrInvalidMessage is wrapped by the errors of ParseMessage for messages
+// that are not valid SSDP.
+var ErrInvalidMessage = errors.New("ssdp: invalid message")
+
+// Message is a typed SSDP message: *AliveMessage, *ByeMessage,
+// *UpdateMessage, *SearchMessage or *SearchResponse.
+type Message interface {
+	// Header returns the headers the message was parsed from or built with.
+	Header() http.Header
+	// Write renders the message in wire format.
+	Write(w io.Writer) error
+}
+
 type SSDPMessage struct {
 	// From is a sender of this message
 	From net.Addr
@@ -60,9 +79,357 @@ type ByeMessage struct {
 	USN string
 }
 
+// UpdateMessage represents SSDP's ssdp:update message.
+type UpdateMessage struct {
+	SSDPMessage
+
+	// USN is a property of "USN"
+	USN string
+
+	// Location is a property of "LOCATION"
+	Location string
+
+	// BootID and NextBootID are properties of "BOOTID.UPNP.ORG" and
+	// "NEXTBOOTID.UPNP.ORG"
+	BootID     int32
+	NextBootID int32
+}
+
 // SearchMessage represents SSDP's ssdp:discover message.
 type SearchMessage struct {
 	SSDPMessage
+
+	// ST is a property of "ST"
+	ST string
+
+	// MX is a property of "MX", bounded by MaxMX. It is 0 for unicast
+	// searches without one.
+	MX int
+}
+
+// SearchResponse represents a response to a SearchMessage.
+type SearchResponse struct {
+	SSDPMessage
+
+	// ST is a property of "ST"
+	ST string
+
+	// USN is a property of "USN"
+	USN string
+
+	// Location is a property of "LOCATION"
+	Location string
+
+	// Server is a property of "SERVER"
+	Server string
+
+	maxAge *int
+}
+
+// MaxAge extracts "max-age" value from "CACHE-CONTROL" property.
+func (m *SearchResponse) MaxAge() int {
+	if m.maxAge == nil {
+		m.maxAge = new(int)
+		*m.maxAge = extractMaxAge(m.Get("CACHE-CONTROL"), -1)
+	}
+	return *m.maxAge
+}
+
+// NewAliveMessage builds an ssdp:alive message.
+func NewAliveMessage(nt, usn, location, server string, maxAge int) *AliveMessage {
+	return &AliveMessage{
+		SSDPMessage: newSSDPMessage(nt, http.Header{"Cache-Control": {"max-age=" + strconv.Itoa(maxAge)}}),
+		USN:         usn,
+		Location:    location,
+		Server:      server,
+	}
+}
+
+// NewByeMessage builds an ssdp:byebye message.
+func NewByeMessage(nt, usn string) *ByeMessage {
+	return &ByeMessage{
+		SSDPMessage: newSSDPMessage(nt, nil),
+		USN:         usn,
+	}
+}
+
+// NewUpdateMessage builds an ssdp:update message.
+func NewUpdateMessage(nt, usn, location string, bootID, nextBootID int32) *UpdateMessage {
+	return &UpdateMessage{
+		SSDPMessage: newSSDPMessage(nt, nil),
+		USN:         usn,
+		Location:    location,
+		BootID:      bootID,
+		NextBootID:  nextBootID,
+	}
+}
+
+// NewSearchMessage builds a multicast ssdp:discover message. An mx of 0 or
+// less is DefaultMX, since multicast searches require MX, and larger values
+// are bounded by MaxMX.
+func NewSearchMessage(st string, mx int) *SearchMessage {
+	if mx <= 0 {
+		mx = DefaultMX
+	}
+	mx = min(mx, MaxMX)
+	return &SearchMessage{
+		SSDPMessage: newSSDPMessage("", nil),
+		ST:          st,
+		MX:          mx,
+	}
+}
+
+// NewSearchResponse builds a response to a search.
+func NewSearchResponse(st, usn, location, server string, maxAge int) *SearchResponse {
+	return &SearchResponse{
+		SSDPMessage: newSSDPMessage("", http.Header{"Cache-Control": {"max-age=" + strconv.Itoa(maxAge)}}),
+		ST:          st,
+		USN:         usn,
+		Location:    location,
+		Server:      server,
+	}
+}
+
+func newSSDPMessage(nt string, header http.Header) SSDPMessage {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return SSDPMessage{Type: nt, rawHeader: header}
+}
+
+// ParseMessage returns the typed message of an SSDP request or response,
+// after checking that it has the required headers.
+func ParseMessage[T *http.Request | *http.Response](m T) (Message, error) {
+	switch m := any(m).(type) {
+	case *http.Request:
+		return parseRequest(m)
+	case *http.Response:
+		return parseResponse(m)
+	}
+	panic("unreachable")
+}
+
+func parseRequest(r *http.Request) (Message, error) {
+	header := r.Header
+	if r.Host != "" && header.Get("HOST") == "" {
+		// net/http moves HOST out of the headers.
+		header = header.Clone()
+		header.Set("HOST", r.Host)
+	}
+	msg := SSDPMessage{
+		From:      parseFrom(r.RemoteAddr),
+		Type:      r.Header.Get("NT"),
+		rawHeader: header,
+	}
+	switch r.Method {
+	case MethodNotify:
+		if err := requireHeaders(r.Header, "NT", "NTS", "USN"); err != nil {
+			return nil, err
+		}
+		switch nts := r.Header.Get("NTS"); nts {
+		case NtsAlive:
+			if err := requireHeaders(r.Header, "LOCATION", "CACHE-CONTROL"); err != nil {
+				return nil, err
+			}
+			m := &AliveMessage{
+				SSDPMessage: msg,
+				USN:         r.Header.Get("USN"),
+				Location:    r.Header.Get("LOCATION"),
+				Server:      r.Header.Get("SERVER"),
+			}
+			if m.MaxAge() < 0 {
+				return nil, fmt.Errorf("%w: no max-age in CACHE-CONTROL %q", ErrInvalidMessage, m.Get("CACHE-CONTROL"))
+			}
+			return m, nil
+		case NtsByebye:
+			return &ByeMessage{SSDPMessage: msg, USN: r.Header.Get("USN")}, nil
+		case NtsUpdate:
+			if err := requireHeaders(r.Header, "LOCATION", "BOOTID.UPNP.ORG", "NEXTBOOTID.UPNP.ORG"); err != nil {
+				return nil, err
+			}
+			bootID, err := parseUpnpIntHeader(r.Header, "BOOTID.UPNP.ORG", -1)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+			}
+			nextBootID, err := parseUpnpIntHeader(r.Header, "NEXTBOOTID.UPNP.ORG", -1)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+			}
+			return &UpdateMessage{
+				SSDPMessage: msg,
+				USN:         r.Header.Get("USN"),
+				Location:    r.Header.Get("LOCATION"),
+				BootID:      bootID,
+				NextBootID:  nextBootID,
+			}, nil
+		default:
+			return nil, fmt.Errorf("%w: unknown NTS %q", ErrInvalidMessage, nts)
+		}
+	case MethodSearch:
+		if err := requireHeaders(r.Header, "MAN", "ST"); err != nil {
+			return nil, err
+		}
+		// The MAN value must be quoted.
+		if man := r.Header.Get("MAN"); man != SsdpDiscover {
+			return nil, fmt.Errorf("%w: MAN is %s, not %s", ErrInvalidMessage, man, SsdpDiscover)
+		}
+		m := &SearchMessage{SSDPMessage: msg, ST: r.Header.Get("ST")}
+		mx := r.Header.Get("MX")
+		if mx == "" {
+			// Only unicast searches may omit MX.
+			if isMulticastHost(r.Host) {
+				return nil, fmt.Errorf("%w: missing MX header", ErrInvalidMessage)
+			}
+			return m, nil
+		}
+		n, err := strconv.Atoi(mx)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%w: invalid MX %q", ErrInvalidMessage, mx)
+		}
+		// Devices treat larger values as MaxMX.
+		m.MX = min(n, MaxMX)
+		return m, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported method %q", ErrInvalidMessage, r.Method)
+	}
+}
+
+func parseResponse(r *http.Response) (Message, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %q", ErrInvalidMessage, r.Status)
+	}
+	if err := requireHeaders(r.Header, "ST", "USN", "LOCATION", "CACHE-CONTROL"); err != nil {
+		return nil, err
+	}
+	m := &SearchResponse{
+		SSDPMessage: SSDPMessage{
+			From:      parseFrom(r.Header.Get(httpu.RemoteAddressHeader)),
+			rawHeader: r.Header,
+		},
+		ST:       r.Header.Get("ST"),
+		USN:      r.Header.Get("USN"),
+		Location: r.Header.Get("LOCATION"),
+		Server:   r.Header.Get("SERVER"),
+	}
+	if m.MaxAge() < 0 {
+		return nil, fmt.Errorf("%w: no max-age in CACHE-CONTROL %q", ErrInvalidMessage, m.Get("CACHE-CONTROL"))
+	}
+	return m, nil
+}
+
+func requireHeaders(header http.Header, names ...string) error {
+	for _, name := range names {
+		if header.Get(name) == "" {
+			return fmt.Errorf("%w: missing %s header", ErrInvalidMessage, name)
+		}
+	}
+	return nil
+}
+
+func parseFrom(addr string) net.Addr {
+	if addr == "" {
+		return nil
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil
+	}
+	return udpAddr
+}
+
+func isMulticastHost(host string) bool {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		h = host
+	}
+	ip := net.ParseIP(h)
+	return ip != nil && ip.IsMulticast()
+}
+
+// header returns a copy of the message headers for rendering, with HOST
+// defaulting to the IPv4 multicast address.
+func (m SSDPMessage) header() http.Header {
+	h := m.rawHeader.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	if h.Get("HOST") == "" {
+		h.Set("HOST", UDP4Addr)
+	}
+	return h
+}
+
+func setIfNotEmpty(h http.Header, name, value string) {
+	if value != "" {
+		h.Set(name, value)
+	}
+}
+
+func writeRequest(w io.Writer, method string, h http.Header) error {
+	return httpu.WriteRequest(w, &http.Request{
+		Method: method,
+		Host:   h.Get("HOST"),
+		URL:    &url.URL{Opaque: "*"},
+		Header: h,
+	})
+}
+
+func (m *AliveMessage) Write(w io.Writer) error {
+	h := m.header()
+	h.Set("NT", m.Type)
+	h.Set("NTS", NtsAlive)
+	h.Set("USN", m.USN)
+	h.Set("LOCATION", m.Location)
+	setIfNotEmpty(h, "SERVER", m.Server)
+	return writeRequest(w, MethodNotify, h)
+}
+
+func (m *ByeMessage) Write(w io.Writer) error {
+	h := m.header()
+	h.Set("NT", m.Type)
+	h.Set("NTS", NtsByebye)
+	h.Set("USN", m.USN)
+	return writeRequest(w, MethodNotify, h)
+}
+
+func (m *UpdateMessage) Write(w io.Writer) error {
+	h := m.header()
+	h.Set("NT", m.Type)
+	h.Set("NTS", NtsUpdate)
+	h.Set("USN", m.USN)
+	h.Set("LOCATION", m.Location)
+	h.Set("BOOTID.UPNP.ORG", strconv.Itoa(int(m.BootID)))
+	h.Set("NEXTBOOTID.UPNP.ORG", strconv.Itoa(int(m.NextBootID)))
+	return writeRequest(w, MethodNotify, h)
+}
+
+func (m *SearchMessage) Write(w io.Writer) error {
+	h := m.header()
+	h.Set("MAN", SsdpDiscover)
+	h.Set("ST", m.ST)
+	if m.MX > 0 {
+		h.Set("MX", strconv.Itoa(m.MX))
+	}
+	return writeRequest(w, MethodSearch, h)
+}
+
+func (m *SearchResponse) Write(w io.Writer) error {
+	h := m.rawHeader.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	h.Set("ST", m.ST)
+	h.Set("USN", m.USN)
+	h.Set("LOCATION", m.Location)
+	setIfNotEmpty(h, "SERVER", m.Server)
+	if _, ok := h["Ext"]; !ok {
+		h.Set("EXT", "")
+	}
+	return httpu.WriteResponse(w, &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     h,
+	})
 }
 
 var rxMaxAge = regexp.MustCompile(`\bmax-age\s*=\s*(\d+)\b`)
@@ -0,0 +1,209 @@
+package ssdp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// parseRaw reads data, a captured request or response, and returns its typed
+// message. Like the gopacket layer, it accepts data missing the final empty
+// line.
+func parseRaw(tb testing.TB, data []byte) (Message, error) {
+	tb.Helper()
+	if !bytes.HasSuffix(data, []byte("\r\n\r\n")) {
+		data = append(bytes.TrimRight(data, "\r\n"), "\r\n\r\n"...)
+	}
+	r := bufio.NewReader(bytes.NewReader(data))
+	if bytes.HasPrefix(data, []byte("HTTP/")) {
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			tb.Fatalf("ReadResponse: %v", err)
+		}
+		return ParseMessage(res)
+	}
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		tb.Fatalf("ReadRequest: %v", err)
+	}
+	return ParseMessage(req)
+}
+
+func TestParseCaptures(t *testing.T) {
+	captures := captures(t)
+	for _, tt := range []struct {
+		file  string
+		check func(t *testing.T, msg Message)
+	}{
+		{"sonos-notify-alive.txt", func(t *testing.T, msg Message) {
+			m := msg.(*AliveMessage)
+			if m.MaxAge() != 1800 || m.Type != "urn:schemas-upnp-org:device:ZonePlayer:1" ||
+				m.Location != "http://192.168.1.23:1400/xml/device_description.xml" ||
+				m.USN != "uuid:RINCON_000E58A0B1C201400::urn:schemas-upnp-org:device:ZonePlayer:1" {
+				t.Errorf("parsed %+v", m)
+			}
+		}},
+		{"router-notify-no-final-crlf.txt", func(t *testing.T, msg Message) {
+			if m := msg.(*AliveMessage); m.MaxAge() != 120 || m.Server != "OpenWRT/OpenWrt UPnP/1.1 MiniUPnPd/2.3.3" {
+				t.Errorf("parsed %+v", m)
+			}
+		}},
+		{"samsung-tv-notify-byebye.txt", func(t *testing.T, msg Message) {
+			if m := msg.(*ByeMessage); m.USN != "uuid:2007e9e6-2ec1-f097-f2df-944770ea00a3::urn:samsung.com:device:RemoteControlReceiver:1" {
+				t.Errorf("parsed %+v", m)
+			}
+		}},
+		{"chromecast-msearch.txt", func(t *testing.T, msg Message) {
+			if m := msg.(*SearchMessage); m.MX != 1 || m.ST != "urn:dial-multiscreen-org:service:dial:1" {
+				t.Errorf("parsed %+v", m)
+			}
+		}},
+		{"windows-msearch.txt", func(t *testing.T, msg Message) {
+			if m := msg.(*SearchMessage); m.MX != 3 || m.ST != "urn:schemas-upnp-org:device:InternetGatewayDevice:1" {
+				t.Errorf("parsed %+v", m)
+			}
+		}},
+		{"hue-response-lowercase.txt", func(t *testing.T, msg Message) {
+			m := msg.(*SearchResponse)
+			if m.MaxAge() != 100 || m.ST != "upnp:rootdevice" || m.Get("hue-bridgeid") != "001788FFFE23BFC2" {
+				t.Errorf("parsed %+v", m)
+			}
+		}},
+		{"lg-tv-response.txt", func(t *testing.T, msg Message) {
+			if m := msg.(*SearchResponse); m.MaxAge() != 1800 || m.Location != "http://192.168.1.41:1825/ba1c2c3e-6b1e-4a51-9a5d-0c1d3e2f6a77.xml" {
+				t.Errorf("parsed %+v", m)
+			}
+		}},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			data, ok := captures[tt.file]
+			if !ok {
+				t.Fatalf("no capture %s", tt.file)
+			}
+			msg, err := parseRaw(t, data)
+			if err != nil {
+				t.Fatalf("ParseMessage: %v", err)
+			}
+			tt.check(t, msg)
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	const (
+		alive  = "NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:alive\r\nUSN: uuid:a\r\n"
+		update = "NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:update\r\nUSN: uuid:a\r\nLOCATION: http://10.0.0.1/\r\n"
+		search = "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nST: ssdp:all\r\n"
+		ok     = "HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nUSN: uuid:a\r\n"
+	)
+	for _, tt := range []struct {
+		name, data string
+	}{
+		{"notify without USN", "NOTIFY * HTTP/1.1\r\nNT: upnp:rootdevice\r\nNTS: ssdp:byebye\r\n"},
+		{"unknown NTS", "NOTIFY * HTTP/1.1\r\nNT: upnp:rootdevice\r\nNTS: ssdp:gone\r\nUSN: uuid:a\r\n"},
+		{"alive without LOCATION", alive + "CACHE-CONTROL: max-age=60\r\n"},
+		{"alive without CACHE-CONTROL", alive + "LOCATION: http://10.0.0.1/\r\n"},
+		{"alive without max-age", alive + "LOCATION: http://10.0.0.1/\r\nCACHE-CONTROL: no-cache\r\n"},
+		{"update without NEXTBOOTID", update + "BOOTID.UPNP.ORG: 1\r\n"},
+		{"update with bad BOOTID", update + "BOOTID.UPNP.ORG: one\r\nNEXTBOOTID.UPNP.ORG: 2\r\n"},
+		{"search with unquoted MAN", search + "MAN: ssdp:discover\r\nMX: 1\r\n"},
+		{"search without MAN", search + "MX: 1\r\n"},
+		{"multicast search without MX", search + "MAN: \"ssdp:discover\"\r\n"},
+		{"search with MX 0", search + "MAN: \"ssdp:discover\"\r\nMX: 0\r\n"},
+		{"search with bad MX", search + "MAN: \"ssdp:discover\"\r\nMX: soon\r\n"},
+		{"unsupported method", "SUBSCRIBE * HTTP/1.1\r\n"},
+		{"response with error status", "HTTP/1.1 404 Not Found\r\n"},
+		{"response without LOCATION", ok + "CACHE-CONTROL: max-age=60\r\n"},
+		{"response without max-age", ok + "LOCATION: http://10.0.0.1/\r\nCACHE-CONTROL: private\r\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseRaw(t, []byte(tt.data))
+			if !errors.Is(err, ErrInvalidMessage) {
+				t.Errorf("ParseMessage = %+v, %v; want ErrInvalidMessage", msg, err)
+			}
+		})
+	}
+}
+
+func TestParseSearchMX(t *testing.T) {
+	for _, tt := range []struct {
+		name, data string
+		mx         int
+	}{
+		{"in range", "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\nST: ssdp:all\r\n", 2},
+		{"clamped", "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 120\r\nST: ssdp:all\r\n", MaxMX},
+		{"unicast without MX", "M-SEARCH * HTTP/1.1\r\nHOST: 192.168.1.23:1900\r\nMAN: \"ssdp:discover\"\r\nST: ssdp:all\r\n", 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseRaw(t, []byte(tt.data))
+			if err != nil {
+				t.Fatalf("ParseMessage: %v", err)
+			}
+			if got := msg.(*SearchMessage).MX; got != tt.mx {
+				t.Errorf("MX = %d, want %d", got, tt.mx)
+			}
+		})
+	}
+}
+
+func TestParseUpdate(t *testing.T) {
+	msg, err := parseRaw(t, []byte("NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\nNTS: ssdp:update\r\n"+
+		"USN: uuid:a::upnp:rootdevice\r\nLOCATION: http://10.0.0.1/d.xml\r\nBOOTID.UPNP.ORG: 7\r\nNEXTBOOTID.UPNP.ORG: 8\r\n"))
+	if err != nil {
+		t.Fatalf("ParseMessage: %v", err)
+	}
+	m := msg.(*UpdateMessage)
+	if m.BootID != 7 || m.NextBootID != 8 || m.USN != "uuid:a::upnp:rootdevice" || m.Location != "http://10.0.0.1/d.xml" {
+		t.Errorf("parsed %+v", m)
+	}
+}
+
+func TestBuildersWrite(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		msg   Message
+		lines []string
+	}{
+		{"alive", NewAliveMessage("upnp:rootdevice", "uuid:a::upnp:rootdevice", "http://10.0.0.1/d.xml", "Linux UPnP/1.0 test/1", 1800), []string{
+			"NOTIFY * HTTP/1.1", "HOST: 239.255.255.250:1900", "NT: upnp:rootdevice", "NTS: ssdp:alive", "USN: uuid:a::upnp:rootdevice",
+			"LOCATION: http://10.0.0.1/d.xml", "CACHE-CONTROL: max-age=1800", "SERVER: Linux UPnP/1.0 test/1",
+		}},
+		{"byebye", NewByeMessage("upnp:rootdevice", "uuid:a::upnp:rootdevice"), []string{
+			"NOTIFY * HTTP/1.1", "HOST: 239.255.255.250:1900", "NT: upnp:rootdevice", "NTS: ssdp:byebye", "USN: uuid:a::upnp:rootdevice",
+		}},
+		{"update", NewUpdateMessage("upnp:rootdevice", "uuid:a::upnp:rootdevice", "http://10.0.0.1/d.xml", 7, 8), []string{
+			"NOTIFY * HTTP/1.1", "HOST: 239.255.255.250:1900", "NT: upnp:rootdevice", "NTS: ssdp:update", "USN: uuid:a::upnp:rootdevice",
+			"LOCATION: http://10.0.0.1/d.xml", "BOOTID.UPNP.ORG: 7", "NEXTBOOTID.UPNP.ORG: 8",
+		}},
+		{"search", NewSearchMessage(SsdpAll, 2), []string{
+			"M-SEARCH * HTTP/1.1", "HOST: 239.255.255.250:1900", "MAN: \"ssdp:discover\"", "MX: 2", "ST: ssdp:all",
+		}},
+		{"search without MX", NewSearchMessage(SsdpAll, 0), []string{
+			"M-SEARCH * HTTP/1.1", "HOST: 239.255.255.250:1900", "MAN: \"ssdp:discover\"", "MX: 2", "ST: ssdp:all",
+		}},
+		{"search with a large MX", NewSearchMessage(SsdpAll, 60), []string{
+			"M-SEARCH * HTTP/1.1", "HOST: 239.255.255.250:1900", "MAN: \"ssdp:discover\"", "MX: 5", "ST: ssdp:all",
+		}},
+		{"response", NewSearchResponse("upnp:rootdevice", "uuid:a::upnp:rootdevice", "http://10.0.0.1/d.xml", "", 100), []string{
+			"HTTP/1.1 200 OK", "CACHE-CONTROL: max-age=100", "EXT: ", "LOCATION: http://10.0.0.1/d.xml",
+			"ST: upnp:rootdevice", "USN: uuid:a::upnp:rootdevice",
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.msg.Write(&buf); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			want := strings.Join(tt.lines, "\r\n") + "\r\n\r\n"
+			if got := buf.String(); got != want {
+				t.Errorf("Write =\n%q\nwant\n%q", got, want)
+			}
+			if _, err := parseRaw(t, buf.Bytes()); err != nil {
+				t.Errorf("ParseMessage of written message: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package ssdp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	registryEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "multicast_proxy",
+		Subsystem: "ssdp_registry",
+		Name:      "entries",
+		Help:      "Devices and services known to the SSDP registries.",
+	})
+
+	registryEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "multicast_proxy",
+		Subsystem: "ssdp_registry",
+		Name:      "events_total",
+		Help:      "SSDP registry events, by event type.",
+	}, []string{"event"})
+)
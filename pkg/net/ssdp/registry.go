@@ -2,10 +2,10 @@ package ssdp
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
-	"regexp"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -13,10 +13,9 @@ import (
 
 const (
 	maxExpiryTimeSeconds = 24 * 60 * 60
-)
-
-var (
-	maxAgeRx = regexp.MustCompile("max-age= *([0-9]+)")
+	// maxEntries bounds the number of entries in a registry; the entries
+	// closest to expiry are forgotten first.
+	maxEntries = 4096
 )
 
 type Entry struct {
@@ -48,27 +47,28 @@ type Entry struct {
 	CacheExpiry time.Time
 }
 
-func newEntryFromRequest(r *http.Request) (*Entry, error) {
-	now := time.Now()
-	expiryDuration, err := parseCacheControlMaxAge(r.Header.Get("CACHE-CONTROL"))
-	if err != nil {
-		return nil, fmt.Errorf("ssdp: error parsing CACHE-CONTROL max age: %v", err)
+// newEntry creates an entry for an announcement of usn at location, received
+// at now and expiring after maxAge seconds.
+func newEntry(msg SSDPMessage, usn, location string, maxAge int, now time.Time) (*Entry, error) {
+	if maxAge < 1 || maxAge > maxExpiryTimeSeconds {
+		return nil, fmt.Errorf("ssdp: rejecting bad expiry time of %d seconds", maxAge)
 	}
 
-	loc, err := url.Parse(r.Header.Get("LOCATION"))
+	loc, err := url.Parse(location)
 	if err != nil {
 		return nil, fmt.Errorf("ssdp: error parsing entry Location URL: %v", err)
 	}
 
-	bootID, err := parseUpnpIntHeader(r.Header, "BOOTID.UPNP.ORG", -1)
+	header := msg.Header()
+	bootID, err := parseUpnpIntHeader(header, "BOOTID.UPNP.ORG", -1)
 	if err != nil {
 		return nil, err
 	}
-	configID, err := parseUpnpIntHeader(r.Header, "CONFIGID.UPNP.ORG", -1)
+	configID, err := parseUpnpIntHeader(header, "CONFIGID.UPNP.ORG", -1)
 	if err != nil {
 		return nil, err
 	}
-	searchPort, err := parseUpnpIntHeader(r.Header, "SEARCHPORT.UPNP.ORG", SearchPort)
+	searchPort, err := parseUpnpIntHeader(header, "SEARCHPORT.UPNP.ORG", SearchPort)
 	if err != nil {
 		return nil, err
 	}
@@ -77,37 +77,26 @@ func newEntryFromRequest(r *http.Request) (*Entry, error) {
 		return nil, fmt.Errorf("ssdp: search port %d is out of range", searchPort)
 	}
 
+	var remoteAddr string
+	if msg.From != nil {
+		remoteAddr = msg.From.String()
+	}
 	return &Entry{
-		RemoteAddr:  r.RemoteAddr,
-		USN:         r.Header.Get("USN"),
-		NT:          r.Header.Get("NT"),
-		Server:      r.Header.Get("SERVER"),
-		Host:        r.Header.Get("HOST"),
-		Wakeup:      r.Header.Get("WAKEUP"),
+		RemoteAddr:  remoteAddr,
+		USN:         usn,
+		NT:          msg.Type,
+		Server:      header.Get("SERVER"),
+		Host:        header.Get("HOST"),
+		Wakeup:      header.Get("WAKEUP"),
 		Location:    *loc,
 		BootID:      bootID,
 		ConfigID:    configID,
 		SearchPort:  uint16(searchPort),
 		LastUpdate:  now,
-		CacheExpiry: now.Add(expiryDuration),
+		CacheExpiry: now.Add(time.Duration(maxAge) * time.Second),
 	}, nil
 }
 
-func parseCacheControlMaxAge(cc string) (time.Duration, error) {
-	matches := maxAgeRx.FindStringSubmatch(cc)
-	if len(matches) != 2 {
-		return 0, fmt.Errorf("did not find exactly one max-age in cache control header: %q", cc)
-	}
-	expirySeconds, err := strconv.ParseInt(matches[1], 10, 16)
-	if err != nil {
-		return 0, err
-	}
-	if expirySeconds < 1 || expirySeconds > maxExpiryTimeSeconds {
-		return 0, fmt.Errorf("rejecting bad expiry time of %d seconds", expirySeconds)
-	}
-	return time.Duration(expirySeconds) * time.Second, nil
-}
-
 // parseUpnpIntHeader is intended to parse the
 // {BOOT,CONFIGID,SEARCHPORT}.UPNP.ORG header fields. It returns the def if
 // the head is empty or missing.
@@ -160,16 +149,49 @@ type Update struct {
 type Registry struct {
 	lock  sync.Mutex
 	byUSN map[string]*Entry
+	now   func() time.Time
 
 	listenersLock sync.RWMutex
 	listeners     map[chan<- Update]struct{}
+
+	logger *slog.Logger
 }
 
-func NewRegistry() *Registry {
-	return &Registry{
+// RegistryOption configures a Registry.
+type RegistryOption func(*Registry)
+
+// WithLogger sets the logger used to report malformed NOTIFY messages.
+func WithLogger(logger *slog.Logger) RegistryOption {
+	return func(reg *Registry) {
+		reg.logger = logger
+	}
+}
+
+func NewRegistry(opts ...RegistryOption) *Registry {
+	reg := &Registry{
 		byUSN:     make(map[string]*Entry),
+		now:       time.Now,
 		listeners: make(map[chan<- Update]struct{}),
+		logger:    slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(reg)
 	}
+	return reg
+}
+
+// Entries returns the entries currently known to the registry, sorted by USN.
+// Expired entries are dropped.
+func (reg *Registry) Entries() []*Entry {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	reg.purgeLocked(reg.now())
+	entries := make([]*Entry, 0, len(reg.byUSN))
+	for _, entry := range reg.byUSN {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].USN < entries[j].USN })
+	return entries
 }
 
 func (reg *Registry) AddListener(c chan<- Update) {
@@ -185,6 +207,8 @@ func (reg *Registry) RemoveListener(c chan<- Update) {
 }
 
 func (reg *Registry) sendUpdate(u Update) {
+	registryEvents.WithLabelValues(u.EventType.String()).Inc()
+
 	reg.listenersLock.RLock()
 	defer reg.listenersLock.RUnlock()
 	for c := range reg.listeners {
@@ -193,39 +217,83 @@ func (reg *Registry) sendUpdate(u Update) {
 }
 
 // ServeMessage implements httpu.Handler, and uses SSDP NOTIFY requests to
-// maintain the registry of devices and services.
+// maintain the registry of devices and services. Messages that are not valid,
+// see ParseMessage, are logged and ignored.
 func (reg *Registry) ServeMessage(r *http.Request) {
 	if r.Method != MethodNotify {
 		return
 	}
+	msg, err := ParseMessage(r)
+	if err == nil {
+		err = reg.Observe(msg)
+	}
+	if err != nil {
+		reg.logger.Warn("ssdp: failed to handle message", "nts", r.Header.Get("NTS"), "from", r.RemoteAddr, "error", err)
+	}
+}
 
-	nts := r.Header.Get("nts")
+// Observe updates the registry with an announcement: an *AliveMessage,
+// *UpdateMessage or *ByeMessage. Other messages are ignored.
+func (reg *Registry) Observe(msg Message) error {
+	switch m := msg.(type) {
+	case *AliveMessage:
+		return reg.handleAlive(m)
+	case *UpdateMessage:
+		return reg.handleUpdate(m)
+	case *ByeMessage:
+		reg.handleByebye(m)
+	}
+	return nil
+}
 
-	var err error
-	switch nts {
-	case NtsAlive:
-		err = reg.handleNTSAlive(r)
-	case NtsUpdate:
-		err = reg.handleNTSUpdate(r)
-	case NtsByebye:
-		err = reg.handleNTSByebye(r)
-	default:
-		err = fmt.Errorf("unknown NTS value: %q", nts)
+func (reg *Registry) store(entry *Entry) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	_, known := reg.byUSN[entry.USN]
+	if !known && len(reg.byUSN) >= maxEntries {
+		reg.evictLocked(reg.now())
 	}
-	if err != nil {
-		log.Printf("goupnp/ssdp: failed to handle %s message from %s: %v", nts, r.RemoteAddr, err)
+	reg.byUSN[entry.USN] = entry
+
+	if !known {
+		registryEntries.Inc()
+	}
+}
+
+// purgeLocked drops the entries that expired before now.
+func (reg *Registry) purgeLocked(now time.Time) {
+	for usn, entry := range reg.byUSN {
+		if !now.Before(entry.CacheExpiry) {
+			delete(reg.byUSN, usn)
+			registryEntries.Dec()
+		}
+	}
+}
+
+// evictLocked drops the expired entries, or the one closest to expiry if
+// none has expired.
+func (reg *Registry) evictLocked(now time.Time) {
+	reg.purgeLocked(now)
+	if len(reg.byUSN) < maxEntries {
+		return
 	}
+	var oldest *Entry
+	for _, entry := range reg.byUSN {
+		if oldest == nil || entry.CacheExpiry.Before(oldest.CacheExpiry) {
+			oldest = entry
+		}
+	}
+	delete(reg.byUSN, oldest.USN)
+	registryEntries.Dec()
 }
 
-func (reg *Registry) handleNTSAlive(r *http.Request) error {
-	entry, err := newEntryFromRequest(r)
+func (reg *Registry) handleAlive(m *AliveMessage) error {
+	entry, err := newEntry(m.SSDPMessage, m.USN, m.Location, m.MaxAge(), reg.now())
 	if err != nil {
 		return err
 	}
 
-	reg.lock.Lock()
-	reg.byUSN[entry.USN] = entry
-	reg.lock.Unlock()
+	reg.store(entry)
 
 	reg.sendUpdate(Update{
 		USN:       entry.USN,
@@ -236,20 +304,26 @@ func (reg *Registry) handleNTSAlive(r *http.Request) error {
 	return nil
 }
 
-func (reg *Registry) handleNTSUpdate(r *http.Request) error {
-	entry, err := newEntryFromRequest(r)
-	if err != nil {
-		return err
+func (reg *Registry) handleUpdate(m *UpdateMessage) error {
+	// ssdp:update carries no CACHE-CONTROL: the entry keeps the expiry of
+	// the last ssdp:alive, if any.
+	maxAge := extractMaxAge(m.Get("CACHE-CONTROL"), -1)
+	if maxAge < 0 {
+		reg.lock.Lock()
+		previous, known := reg.byUSN[m.USN]
+		reg.lock.Unlock()
+		if !known || !reg.now().Before(previous.CacheExpiry) {
+			return fmt.Errorf("ssdp: update for unknown USN %q without max-age", m.USN)
+		}
+		maxAge = max(int(previous.CacheExpiry.Sub(reg.now()).Seconds()), 1)
 	}
-	nextBootID, err := parseUpnpIntHeader(r.Header, "NEXTBOOTID.UPNP.ORG", -1)
+	entry, err := newEntry(m.SSDPMessage, m.USN, m.Location, maxAge, reg.now())
 	if err != nil {
 		return err
 	}
-	entry.BootID = nextBootID
+	entry.BootID = m.NextBootID
 
-	reg.lock.Lock()
-	reg.byUSN[entry.USN] = entry
-	reg.lock.Unlock()
+	reg.store(entry)
 
 	reg.sendUpdate(Update{
 		USN:       entry.USN,
@@ -260,19 +334,21 @@ func (reg *Registry) handleNTSUpdate(r *http.Request) error {
 	return nil
 }
 
-func (reg *Registry) handleNTSByebye(r *http.Request) error {
-	usn := r.Header.Get("USN")
+func (reg *Registry) handleByebye(m *ByeMessage) {
+	usn := m.USN
 
 	reg.lock.Lock()
-	entry := reg.byUSN[usn]
+	entry, known := reg.byUSN[usn]
 	delete(reg.byUSN, usn)
 	reg.lock.Unlock()
 
+	if known {
+		registryEntries.Dec()
+	}
+
 	reg.sendUpdate(Update{
 		USN:       usn,
 		EventType: EventByeBye,
 		Entry:     entry,
 	})
-
-	return nil
 }
@@ -0,0 +1,59 @@
+package ssdp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRegistryExpiry(t *testing.T) {
+	now := time.Now()
+	reg := NewRegistry()
+	reg.now = func() time.Time { return now }
+
+	alive := NewAliveMessage("upnp:rootdevice", "uuid:a::upnp:rootdevice", "http://192.168.1.23:1400/desc.xml", "", 60)
+	if err := reg.Observe(alive); err != nil {
+		t.Fatal(err)
+	}
+	if got := reg.Entries(); len(got) != 1 {
+		t.Fatalf("Entries() = %v, want one entry", got)
+	}
+
+	now = now.Add(60 * time.Second)
+	if got := reg.Entries(); len(got) != 0 {
+		t.Errorf("Entries() after max-age = %v, want none", got)
+	}
+	if len(reg.byUSN) != 0 {
+		t.Errorf("registry holds %d expired entries", len(reg.byUSN))
+	}
+
+	update := NewUpdateMessage("upnp:rootdevice", "uuid:a::upnp:rootdevice", "http://192.168.1.23:1400/desc.xml", 1, 2)
+	if err := reg.Observe(update); err == nil {
+		t.Error("update of an expired entry without max-age accepted")
+	}
+}
+
+func TestRegistryEvictsClosestToExpiry(t *testing.T) {
+	now := time.Now()
+	reg := NewRegistry()
+	reg.now = func() time.Time { return now }
+
+	for i := 0; i < maxEntries; i++ {
+		usn := fmt.Sprintf("uuid:%d", i)
+		if err := reg.Observe(NewAliveMessage("upnp:rootdevice", usn, "http://192.168.1.23/", "", 60+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reg.Observe(NewAliveMessage("upnp:rootdevice", "uuid:new", "http://192.168.1.23/", "", 60)); err != nil {
+		t.Fatal(err)
+	}
+	if len(reg.byUSN) != maxEntries {
+		t.Errorf("registry holds %d entries, want %d", len(reg.byUSN), maxEntries)
+	}
+	if _, ok := reg.byUSN["uuid:0"]; ok {
+		t.Error("entry closest to expiry kept")
+	}
+	if _, ok := reg.byUSN["uuid:new"]; !ok {
+		t.Error("new entry not stored")
+	}
+}
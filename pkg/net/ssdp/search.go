@@ -2,70 +2,368 @@ package ssdp
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/home-sol/multicast-proxy/pkg/net/httpu"
+	"github.com/home-sol/multicast-proxy/pkg/net/netwatch"
 )
 
-// SSDPRawSearchCtx performs a fairly raw SSDP search request, and returns the
-// unique response(s) that it receives. Each response has the requested
-// searchTarget, a USN, and a valid location. maxWaitSeconds states how long to
-// wait for responses in seconds, and must be a minimum of 1 (the
-// implementation waits an additional 100ms for responses to arrive), 2 is a
-// reasonable value for this. numSends is the number of requests to send - 3 is
-// a reasonable value for this.
-func SSDPRawSearchCtx(ctx context.Context, client httpu.Client, searchTarget string, numSends int) ([]*http.Response, error) {
-	maxWaitSeconds := 4
-	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
-		maxWaitSeconds = int(deadline.Sub(time.Now()).Seconds())
+const (
+	// DefaultMX is the MX value used when the context has no deadline.
+	DefaultMX = 2
+	// MaxMX is the largest MX value allowed by UPnP 1.1.
+	MaxMX = 5
+	// DefaultNumSends is the number of times a search request is sent.
+	DefaultNumSends = 3
+)
+
+// SearchOptions configures Search.
+type SearchOptions struct {
+	// Targets lists the search targets (ST). A request for each is sent
+	// before awaiting responses to all of them. Defaults to SsdpAll.
+	Targets []string
+	// MX is the maximum response delay requested from devices, in seconds.
+	// Defaults to the time left until the context deadline, bounded by 1 and
+	// MaxMX, or DefaultMX without a deadline.
+	MX int
+	// NumSends is the number of times each request is sent. Defaults to
+	// DefaultNumSends.
+	NumSends int
+	// Network is "udp4", "udp6" or "udp" for both. Defaults to "udp4".
+	Network string
+	// Interfaces are used to create clients when Search is not given one,
+	// and to attribute responses to interfaces. Defaults to all interfaces.
+	Interfaces []net.Interface
+	// Watcher, if set, keeps the clients Search creates in line with the
+	// interfaces as they come and go, or get new addresses, during a long
+	// search.
+	Watcher *netwatch.Watcher
+	Logger  *slog.Logger
+}
+
+// SearchResult is a unique response to a search.
+type SearchResult struct {
+	Response *http.Response
+	ST       string
+	USN      string
+	Location *url.URL
+	// Interface and InterfaceIndex identify the interface the response was
+	// received on, if it could be determined.
+	Interface      string
+	InterfaceIndex int
+	LocalAddr      string
+	RemoteAddr     string
+}
+
+// Search sends SSDP search requests and delivers each unique, valid response
+// on the returned channel as soon as it arrives. The channel is closed when
+// the context is done; the returned function then reports any error.
+//
+// If client is nil, Search creates clients for opts.Network on
+// opts.Interfaces and closes them when done. Otherwise client searches
+// opts.Network, which must then be "udp4" or "udp6".
+func Search(ctx context.Context, client httpu.Client, opts SearchOptions) (<-chan SearchResult, func() error) {
+	results := make(chan SearchResult)
+	var searchErr error
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer close(results)
+		searchErr = search(ctx, client, opts, results)
+	}()
+
+	return results, func() error {
+		<-done
+		return searchErr
 	}
-	req := (&http.Request{
+}
+
+func search(ctx context.Context, client httpu.Client, opts SearchOptions, results chan<- SearchResult) (err error) {
+	if len(opts.Targets) == 0 {
+		opts.Targets = []string{SsdpAll}
+	}
+	if opts.NumSends <= 0 {
+		opts.NumSends = DefaultNumSends
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.MX == 0 {
+		opts.MX = mxFromContext(ctx)
+	}
+	if opts.MX < 1 || opts.MX > MaxMX {
+		return fmt.Errorf("ssdp: MX %d is out of range 1-%d", opts.MX, MaxMX)
+	}
+	// Follow every interface if none were named.
+	watchMatch := func(net.Interface) bool { return true }
+	if opts.Interfaces == nil {
+		if opts.Interfaces, err = net.Interfaces(); err != nil {
+			return err
+		}
+	} else {
+		names := make([]string, len(opts.Interfaces))
+		for i, intf := range opts.Interfaces {
+			names[i] = intf.Name
+		}
+		watchMatch = netwatch.MatchNames(names...)
+	}
+
+	networks, err := searchNetworks(opts.Network)
+	if err != nil {
+		return err
+	}
+	if client != nil && len(networks) > 1 {
+		return fmt.Errorf("ssdp: a client searches a single network, not %q", opts.Network)
+	}
+
+	clients := make(map[string]httpu.Client, len(networks))
+	for _, network := range networks {
+		if client != nil {
+			clients[network] = client
+			continue
+		}
+		c, err := httpu.NewClientNetwork(network, opts.Interfaces, httpu.WithLogger(opts.Logger))
+		if err != nil {
+			if len(networks) > 1 {
+				opts.Logger.Debug("ssdp: not searching on network", "network", network, "error", err)
+				continue
+			}
+			return err
+		}
+		defer func() {
+			if closeErr := c.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		if opts.Watcher != nil {
+			// Stop following interfaces before the client is closed.
+			watchCtx, stopWatching := context.WithCancel(ctx)
+			watching := make(chan struct{})
+			go func() {
+				defer close(watching)
+				c.Watch(watchCtx, opts.Watcher, watchMatch)
+			}()
+			defer func() {
+				stopWatching()
+				<-watching
+			}()
+		}
+		clients[network] = c
+	}
+
+	names := &interfaceNames{byIP: interfacesByIP(opts.Interfaces)}
+	if opts.Watcher != nil {
+		names.current = func() []net.Interface {
+			return opts.Watcher.Interfaces(watchMatch)
+		}
+	}
+	dedup := newSearchDedup(opts.Targets)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(clients))
+	for network, c := range clients {
+		// A client serves one request at a time: send every target in the
+		// same response window.
+		reqs := make([]*http.Request, len(opts.Targets))
+		for i, target := range opts.Targets {
+			reqs[i] = newSearchRequest(network, target, opts.MX).WithContext(ctx)
+		}
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.DoAllFunc(ctx, reqs, opts.NumSends, func(response *http.Response) error {
+				result, ok := dedup.accept(response, opts.Logger)
+				if !ok {
+					return nil
+				}
+				if result.Interface == "" {
+					result.Interface = names.name(result.LocalAddr)
+				}
+				select {
+				case results <- result:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for e := range errs {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func searchNetworks(network string) ([]string, error) {
+	switch network {
+	case "", "udp4":
+		return []string{"udp4"}, nil
+	case "udp6":
+		return []string{"udp6"}, nil
+	case "udp":
+		return []string{"udp4", "udp6"}, nil
+	default:
+		return nil, fmt.Errorf("ssdp: unsupported network %q", network)
+	}
+}
+
+func mxFromContext(ctx context.Context) int {
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		return DefaultMX
+	}
+	mx := int(time.Until(deadline).Seconds())
+	if mx < 1 {
+		return 1
+	}
+	if mx > MaxMX {
+		return MaxMX
+	}
+	return mx
+}
+
+func newSearchRequest(network, searchTarget string, mx int) *http.Request {
+	host := UDP4Addr
+	if network == "udp6" {
+		host = UDP6Addr
+	}
+	return &http.Request{
 		Method: MethodSearch,
-		// TODO: Support both IPv4 and IPv6.
-		Host: UDP4Addr,
-		URL:  &url.URL{Opaque: "*"},
+		Host:   host,
+		URL:    &url.URL{Opaque: "*"},
 		Header: http.Header{
 			// Putting headers in here avoids them being title-cased.
 			// (The UPnP discovery protocol uses case-sensitive headers)
-			"HOST": []string{UDP4Addr},
-			"MX":   []string{strconv.FormatInt(int64(maxWaitSeconds), 10)},
+			"HOST": []string{host},
+			"MX":   []string{strconv.Itoa(mx)},
 			"MAN":  []string{SsdpDiscover},
 			"ST":   []string{searchTarget},
 		},
-	}).WithContext(ctx)
-	allResponses, err := client.Do(ctx, req, numSends)
-	if err != nil {
-		return nil, err
 	}
+}
 
-	isExactSearch := searchTarget != SsdpAll && searchTarget != UPNPRootDevice
+// interfaceNames names the interfaces of local addresses. With current set,
+// it follows the interfaces as they come and go, or get new addresses.
+type interfaceNames struct {
+	lock    sync.Mutex
+	byIP    map[string]string
+	current func() []net.Interface
+}
 
-	seenIDs := make(map[string]bool, len(allResponses))
-	var responses []*http.Response
-	for _, response := range allResponses {
-		if response.StatusCode != 200 {
-			log.Printf("ssdp: got response status code %q in search response", response.Status)
-			continue
-		}
-		if st := response.Header.Get("ST"); isExactSearch && st != searchTarget {
-			continue
-		}
-		usn := response.Header.Get("USN")
-		loc, err := response.Location()
+func (n *interfaceNames) name(ip string) string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if name, ok := n.byIP[ip]; ok || n.current == nil {
+		return name
+	}
+	n.byIP = interfacesByIP(n.current())
+	return n.byIP[ip]
+}
+
+func interfacesByIP(interfaces []net.Interface) map[string]string {
+	byIP := make(map[string]string)
+	for _, intf := range interfaces {
+		addrs, err := intf.Addrs()
 		if err != nil {
-			// No usable location in search response - discard.
 			continue
 		}
-		id := loc.String() + "\x00" + usn
-		if _, alreadySeen := seenIDs[id]; !alreadySeen {
-			seenIDs[id] = true
-			responses = append(responses, response)
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				byIP[ipNet.IP.String()] = intf.Name
+			}
+		}
+	}
+	return byIP
+}
+
+// searchDedup filters search responses, keeping the first valid response of
+// each device location and USN.
+type searchDedup struct {
+	lock          sync.Mutex
+	seen          map[string]bool
+	targets       map[string]bool
+	isExactSearch bool
+}
+
+func newSearchDedup(targets []string) *searchDedup {
+	d := &searchDedup{
+		seen:          make(map[string]bool),
+		targets:       make(map[string]bool, len(targets)),
+		isExactSearch: true,
+	}
+	for _, target := range targets {
+		d.targets[target] = true
+		if target == SsdpAll || target == UPNPRootDevice {
+			d.isExactSearch = false
 		}
 	}
+	return d
+}
 
-	return responses, nil
+func (d *searchDedup) accept(response *http.Response, logger *slog.Logger) (SearchResult, bool) {
+	if response.StatusCode != 200 {
+		logger.Debug("ssdp: unexpected status in search response", "status", response.Status)
+		return SearchResult{}, false
+	}
+	st := response.Header.Get("ST")
+	if d.isExactSearch && !d.targets[st] {
+		return SearchResult{}, false
+	}
+	usn := response.Header.Get("USN")
+	loc, err := response.Location()
+	if err != nil {
+		// No usable location in search response - discard.
+		return SearchResult{}, false
+	}
+
+	origin := httpu.ResponseOrigin(response)
+	id := loc.String() + "\x00" + usn
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.seen[id] {
+		return SearchResult{}, false
+	}
+	d.seen[id] = true
+
+	return SearchResult{
+		Response:       response,
+		ST:             st,
+		USN:            usn,
+		Location:       loc,
+		Interface:      origin.Interface,
+		InterfaceIndex: origin.Index,
+		LocalAddr:      origin.LocalAddr,
+		RemoteAddr:     response.Header.Get(httpu.RemoteAddressHeader),
+	}, true
+}
+
+// SSDPRawSearchCtx performs a fairly raw SSDP search request, and returns the
+// unique response(s) that it receives. Each response has the requested
+// searchTarget, a USN, and a valid location. The search lasts until the
+// context deadline, which also determines the MX value. numSends is the
+// number of requests to send - 3 is a reasonable value for this.
+func SSDPRawSearchCtx(ctx context.Context, client httpu.Client, searchTarget string, numSends int) ([]*http.Response, error) {
+	results, wait := Search(ctx, client, SearchOptions{
+		Targets:  []string{searchTarget},
+		NumSends: numSends,
+	})
+	var responses []*http.Response
+	for result := range results {
+		responses = append(responses, result.Response)
+	}
+	return responses, wait()
 }
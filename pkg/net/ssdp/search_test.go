@@ -0,0 +1,124 @@
+package ssdp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/home-sol/multicast-proxy/pkg/net/httpu"
+)
+
+// fakeClient answers each search request with one response from a device
+// of the searched type, and allows a single request at a time, like the
+// httpu client.
+type fakeClient struct {
+	busy chan struct{}
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{busy: make(chan struct{}, 1)}
+}
+
+func (c *fakeClient) Close() error { return nil }
+
+func (c *fakeClient) Do(ctx context.Context, req *http.Request, numSends int) ([]*http.Response, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeClient) DoFunc(ctx context.Context, req *http.Request, numSends int, fn httpu.ResponseFunc) error {
+	return c.DoAllFunc(ctx, []*http.Request{req}, numSends, fn)
+}
+
+func (c *fakeClient) DoAllFunc(ctx context.Context, reqs []*http.Request, numSends int, fn httpu.ResponseFunc) error {
+	select {
+	case c.busy <- struct{}{}:
+		defer func() { <-c.busy }()
+	default:
+		return errors.New("request already in progress")
+	}
+	for _, req := range reqs {
+		st := req.Header["ST"][0]
+		response := &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Header: http.Header{
+				"St":       {st},
+				"Usn":      {"uuid:" + st},
+				"Location": {"http://192.168.1.23/" + st + ".xml"},
+			},
+		}
+		if err := fn(response); err != nil {
+			return err
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestSearchTargets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	results, wait := Search(ctx, newFakeClient(), SearchOptions{
+		Targets:  []string{"urn:a", "urn:b"},
+		MX:       1,
+		NumSends: 1,
+	})
+	var sts []string
+	for result := range results {
+		sts = append(sts, result.ST)
+	}
+	if err := wait(); err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	sort.Strings(sts)
+	if len(sts) != 2 || sts[0] != "urn:a" || sts[1] != "urn:b" {
+		t.Errorf("results for %v, want [urn:a urn:b]", sts)
+	}
+}
+
+func TestSearchClientNetwork(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	results, wait := Search(ctx, newFakeClient(), SearchOptions{MX: 1, NumSends: 1, Network: "udp"})
+	for result := range results {
+		t.Errorf("result %+v", result)
+	}
+	if err := wait(); err == nil {
+		t.Error("Search with a client on both networks succeeded")
+	}
+
+	results, wait = Search(ctx, newFakeClient(), SearchOptions{MX: 1, NumSends: 1, Network: "udp6"})
+	n := 0
+	for range results {
+		n++
+	}
+	if err := wait(); err != nil || n != 1 {
+		t.Errorf("Search with a client on udp6 = %d results, %v; want 1", n, err)
+	}
+}
+
+func TestInterfaceNamesRefresh(t *testing.T) {
+	all, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loopback := interfacesByIP(all)["127.0.0.1"]
+	if loopback == "" {
+		t.Skip("no interface with 127.0.0.1")
+	}
+
+	stale := &interfaceNames{byIP: map[string]string{}}
+	if got := stale.name("127.0.0.1"); got != "" {
+		t.Errorf("name without refresh = %q, want none", got)
+	}
+	names := &interfaceNames{byIP: map[string]string{}, current: func() []net.Interface { return all }}
+	if got := names.name("127.0.0.1"); got != loopback {
+		t.Errorf("name after an interface appeared = %q, want %q", got, loopback)
+	}
+}
@@ -11,6 +11,7 @@ const (
 
 	SearchPort = 1900
 	UDP4Addr   = "239.255.255.250:1900"
+	UDP6Addr   = "[FF02::C]:1900"
 
 	// SsdpAll is a value for searchTarget that searches for all devices and services.
 	SsdpAll = "ssdp:all"
@@ -0,0 +1,400 @@
+package upnp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MethodSubscribe and MethodUnsubscribe are the GENA methods control
+	// points send to event URLs; devices deliver events with MethodNotify.
+	MethodSubscribe   = "SUBSCRIBE"
+	MethodUnsubscribe = "UNSUBSCRIBE"
+	MethodNotify      = "NOTIFY"
+
+	// NotifyPrefix starts the paths of the callbacks given to devices.
+	NotifyPrefix = "/gena/notify/"
+
+	// maxEventBytes bounds the size of an event body.
+	maxEventBytes = 1 << 20
+	// maxSubscriptions bounds the number of subscriptions held, each of
+	// which is also held on a device.
+	maxSubscriptions = 1024
+)
+
+// EventProxy subscribes to device events on behalf of control points and
+// relays the events to them. Control points subscribe to proxied event URLs,
+// see ProxyURL; the SID of the device subscription is passed through.
+type EventProxy struct {
+	// Port is the port devices reach the proxy on for callbacks.
+	Port int
+	// Allow reports whether a device host:port may be proxied for the
+	// request of a control point. If nil, every host is allowed.
+	Allow func(r *http.Request, hostport string) bool
+	// Client sends requests to devices and control points. If nil, a client
+	// with a 10 second timeout is used.
+	Client *http.Client
+	// Logger reports failures. If nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	lock          sync.Mutex
+	subscriptions map[string]*subscription
+	// pending counts the subscriptions being made on devices.
+	pending int
+	now     func() time.Time
+}
+
+// subscription is a device subscription held for a control point.
+type subscription struct {
+	id        string
+	sid       string
+	eventURL  *url.URL
+	callbacks []*url.URL
+	expiry    time.Time
+}
+
+func (p *EventProxy) logger() *slog.Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return slog.Default()
+}
+
+func (p *EventProxy) currentTime() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+func (p *EventProxy) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+// ServeHTTP handles SUBSCRIBE and UNSUBSCRIBE requests for proxied event URLs
+// and NOTIFY requests from devices.
+func (p *EventProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == MethodNotify && strings.HasPrefix(r.URL.Path, NotifyPrefix) {
+		p.notify(w, r)
+		return
+	}
+
+	target, err := targetURL(r.URL)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if p.Allow != nil && !p.Allow(r, target.Host) {
+		http.Error(w, "device not known", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case MethodSubscribe:
+		if r.Header.Get("SID") != "" {
+			p.renew(w, r, target)
+			return
+		}
+		p.subscribe(w, r, target)
+	case MethodUnsubscribe:
+		p.unsubscribe(w, r, target)
+	default:
+		w.Header().Set("Allow", MethodSubscribe+", "+MethodUnsubscribe)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *EventProxy) subscribe(w http.ResponseWriter, r *http.Request, target *url.URL) {
+	if r.Header.Get("NT") != "upnp:event" {
+		http.Error(w, "NT must be upnp:event", http.StatusPreconditionFailed)
+		return
+	}
+	// Only relay events to the control point itself.
+	remoteIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	callbacks, err := parseCallbacks(r.Header.Get("CALLBACK"), net.ParseIP(remoteIP))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	p.lock.Lock()
+	p.pruneLocked()
+	if len(p.subscriptions)+p.pending >= maxSubscriptions {
+		p.lock.Unlock()
+		p.logger().Warn("upnp: too many subscriptions", "max", maxSubscriptions)
+		http.Error(w, "too many subscriptions", http.StatusServiceUnavailable)
+		return
+	}
+	p.pending++
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		p.pending--
+		p.lock.Unlock()
+	}()
+
+	id, err := newCallbackID()
+	if err != nil {
+		p.logger().Error("upnp: failed to generate a callback id", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	callback, err := p.callbackURL(target, id)
+	if err != nil {
+		p.logger().Warn("upnp: no callback address for device", "device", target.Host, "error", err)
+		http.Error(w, "device unreachable", http.StatusBadGateway)
+		return
+	}
+	header := http.Header{
+		"CALLBACK": {"<" + callback.String() + ">"},
+		"NT":       {"upnp:event"},
+	}
+	copyHeader(header, r.Header, "TIMEOUT", "STATEVAR")
+	res, err := p.send(r.Context(), MethodSubscribe, target, header, nil)
+	if err != nil {
+		p.logger().Warn("upnp: subscribing to device failed", "url", target, "error", err)
+		http.Error(w, "device unreachable", http.StatusBadGateway)
+		return
+	}
+	sid := res.Header.Get("SID")
+	if res.StatusCode != http.StatusOK || sid == "" {
+		copyResponse(w, res)
+		return
+	}
+
+	sub := &subscription{
+		id:        id,
+		sid:       sid,
+		eventURL:  target,
+		callbacks: callbacks,
+		expiry:    expiry(res.Header.Get("TIMEOUT"), p.currentTime()),
+	}
+	p.lock.Lock()
+	if p.subscriptions == nil {
+		p.subscriptions = make(map[string]*subscription)
+	}
+	p.subscriptions[id] = sub
+	p.lock.Unlock()
+
+	p.logger().Info("upnp: subscribed for control point", "sid", sid, "url", target, "callback", callbacks[0])
+	copyResponse(w, res)
+}
+
+func (p *EventProxy) renew(w http.ResponseWriter, r *http.Request, target *url.URL) {
+	sub := p.bySID(r.Header.Get("SID"), target)
+	if sub == nil {
+		http.Error(w, "unknown subscription", http.StatusPreconditionFailed)
+		return
+	}
+	header := http.Header{"SID": {sub.sid}}
+	copyHeader(header, r.Header, "TIMEOUT")
+	res, err := p.send(r.Context(), MethodSubscribe, target, header, nil)
+	if err != nil {
+		http.Error(w, "device unreachable", http.StatusBadGateway)
+		return
+	}
+	if res.StatusCode == http.StatusOK {
+		p.lock.Lock()
+		sub.expiry = expiry(res.Header.Get("TIMEOUT"), p.currentTime())
+		p.lock.Unlock()
+	}
+	copyResponse(w, res)
+}
+
+func (p *EventProxy) unsubscribe(w http.ResponseWriter, r *http.Request, target *url.URL) {
+	sub := p.bySID(r.Header.Get("SID"), target)
+	if sub == nil {
+		http.Error(w, "unknown subscription", http.StatusPreconditionFailed)
+		return
+	}
+	p.lock.Lock()
+	delete(p.subscriptions, sub.id)
+	p.lock.Unlock()
+
+	res, err := p.send(r.Context(), MethodUnsubscribe, target, http.Header{"SID": {sub.sid}}, nil)
+	if err != nil {
+		// The subscription expires on the device anyway.
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	copyResponse(w, res)
+}
+
+// notify relays an event from a device to the first control point callback
+// accepting it.
+func (p *EventProxy) notify(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, NotifyPrefix)
+	p.lock.Lock()
+	sub := p.subscriptions[id]
+	p.lock.Unlock()
+	if sub == nil || r.Header.Get("SID") != sub.sid {
+		http.Error(w, "unknown subscription", http.StatusPreconditionFailed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxEventBytes))
+	if err != nil {
+		http.Error(w, "reading event failed", http.StatusBadRequest)
+		return
+	}
+	header := make(http.Header)
+	copyHeader(header, r.Header, "CONTENT-TYPE", "NT", "NTS", "SID", "SEQ")
+
+	for _, callback := range sub.callbacks {
+		res, err := p.send(r.Context(), MethodNotify, callback, header, body)
+		if err != nil {
+			p.logger().Debug("upnp: event delivery failed", "sid", sub.sid, "callback", callback, "error", err)
+			continue
+		}
+		w.WriteHeader(res.StatusCode)
+		return
+	}
+	p.logger().Warn("upnp: no control point callback accepted event", "sid", sub.sid)
+	http.Error(w, "control point unreachable", http.StatusBadGateway)
+}
+
+func (p *EventProxy) bySID(sid string, target *url.URL) *subscription {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pruneLocked()
+	for _, sub := range p.subscriptions {
+		if sub.sid == sid && sub.eventURL.String() == target.String() {
+			return sub
+		}
+	}
+	return nil
+}
+
+// pruneLocked drops expired subscriptions. p.lock must be held.
+func (p *EventProxy) pruneLocked() {
+	now := p.currentTime()
+	for id, sub := range p.subscriptions {
+		if now.After(sub.expiry) {
+			delete(p.subscriptions, id)
+		}
+	}
+}
+
+// callbackURL returns the callback URL for subscription id, on the local
+// address used to reach the device.
+func (p *EventProxy) callbackURL(target *url.URL, id string) (*url.URL, error) {
+	// Connecting a UDP socket sends nothing but picks the local address.
+	conn, err := net.Dial("udp", target.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr)
+	return &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(local.IP.String(), strconv.Itoa(p.Port)),
+		Path:   NotifyPrefix + id,
+	}, nil
+}
+
+func (p *EventProxy) send(ctx context.Context, method string, u *url.URL, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	// Keep the body, usually empty, for copyResponse.
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxEventBytes))
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(data))
+	return res, nil
+}
+
+// parseCallbacks parses a CALLBACK header: one or more URLs in angle
+// brackets, each on the host at ip.
+func parseCallbacks(header string, ip net.IP) ([]*url.URL, error) {
+	var callbacks []*url.URL
+	for {
+		start := strings.IndexByte(header, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(header[start:], '>')
+		if end < 0 {
+			return nil, errors.New("unterminated CALLBACK URL")
+		}
+		u, err := url.Parse(header[start+1 : start+end])
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			return nil, fmt.Errorf("invalid CALLBACK URL %q", header[start+1:start+end])
+		}
+		if !ip.Equal(net.ParseIP(u.Hostname())) {
+			return nil, fmt.Errorf("CALLBACK URL %q is not on the subscriber %s", u, ip)
+		}
+		callbacks = append(callbacks, u)
+		header = header[start+end+1:]
+	}
+	if len(callbacks) == 0 {
+		return nil, errors.New("missing CALLBACK")
+	}
+	return callbacks, nil
+}
+
+// expiry returns when a subscription made at now with the given TIMEOUT
+// header expires.
+func expiry(timeout string, now time.Time) time.Time {
+	seconds := 1800
+	if s, ok := strings.CutPrefix(strings.ToLower(timeout), "second-"); ok {
+		if s == "infinite" {
+			seconds = 24 * 60 * 60
+		} else if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			seconds = n
+		}
+	}
+	return now.Add(time.Duration(seconds) * time.Second)
+}
+
+func copyHeader(dst, src http.Header, names ...string) {
+	for _, name := range names {
+		if v := src.Get(name); v != "" {
+			dst[name] = []string{v}
+		}
+	}
+}
+
+func copyResponse(w http.ResponseWriter, res *http.Response) {
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(w, res.Body)
+}
+
+// newCallbackID returns a random id for a callback path, so that only the
+// device given the callback can guess it.
+func newCallbackID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
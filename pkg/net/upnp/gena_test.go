@@ -0,0 +1,262 @@
+package upnp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// controlPointAddr is the address control points subscribe from in tests,
+// where their callback servers listen.
+const controlPointAddr = "127.0.0.1:50000"
+
+// fakeDevice is a device accepting one event subscription at a time.
+type fakeDevice struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	callback string
+	requests []string
+}
+
+func newFakeDevice(t *testing.T) *fakeDevice {
+	d := &fakeDevice{}
+	d.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		d.requests = append(d.requests, r.Method+" "+r.Header.Get("SID"))
+		switch {
+		case r.Method == MethodSubscribe && r.Header.Get("SID") == "":
+			d.callback = strings.Trim(r.Header.Get("CALLBACK"), "<>")
+			w.Header().Set("SID", "uuid:device-sid")
+			w.Header().Set("TIMEOUT", "Second-300")
+		case r.Header.Get("SID") != "uuid:device-sid":
+			w.WriteHeader(http.StatusPreconditionFailed)
+		case r.Method == MethodSubscribe:
+			w.Header().Set("SID", "uuid:device-sid")
+			w.Header().Set("TIMEOUT", "Second-600")
+		}
+	}))
+	t.Cleanup(d.Close)
+	return d
+}
+
+// eventURL returns the proxied event URL of the device.
+func (d *fakeDevice) eventURL(t *testing.T) string {
+	target, err := url.Parse(d.URL + "/event")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ProxyURL(&url.URL{Scheme: "http", Host: "proxy.test"}, target).String()
+}
+
+// callbackPath returns the path of the callback the proxy gave the device.
+func (d *fakeDevice) callbackPath(t *testing.T) string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	u, err := url.Parse(d.callback)
+	if err != nil || !strings.HasPrefix(u.Path, NotifyPrefix) {
+		t.Fatalf("device got callback %q", d.callback)
+	}
+	return u.Path
+}
+
+// fakeControlPoint records the events delivered to it.
+type fakeControlPoint struct {
+	*httptest.Server
+
+	lock   sync.Mutex
+	events []string
+}
+
+func newFakeControlPoint(t *testing.T) *fakeControlPoint {
+	cp := &fakeControlPoint{}
+	cp.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		cp.lock.Lock()
+		defer cp.lock.Unlock()
+		cp.events = append(cp.events, r.Header.Get("SID")+" "+string(body))
+	}))
+	t.Cleanup(cp.Close)
+	return cp
+}
+
+func serveEvent(p *EventProxy, method, target string, header http.Header, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.RemoteAddr = controlPointAddr
+	for k, v := range header {
+		r.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	return w
+}
+
+func subscribe(t *testing.T, p *EventProxy, device *fakeDevice, cp *fakeControlPoint) {
+	t.Helper()
+	w := serveEvent(p, MethodSubscribe, device.eventURL(t), http.Header{
+		"NT":       {"upnp:event"},
+		"CALLBACK": {"<" + cp.URL + "/cb>"},
+		"TIMEOUT":  {"Second-300"},
+	}, "")
+	if w.Code != http.StatusOK || w.Header().Get("SID") != "uuid:device-sid" {
+		t.Fatalf("SUBSCRIBE = %d %v", w.Code, w.Header())
+	}
+}
+
+func TestEventProxy(t *testing.T) {
+	device := newFakeDevice(t)
+	cp := newFakeControlPoint(t)
+	p := &EventProxy{Port: 1}
+
+	subscribe(t, p, device, cp)
+	callback := device.callbackPath(t)
+	if id := strings.TrimPrefix(callback, NotifyPrefix); len(id) != 32 {
+		t.Errorf("callback id %q, want 32 hex digits", id)
+	}
+
+	event := http.Header{"SID": {"uuid:device-sid"}, "NT": {"upnp:event"}, "NTS": {"upnp:propchange"}, "SEQ": {"0"}}
+	if w := serveEvent(p, MethodNotify, "http://proxy.test"+callback, event, "<e:propertyset/>"); w.Code != http.StatusOK {
+		t.Fatalf("NOTIFY = %d", w.Code)
+	}
+	wrongSID := http.Header{"SID": {"uuid:other"}, "NT": {"upnp:event"}, "NTS": {"upnp:propchange"}}
+	if w := serveEvent(p, MethodNotify, "http://proxy.test"+callback, wrongSID, "<forged/>"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("NOTIFY with another SID = %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+	cp.lock.Lock()
+	if len(cp.events) != 1 || cp.events[0] != "uuid:device-sid <e:propertyset/>" {
+		t.Errorf("control point got events %q", cp.events)
+	}
+	cp.lock.Unlock()
+
+	sid := http.Header{"SID": {"uuid:device-sid"}, "TIMEOUT": {"Second-600"}}
+	if w := serveEvent(p, MethodSubscribe, device.eventURL(t), sid, ""); w.Code != http.StatusOK {
+		t.Fatalf("renewing SUBSCRIBE = %d", w.Code)
+	}
+	for _, sub := range p.subscriptions {
+		if until := time.Until(sub.expiry); until < 500*time.Second {
+			t.Errorf("renewed subscription expires in %v", until)
+		}
+	}
+
+	if w := serveEvent(p, MethodUnsubscribe, device.eventURL(t), http.Header{"SID": {"uuid:device-sid"}}, ""); w.Code != http.StatusOK {
+		t.Fatalf("UNSUBSCRIBE = %d", w.Code)
+	}
+	if w := serveEvent(p, MethodNotify, "http://proxy.test"+callback, event, "<late/>"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("NOTIFY after UNSUBSCRIBE = %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	want := []string{"SUBSCRIBE ", "SUBSCRIBE uuid:device-sid", "UNSUBSCRIBE uuid:device-sid"}
+	if strings.Join(device.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("device got %q, want %q", device.requests, want)
+	}
+}
+
+func TestEventProxyRefusesForeignCallback(t *testing.T) {
+	device := newFakeDevice(t)
+	p := &EventProxy{Port: 1}
+
+	w := serveEvent(p, MethodSubscribe, device.eventURL(t), http.Header{
+		"NT":       {"upnp:event"},
+		"CALLBACK": {"<http://10.0.0.9:8080/cb>"},
+	}, "")
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("SUBSCRIBE with a callback on another host = %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	if len(device.requests) != 0 {
+		t.Errorf("device got %q", device.requests)
+	}
+}
+
+func TestEventProxyExpiry(t *testing.T) {
+	device := newFakeDevice(t)
+	cp := newFakeControlPoint(t)
+	now := time.Now()
+	p := &EventProxy{Port: 1, now: func() time.Time { return now }}
+
+	subscribe(t, p, device, cp)
+	now = now.Add(301 * time.Second)
+
+	sid := http.Header{"SID": {"uuid:device-sid"}}
+	if w := serveEvent(p, MethodSubscribe, device.eventURL(t), sid, ""); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("renewing an expired subscription = %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+	if len(p.subscriptions) != 0 {
+		t.Errorf("%d expired subscriptions kept", len(p.subscriptions))
+	}
+}
+
+func TestEventProxyLimit(t *testing.T) {
+	device := newFakeDevice(t)
+	cp := newFakeControlPoint(t)
+	p := &EventProxy{Port: 1, subscriptions: make(map[string]*subscription)}
+	for i := 0; i < maxSubscriptions; i++ {
+		id := fmt.Sprintf("held-%d", i)
+		p.subscriptions[id] = &subscription{id: id, expiry: time.Now().Add(time.Hour)}
+	}
+
+	w := serveEvent(p, MethodSubscribe, device.eventURL(t), http.Header{
+		"NT":       {"upnp:event"},
+		"CALLBACK": {"<" + cp.URL + "/cb>"},
+	}, "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("SUBSCRIBE beyond the limit = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestParseCallbacks(t *testing.T) {
+	ip := net.ParseIP("192.168.1.20")
+	for _, tt := range []struct {
+		header string
+		want   []string
+	}{
+		{"<http://192.168.1.20:49152/cb>", []string{"http://192.168.1.20:49152/cb"}},
+		{"<http://192.168.1.20/a><http://192.168.1.20:8080/b>", []string{"http://192.168.1.20/a", "http://192.168.1.20:8080/b"}},
+		{"", nil},
+		{"http://192.168.1.20/cb", nil},
+		{"<http://192.168.1.20/cb", nil},
+		{"<https://192.168.1.20/cb>", nil},
+		{"</cb>", nil},
+		{"<http://192.168.1.21/cb>", nil},
+		{"<http://192.168.1.20/a><http://10.0.0.1/b>", nil},
+		{"<http://router.local/cb>", nil},
+	} {
+		callbacks, err := parseCallbacks(tt.header, ip)
+		var got []string
+		for _, u := range callbacks {
+			got = append(got, u.String())
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") || (err == nil) != (tt.want != nil) {
+			t.Errorf("parseCallbacks(%q) = %q, %v; want %q", tt.header, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewCallbackID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := newCallbackID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+			t.Errorf("callback id %q, want 32 hex digits", id)
+		}
+		if seen[id] {
+			t.Errorf("callback id %q repeated", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,166 @@
+package upnp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxRewriteBytes bounds the size of a body whose URLs are rewritten; larger
+// bodies are refused rather than passed through with device URLs.
+const maxRewriteBytes = 4 << 20
+
+// urlElementRx matches the elements of device and service descriptions that
+// hold URLs.
+var urlElementRx = regexp.MustCompile(`<(URLBase|SCPDURL|controlURL|eventSubURL|presentationURL|url)>\s*([^<]*?)\s*</`)
+
+// Proxy is a reverse proxy for UPnP devices. It forwards requests for proxied
+// device URLs, see ProxyURL, to the device: descriptions, SOAP control and
+// presentation pages. URLs of the device in XML and HTML responses are
+// rewritten to go through the proxy. GENA requests are passed to Events.
+type Proxy struct {
+	// Events handles SUBSCRIBE, UNSUBSCRIBE and NOTIFY requests. If nil, they
+	// are refused.
+	Events *EventProxy
+	// Allow reports whether a device host:port may be proxied for the
+	// request of a control point. If nil, every host is allowed.
+	Allow func(r *http.Request, hostport string) bool
+	// Transport sends requests to devices. If nil, http.DefaultTransport is
+	// used.
+	Transport http.RoundTripper
+	// Logger reports failures. If nil, slog.Default() is used.
+	Logger *slog.Logger
+}
+
+func (p *Proxy) logger() *slog.Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return slog.Default()
+}
+
+// ServeHTTP forwards r to the device it addresses.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case MethodSubscribe, MethodUnsubscribe, MethodNotify:
+		if p.Events == nil {
+			http.Error(w, "eventing not proxied", http.StatusMethodNotAllowed)
+			return
+		}
+		p.Events.ServeHTTP(w, r)
+		return
+	}
+
+	target, err := targetURL(r.URL)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if p.Allow != nil && !p.Allow(r, target.Host) {
+		http.Error(w, "device not known", http.StatusForbidden)
+		return
+	}
+	// The proxy as the client reached it.
+	base := &url.URL{Scheme: "http", Host: r.Host}
+
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL = target
+			pr.Out.Host = target.Host
+			// Bodies are rewritten, so ask for them uncompressed.
+			pr.Out.Header.Del("Accept-Encoding")
+		},
+		Transport: p.Transport,
+		ModifyResponse: func(res *http.Response) error {
+			return rewriteResponse(res, base, target)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.logger().Warn("upnp: proxying to device failed", "url", target, "error", err)
+			http.Error(w, "device unreachable", http.StatusBadGateway)
+		},
+	}
+	rp.ServeHTTP(w, r)
+}
+
+// rewriteResponse rewrites the URLs of the device at target in the Location
+// header and in XML or HTML bodies of res to go through the proxy at base.
+func rewriteResponse(res *http.Response, base, target *url.URL) error {
+	origin := "http://" + target.Host
+	if location := res.Header.Get("Location"); location != "" {
+		res.Header.Set("Location", rewriteURL(location, base, target.Host))
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/xml", "application/xml", "text/html", "application/xhtml+xml":
+	default:
+		return nil
+	}
+	if res.Header.Get("Content-Encoding") != "" {
+		// Not asked for, and not readable.
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxRewriteBytes+1))
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(body) > maxRewriteBytes {
+		return fmt.Errorf("response from %s larger than %d bytes", origin, maxRewriteBytes)
+	}
+	body = rewriteBody(body, base, target.Host)
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// rewriteBody rewrites the URLs of the device at hostport in an XML or HTML
+// body. Absolute URLs anywhere in the body are rewritten, e.g. media URLs in
+// DIDL-Lite, and so are path-absolute URLs in description elements, which
+// would otherwise resolve against the proxy root.
+func rewriteBody(body []byte, base *url.URL, hostport string) []byte {
+	body = urlElementRx.ReplaceAllFunc(body, func(m []byte) []byte {
+		sub := urlElementRx.FindSubmatch(m)
+		value := string(sub[2])
+		if !strings.HasPrefix(value, "/") || strings.HasPrefix(value, "//") {
+			return m
+		}
+		return []byte("<" + string(sub[1]) + ">" + rewriteURL(value, base, hostport) + "</")
+	})
+	prefix := []byte(ProxyURL(base, &url.URL{Scheme: "http", Host: hostport, Path: "/"}).String())
+	body = bytes.ReplaceAll(body, []byte("http://"+hostport+"/"), prefix)
+	if host, port, _ := net.SplitHostPort(hostport); port == "80" {
+		body = bytes.ReplaceAll(body, []byte("http://"+host+"/"), prefix)
+	}
+	return body
+}
+
+// rewriteURL rewrites a URL of the device at hostport, absolute or
+// path-absolute, to go through the proxy at base. Other URLs are returned
+// unchanged.
+func rewriteURL(s string, base *url.URL, hostport string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	switch {
+	case u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/"):
+		u.Scheme, u.Host = "http", hostport
+	case u.Scheme != "http" || hostPort(u) != hostport:
+		return s
+	}
+	proxied := ProxyURL(base, u)
+	proxied.Fragment = u.Fragment
+	return proxied.String()
+}
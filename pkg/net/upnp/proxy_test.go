@@ -0,0 +1,138 @@
+package upnp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var proxyBase = &url.URL{Scheme: "http", Host: "10.30.0.1:8200"}
+
+func TestTargetURL(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/upnp/10.0.0.2:1400/xml/desc.xml", "http://10.0.0.2:1400/xml/desc.xml"},
+		{"/upnp/10.0.0.2:80/", "http://10.0.0.2:80/"},
+		{"/upnp/10.0.0.2:1400/ctl?a=b", "http://10.0.0.2:1400/ctl?a=b"},
+		{"/base/upnp/10.0.0.2:1400/a%20b", "http://10.0.0.2:1400/a%20b"},
+		{"/upnp/10.0.0.2/desc.xml", ""},
+		{"/desc.xml", ""},
+	} {
+		u, err := url.Parse(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := targetURL(u)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("targetURL(%s) = %s, want error", tt.path, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != tt.want {
+			t.Errorf("targetURL(%s) = %v, %v; want %s", tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestProxyURLRoundTrip(t *testing.T) {
+	for _, target := range []string{
+		"http://10.0.0.2:1400/xml/desc.xml",
+		"http://10.0.0.2:1400/a%20b.xml",
+		"http://10.0.0.2:1400/a%2Fb/c%25d.xml?q=1%202",
+		"http://10.0.0.2/desc.xml",
+	} {
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxied, err := url.Parse(ProxyURL(proxyBase, u).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := targetURL(proxied)
+		if err != nil {
+			t.Errorf("targetURL(%s) = %v", proxied, err)
+			continue
+		}
+		want := strings.Replace(target, "10.0.0.2/", "10.0.0.2:80/", 1)
+		if got.String() != want {
+			t.Errorf("%s proxied as %s targets %s", target, proxied, got)
+		}
+	}
+}
+
+func TestRewriteURL(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"http://10.0.0.2:1400/xml/desc.xml", "http://10.30.0.1:8200/upnp/10.0.0.2:1400/xml/desc.xml"},
+		{"/MediaRenderer/AVTransport/Control", "http://10.30.0.1:8200/upnp/10.0.0.2:1400/MediaRenderer/AVTransport/Control"},
+		{"http://10.0.0.2:1400/art?id=1#top", "http://10.30.0.1:8200/upnp/10.0.0.2:1400/art?id=1#top"},
+		{"http://10.0.0.3:1400/desc.xml", "http://10.0.0.3:1400/desc.xml"},
+		{"https://10.0.0.2:1400/desc.xml", "https://10.0.0.2:1400/desc.xml"},
+		{"relative/path", "relative/path"},
+	} {
+		if got := rewriteURL(tt.in, proxyBase, "10.0.0.2:1400"); got != tt.want {
+			t.Errorf("rewriteURL(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+	if got := rewriteURL("http://10.0.0.2/desc.xml", proxyBase, "10.0.0.2:80"); got != "http://10.30.0.1:8200/upnp/10.0.0.2:80/desc.xml" {
+		t.Errorf("rewriteURL without port = %s", got)
+	}
+}
+
+func TestRewriteBody(t *testing.T) {
+	body := `<root><URLBase>http://10.0.0.2:1400/</URLBase><device>
+<service><SCPDURL>/xml/AVTransport1.xml</SCPDURL><controlURL> /MediaRenderer/AVTransport/Control </controlURL>
+<eventSubURL>relative/Event</eventSubURL></service>
+<presentationURL>//cdn.example/</presentationURL>
+<res>http://10.0.0.2:1400/getaa?u=x</res><other>http://10.0.0.3:1400/x</other></device></root>`
+	want := `<root><URLBase>http://10.30.0.1:8200/upnp/10.0.0.2:1400/</URLBase><device>
+<service><SCPDURL>http://10.30.0.1:8200/upnp/10.0.0.2:1400/xml/AVTransport1.xml</SCPDURL><controlURL>http://10.30.0.1:8200/upnp/10.0.0.2:1400/MediaRenderer/AVTransport/Control</controlURL>
+<eventSubURL>relative/Event</eventSubURL></service>
+<presentationURL>//cdn.example/</presentationURL>
+<res>http://10.30.0.1:8200/upnp/10.0.0.2:1400/getaa?u=x</res><other>http://10.0.0.3:1400/x</other></device></root>`
+	if got := string(rewriteBody([]byte(body), proxyBase, "10.0.0.2:1400")); got != want {
+		t.Errorf("rewriteBody =\n%s\nwant\n%s", got, want)
+	}
+
+	got := string(rewriteBody([]byte(`<a href="http://10.0.0.2/index.html">`), proxyBase, "10.0.0.2:80"))
+	if want := `<a href="http://10.30.0.1:8200/upnp/10.0.0.2:80/index.html">`; got != want {
+		t.Errorf("rewriteBody on port 80 = %s, want %s", got, want)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		_, _ = io.WriteString(w, "<root><URLBase>http://"+r.Host+"/</URLBase></root>")
+	}))
+	defer device.Close()
+	hostport := strings.TrimPrefix(device.URL, "http://")
+
+	allowed := map[string]bool{}
+	p := &Proxy{Allow: func(r *http.Request, hostport string) bool { return allowed[hostport] }}
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://10.30.0.1:8200/upnp/"+hostport+"/desc.xml", nil))
+		return w
+	}
+
+	if w := get(); w.Code != http.StatusForbidden {
+		t.Errorf("GET of a device not allowed = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	allowed[hostport] = true
+	w := get()
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET = %d", w.Code)
+	}
+	if want := "<root><URLBase>http://10.30.0.1:8200/upnp/" + hostport + "/</URLBase></root>"; w.Body.String() != want {
+		t.Errorf("body = %s, want %s", w.Body, want)
+	}
+}
@@ -0,0 +1,56 @@
+// Package upnp proxies UPnP device traffic between VLANs for control points
+// that cannot reach devices directly.
+package upnp
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// TargetPrefix starts the paths of proxied device URLs:
+// <proxy>/upnp/<host:port>/<path>.
+const TargetPrefix = "/upnp/"
+
+var errNotProxied = errors.New("upnp: not a proxied device URL")
+
+// ProxyURL returns the URL through which the proxy at base reaches target.
+func ProxyURL(base *url.URL, target *url.URL) *url.URL {
+	u := *base
+	prefix := TargetPrefix + hostPort(target)
+	u.Path = strings.TrimSuffix(base.Path, "/") + prefix + target.Path
+	u.RawPath = strings.TrimSuffix(base.EscapedPath(), "/") + prefix + target.EscapedPath()
+	u.RawQuery = target.RawQuery
+	return &u
+}
+
+// hostPort returns the host and port of an http URL, with the default port
+// made explicit.
+func hostPort(u *url.URL) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+	return u.Host
+}
+
+// targetURL returns the device URL proxied by a request for u.
+func targetURL(u *url.URL) (*url.URL, error) {
+	path := u.EscapedPath()
+	i := strings.Index(path, TargetPrefix)
+	if i < 0 {
+		return nil, errNotProxied
+	}
+	host, rest, _ := strings.Cut(path[i+len(TargetPrefix):], "/")
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return nil, errNotProxied
+	}
+	return url.Parse("http://" + host + "/" + rest + query(u.RawQuery))
+}
+
+func query(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	return "?" + raw
+}
@@ -0,0 +1,108 @@
+package trace
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/google/gopacket/layers"
+	"github.com/home-sol/multicast-proxy/pkg/net/reflector"
+)
+
+// pcapng block types and options, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+const (
+	blockSectionHeader  = 0x0A0D0D0A
+	blockInterface      = 0x00000001
+	blockEnhancedPacket = 0x00000006
+	byteOrderMagic      = 0x1A2B3C4D
+	optionEndOfOptions  = 0
+	optionComment       = 1
+	interfaceSnapLen    = 65536
+)
+
+// pcapngWriter writes every decision as an Enhanced Packet Block carrying the
+// captured frame, with the decision text as the packet comment. gopacket's
+// pcapgo.NgWriter does not support packet comments.
+type pcapngWriter struct {
+	w io.Writer
+}
+
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	p := &pcapngWriter{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // major version
+	binary.LittleEndian.PutUint16(shb[6:], 0) // minor version
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	if err := p.writeBlock(blockSectionHeader, shb, nil); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], uint16(layers.LinkTypeEthernet))
+	binary.LittleEndian.PutUint32(idb[4:], interfaceSnapLen)
+	if err := p.writeBlock(blockInterface, idb, nil); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *pcapngWriter) Write(d reflector.Decision) error {
+	if len(d.Data) == 0 {
+		return errors.New("pcapng: decision without captured frame")
+	}
+	ts := uint64(d.Time.UnixMicro())
+	if d.Time.IsZero() {
+		ts = 0
+	}
+
+	epb := make([]byte, 20, 20+len(d.Data)+3)
+	binary.LittleEndian.PutUint32(epb[0:], 0) // interface ID
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(d.Data)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(d.Data)))
+	epb = append(epb, d.Data...)
+	epb = pad(epb)
+
+	return p.writeBlock(blockEnhancedPacket, epb, []option{{optionComment, []byte(Format(d))}})
+}
+
+type option struct {
+	code  uint16
+	value []byte
+}
+
+// writeBlock writes a block with the given body and options, framed by the
+// block type and the total length repeated at both ends.
+func (p *pcapngWriter) writeBlock(blockType uint32, body []byte, options []option) error {
+	if len(options) > 0 {
+		for _, o := range options {
+			var hdr [4]byte
+			binary.LittleEndian.PutUint16(hdr[0:], o.code)
+			binary.LittleEndian.PutUint16(hdr[2:], uint16(len(o.value)))
+			body = append(body, hdr[:]...)
+			body = pad(append(body, o.value...))
+		}
+		body = append(body, optionEndOfOptions, 0, 0, 0)
+	}
+
+	length := uint32(12 + len(body))
+	buf := make([]byte, 0, length)
+	buf = binary.LittleEndian.AppendUint32(buf, blockType)
+	buf = binary.LittleEndian.AppendUint32(buf, length)
+	buf = append(buf, body...)
+	buf = binary.LittleEndian.AppendUint32(buf, length)
+	_, err := p.w.Write(buf)
+	return err
+}
+
+// pad extends b to a multiple of 32 bits.
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
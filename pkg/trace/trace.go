@@ -0,0 +1,85 @@
+// Package trace writes forwarding decisions of the reflector as text, JSON
+// lines or pcapng.
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/home-sol/multicast-proxy/pkg/net/reflector"
+)
+
+// Writer writes a stream of decisions.
+type Writer interface {
+	Write(d reflector.Decision) error
+}
+
+// Formats accepted by NewWriter.
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatPcapng = "pcapng"
+)
+
+// NewWriter returns a Writer producing format on w.
+func NewWriter(w io.Writer, format string) (Writer, error) {
+	switch format {
+	case FormatText:
+		return textWriter{w}, nil
+	case FormatJSON:
+		return jsonWriter{json.NewEncoder(w)}, nil
+	case FormatPcapng:
+		return newPcapngWriter(w)
+	default:
+		return nil, fmt.Errorf("invalid trace format %q, expected %s, %s or %s", format, FormatText, FormatJSON, FormatPcapng)
+	}
+}
+
+// NeedsData reports whether format requires the captured frames.
+func NeedsData(format string) bool {
+	return format == FormatPcapng
+}
+
+type textWriter struct {
+	w io.Writer
+}
+
+func (t textWriter) Write(d reflector.Decision) error {
+	_, err := fmt.Fprintln(t.w, Format(d))
+	return err
+}
+
+type jsonWriter struct {
+	enc *json.Encoder
+}
+
+func (j jsonWriter) Write(d reflector.Decision) error {
+	return j.enc.Encode(d)
+}
+
+// Format renders a decision as a single line of text.
+func Format(d reflector.Decision) string {
+	kind := "announce"
+	if d.Query {
+		kind = "query"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s [%4s] vlan %-4d %-8s %s (%s) -> %s: %s",
+		d.Time.Format(time.TimeOnly), d.Protocol, d.VLAN, kind, d.SrcIP, d.SrcMAC, d.Action, d.Reason)
+	if len(d.VLANs) > 0 {
+		fmt.Fprintf(&b, " %v", d.VLANs)
+	}
+	if d.DryRun {
+		b.WriteString(" (dry run)")
+	}
+	if len(d.Queries) > 0 {
+		fmt.Fprintf(&b, " queries=%v", d.Queries)
+	}
+	if len(d.Names) > 0 {
+		fmt.Fprintf(&b, " names=%v", d.Names)
+	}
+	return b.String()
+}